@@ -4,14 +4,22 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/rustyeddy/otto/logging"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/api"
+	"github.com/rustyeddy/otto/messenger/broker"
+	"github.com/rustyeddy/otto/messenger/memory"
+	"github.com/rustyeddy/otto/messenger/metrics"
+	"github.com/rustyeddy/otto/messenger/mqtt"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +30,13 @@ var (
 	logFormat string
 	logOutput string
 	logFile   string
+
+	mqttBroker       string
+	mqttUsername     string
+	mqttPasswordFile string
+	mqttTLS          mqtt.TLSConfig
+	embeddedBroker   string
+	station          string
 )
 
 var rootCmd = &cobra.Command{
@@ -42,6 +57,16 @@ func init() {
 	serveCmd.Flags().StringVar(&logFormat, "log-format", logging.DefaultFormat, "Log format (text, json)")
 	serveCmd.Flags().StringVar(&logOutput, "log-output", logging.DefaultOutput, "Log output (stdout, stderr, file, string)")
 	serveCmd.Flags().StringVar(&logFile, "log-file", "", "Log file path (required when log-output=file)")
+	serveCmd.Flags().StringVar(&mqttBroker, "mqtt-broker", "", "MQTT broker URL, e.g. tcp://localhost:1883 or ssl://broker:8883")
+	serveCmd.Flags().StringVar(&mqttUsername, "mqtt-username", "", "MQTT username (default $"+mqtt.EnvUsername+")")
+	serveCmd.Flags().StringVar(&mqttPasswordFile, "mqtt-password-file", "", "File holding the MQTT password (default $"+mqtt.EnvPassword+")")
+	serveCmd.Flags().StringVar(&mqttTLS.CAFile, "mqtt-ca", "", "CA bundle for the MQTT broker certificate")
+	serveCmd.Flags().StringVar(&mqttTLS.CertFile, "mqtt-cert", "", "Client certificate for MQTT mutual TLS")
+	serveCmd.Flags().StringVar(&mqttTLS.KeyFile, "mqtt-key", "", "Client key for MQTT mutual TLS")
+	serveCmd.Flags().StringVar(&mqttTLS.ServerName, "mqtt-server-name", "", "Name expected in the MQTT broker certificate")
+	serveCmd.Flags().StringVar(&mqttTLS.MinVersion, "mqtt-tls-min", "", "Minimum TLS version for MQTT (1.2, 1.3)")
+	serveCmd.Flags().StringVar(&station, "station", "", "Station name for the MQTT status and will topic (default hostname)")
+	serveCmd.Flags().StringVar(&embeddedBroker, "embedded-broker", "", "Start an embedded MQTT broker on this address, e.g. :1883")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -56,6 +81,9 @@ func runServe(cmd *cobra.Command, args []string) error {
 	if strings.EqualFold(logOutput, "file") && strings.TrimSpace(logFile) == "" {
 		return errors.New("log-output=file requires --log-file")
 	}
+	if embeddedBroker != "" && (mqttBroker != "" || mqttTLS != (mqtt.TLSConfig{})) {
+		return errors.New("--embedded-broker cannot be combined with --mqtt-broker or the --mqtt TLS flags")
+	}
 
 	cfg := logging.Config{
 		Level:    logLevel,
@@ -69,17 +97,82 @@ func runServe(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	brokerURL := mqttBroker
+	if embeddedBroker != "" {
+		// The broker outlives ctx so the registry's offline status and
+		// the client's disconnect still reach it.
+		bctx, bstop := context.WithCancel(context.Background())
+		b := broker.New(broker.Config{Addr: embeddedBroker})
+		if err := b.Start(bctx); err != nil {
+			bstop()
+			return err
+		}
+		defer func() {
+			bstop()
+			b.Wait()
+		}()
+		brokerURL = loopbackURL(b.Addr())
+	}
+
+	// Devices are served from a Registry on the broker, or on an
+	// in-process bus when there is none.
+	var (
+		reg    *messenger.Registry
+		client *mqtt.Paho
+	)
+	if brokerURL != "" {
+		mcfg := mqtt.Config{Broker: brokerURL, Username: mqttUsername, PasswordFile: mqttPasswordFile}
+		if mqttTLS != (mqtt.TLSConfig{}) {
+			mcfg.TLS = &mqttTLS
+		}
+		client = mqtt.New(mcfg)
+		reg = messenger.NewRegistry(client, nil)
+		if station != "" {
+			reg.Station = station
+		}
+		// The will goes out with CONNECT, so set it first.
+		if err := reg.SetStationWill(); err != nil {
+			return err
+		}
+		client.SetOnConnect(func() { reg.ResubscribeAll(ctx) })
+		if err := client.Connect(ctx); err != nil {
+			return err
+		}
+	} else {
+		reg = messenger.NewRegistry(memory.New(), nil)
+		if station != "" {
+			reg.Station = station
+		}
+		reg.ResubscribeAll(ctx)
+	}
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		if err := reg.Run(ctx); err != nil {
+			slog.Error("registry stopped", "error", err)
+		}
+	}()
+
+	devicesAPI := api.New(reg)
+
 	mux := http.NewServeMux()
 	mux.Handle("/api/log", logService)
+	mux.Handle("/api/devices", devicesAPI)
+	mux.Handle("/api/devices/", devicesAPI)
+	mux.Handle("/api/stream", devicesAPI)
+	mux.Handle("/metrics", metrics.Default)
 
 	server := &http.Server{
 		Addr:    serverAddr,
 		Handler: mux,
+		// Requests end with ctx, so the event streams close and let
+		// Shutdown finish.
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
-
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- server.ListenAndServe()
@@ -89,10 +182,16 @@ func runServe(cmd *cobra.Command, args []string) error {
 	case <-ctx.Done():
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			return err
+		err := server.Shutdown(shutdownCtx)
+		// Let the registry publish offline status, then leave the
+		// broker cleanly, even if some request outlived Shutdown.
+		<-runDone
+		if client != nil {
+			if err := client.Disconnect(context.Background()); err != nil {
+				slog.Warn("MQTT disconnect", "error", err)
+			}
 		}
-		return nil
+		return err
 	case err := <-errCh:
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
@@ -100,3 +199,16 @@ func runServe(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 }
+
+// loopbackURL returns a tcp:// URL that reaches a listener on this host:
+// its own IP, or loopback when it listens on every address.
+func loopbackURL(addr net.Addr) string {
+	host, port := "127.0.0.1", "1883"
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		port = strconv.Itoa(tcp.Port)
+		if tcp.IP != nil && !tcp.IP.IsUnspecified() {
+			host = tcp.IP.String()
+		}
+	}
+	return "tcp://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,152 @@
+package messenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Set command outcomes published on a device's ack topic.
+const (
+	AckAccepted = "accepted" // delivered to the device
+	AckRejected = "rejected" // failed to decode or validate
+	AckClamped  = "clamped"  // clamped into range before delivery
+	AckTimeout  = "timeout"  // not taken by the device within CommandTimeout
+	AckApplied  = "applied"  // the device's state now reflects the value
+)
+
+// SetCommand is the JSON envelope for a set command that wants acks:
+// {"id": "c1", "value": 42}. Value is decoded with the sink's codec, so
+// the envelope suits JSON codecs; with others, send the id as MQTT 5
+// correlation data instead. A plain payload is a command without an id.
+type SetCommand struct {
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parseSetCommand returns the command id of a set message and the
+// payload to decode. Rejections, clamps and timeouts are acked for
+// every command; accepted and applied only for commands with an id.
+func parseSetCommand(m Message) (id string, payload []byte) {
+	payload = m.Payload
+	if m.Properties != nil && len(m.Properties.CorrelationData) > 0 {
+		id = string(m.Properties.CorrelationData)
+	}
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return id, payload
+	}
+	// Only an object with exactly "id" and "value" is an envelope, so
+	// struct-valued devices keep their own payloads.
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(trimmed, &fields) != nil || len(fields) != 2 || fields["value"] == nil {
+		return id, payload
+	}
+	var envID string
+	if json.Unmarshal(fields["id"], &envID) != nil || envID == "" {
+		return id, payload
+	}
+	return envID, fields["value"]
+}
+
+// ackTracker remembers, per device, the last accepted command with an
+// id so its applied ack can be sent when the state catches up.
+type ackTracker struct {
+	mu      sync.Mutex
+	pending map[string]*pendingAck
+}
+
+type pendingAck struct {
+	id       string
+	want     []byte // encoded value the state should reach
+	accepted bool   // accepted ack sent
+	applied  bool   // state matched before the accepted ack went out
+}
+
+// expect registers a command about to be delivered. A newer command
+// replaces any pending one, with or without an id. It returns nil when
+// nothing is to be tracked.
+func (t *ackTracker) expect(name, id string, want []byte) *pendingAck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id == "" || want == nil {
+		delete(t.pending, name)
+		return nil
+	}
+	if t.pending == nil {
+		t.pending = map[string]*pendingAck{}
+	}
+	p := &pendingAck{id: id, want: want}
+	t.pending[name] = p
+	return p
+}
+
+// failed drops p after its delivery failed.
+func (t *ackTracker) failed(name string, p *pendingAck) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p != nil && t.pending[name] == p {
+		delete(t.pending, name)
+	}
+}
+
+// accepted records that the accepted ack for p went out. It reports
+// whether the state already reflected the value, in which case the
+// applied ack is due now.
+func (t *ackTracker) accepted(name string, p *pendingAck) (applied bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p == nil || t.pending[name] != p {
+		return false
+	}
+	if p.applied {
+		delete(t.pending, name)
+		return true
+	}
+	p.accepted = true
+	return false
+}
+
+// state checks a published state against the pending command and
+// returns it when the state reflects it.
+func (t *ackTracker) state(name string, b []byte) *pendingAck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.pending[name]
+	if p == nil || !bytes.Equal(bytes.TrimSpace(b), bytes.TrimSpace(p.want)) {
+		return nil
+	}
+	if !p.accepted {
+		p.applied = true
+		return nil
+	}
+	delete(t.pending, name)
+	return p
+}
+
+func (t *ackTracker) forget(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, name)
+}
+
+// publishAck stamps ack and publishes it on the device's ack topic.
+func (r *Registry) publishAck(ctx context.Context, name string, ack AckPayload) {
+	if ack.Time.IsZero() {
+		ack.Time = time.Now()
+	}
+	if b, err := json.Marshal(ack); err == nil {
+		_ = r.publish(ctx, name, Message{Topic: AckTopic(r.Topics, name), Payload: b, QoS: r.QoSSet})
+	}
+}
+
+// stateApplied publishes the applied ack for a pending command the
+// state b now reflects.
+func (r *Registry) stateApplied(name string, b []byte) {
+	if p := r.acks.state(name, b); p != nil {
+		r.publishAck(context.Background(), name, AckPayload{ID: p.id, Status: AckApplied})
+	}
+}
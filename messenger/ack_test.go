@@ -0,0 +1,112 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSetCommand(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		msg     Message
+		id      string
+		payload string
+	}{
+		{name: "plain", msg: Message{Payload: []byte("42")}, payload: "42"},
+		{name: "envelope", msg: Message{Payload: []byte(`{"id":"c1","value":42}`)}, id: "c1", payload: "42"},
+		{name: "struct", msg: Message{Payload: []byte(`{"id":"c1","value":42,"unit":"%"}`)}, payload: `{"id":"c1","value":42,"unit":"%"}`},
+		{name: "numeric id", msg: Message{Payload: []byte(`{"id":1,"value":42}`)}, payload: `{"id":1,"value":42}`},
+		{
+			name:    "correlation data",
+			msg:     Message{Payload: []byte("true"), Properties: &Properties{CorrelationData: []byte("c2")}},
+			id:      "c2",
+			payload: "true",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			id, payload := parseSetCommand(tc.msg)
+			assert.Equal(t, tc.id, id)
+			assert.Equal(t, tc.payload, string(payload))
+		})
+	}
+}
+
+// valve is a duplex device whose state the test drives.
+type valve struct {
+	*testutils.Sink[bool]
+	state *testutils.Source[bool]
+}
+
+func (v valve) Out() <-chan bool { return v.state.Out() }
+
+func TestWireSinkAcks(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newLoopMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Metrics = nil
+	reg.CommandTimeout = 20 * time.Millisecond
+	dev := valve{Sink: testutils.NewSink[bool]("valve", 1), state: testutils.NewSource[bool]("valve", 1)}
+	WireDuplex(ctx, reg, dev, codec.JSON[bool]{})
+
+	acks := make(chan AckPayload, 8)
+	_, err := mqtt.Subscribe(ctx, "otto/devices/valve/ack", 1, func(m Message) {
+		var a AckPayload
+		require.NoError(t, json.Unmarshal(m.Payload, &a))
+		acks <- a
+	})
+	require.NoError(t, err)
+	reg.ResubscribeAll(ctx)
+
+	set := func(payload string) {
+		require.NoError(t, mqtt.Publish(ctx, "otto/devices/valve/set", []byte(payload), false, 1))
+	}
+	next := func(id, status string) AckPayload {
+		t.Helper()
+		ack, ok := testutils.WaitRecv(acks, time.Second)
+		require.True(t, ok, "waiting for %s %s", id, status)
+		assert.Equal(t, id, ack.ID)
+		assert.Equal(t, status, ack.Status)
+		assert.False(t, ack.Time.IsZero())
+		return ack
+	}
+
+	set(`{"id":"c1","value":true}`)
+	assert.True(t, dev.Read())
+	next("c1", AckAccepted)
+	dev.state.Set() <- true
+	next("c1", AckApplied)
+
+	// Only the commanded value completes the command.
+	set(`{"id":"c2","value":false}`)
+	assert.False(t, dev.Read())
+	next("c2", AckAccepted)
+	dev.state.Set() <- true
+	assert.True(t, testutils.WaitNoRecv(acks, 50*time.Millisecond))
+	dev.state.Set() <- false
+	next("c2", AckApplied)
+
+	set(`{"id":"c3","value":"open"}`)
+	assert.Contains(t, next("c3", AckRejected).Error, "cannot unmarshal")
+
+	// Commands without an id are only acked when they fail. The first
+	// fills the device's buffer so the second times out.
+	set("true")
+	assert.True(t, testutils.WaitNoRecv(acks, 50*time.Millisecond))
+	set(`{"id":"c4","value":false}`)
+	assert.Equal(t, ErrSetTimeout.Error(), next("c4", AckTimeout).Error)
+}
@@ -0,0 +1,185 @@
+// Package api serves a Registry's devices over HTTP for clients that
+// cannot speak MQTT.
+//
+//	GET /api/devices               names, meta and status
+//	GET /api/devices/{name}        last state and when it was recorded
+//	PUT /api/devices/{name}        deliver a set value, encoded with the device's codec
+//	GET /api/devices/{name}/events recent events (?limit=n)
+//	GET /api/stream                state, event and status updates over
+//	                               WebSocket or Server-Sent Events
+//
+// Streams accept device, tag and topic query parameters to filter what
+// they receive and start with a snapshot of current status and state.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// MaxSetBody caps the size of a PUT body.
+const MaxSetBody = 1 << 20
+
+// Server is an http.Handler for the device API.
+type Server struct {
+	Registry *messenger.Registry
+
+	// CheckOrigin approves WebSocket stream origins; nil allows only
+	// same-host origins.
+	CheckOrigin func(r *http.Request) bool
+
+	mux     *http.ServeMux
+	hub     hub
+	hubOnce sync.Once
+}
+
+// New returns a Server backed by r.
+func New(r *messenger.Registry) *Server {
+	s := &Server{Registry: r, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /api/devices", s.listDevices)
+	s.mux.HandleFunc("GET /api/devices/{name}", s.getDevice)
+	s.mux.HandleFunc("PUT /api/devices/{name}", s.setDevice)
+	s.mux.HandleFunc("GET /api/devices/{name}/events", s.deviceEvents)
+	s.mux.HandleFunc("GET /api/stream", s.stream)
+	return s
+}
+
+// ServeHTTP routes a request to the device endpoints.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Device is an entry of GET /api/devices.
+type Device struct {
+	Name   string                   `json:"name"`
+	Meta   *messenger.MetaPayload   `json:"meta,omitempty"`
+	Status *messenger.StatusPayload `json:"status,omitempty"`
+}
+
+// State is the body of GET /api/devices/{name}. JSON state is inlined;
+// other encodings (CBOR, MessagePack, ...) are returned base64 in Encoded.
+type State struct {
+	Name    string          `json:"name"`
+	State   json.RawMessage `json:"state,omitempty"`
+	Encoded []byte          `json:"encoded,omitempty"`
+	Time    *time.Time      `json:"time,omitempty"`
+}
+
+func (s *Server) listDevices(w http.ResponseWriter, _ *http.Request) {
+	devs := s.Registry.Devices()
+	out := make([]Device, 0, len(devs))
+	for _, dev := range devs {
+		d := Device{Name: dev.Name()}
+		if desc, ok := messenger.DescriptorOf(dev); ok {
+			meta := messenger.NewMetaPayload(desc)
+			d.Meta = &meta
+		}
+		if st, ok := s.Registry.Status(d.Name); ok {
+			d.Status = &st
+		}
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := s.Registry.Device(name); !ok {
+		writeError(w, http.StatusNotFound, messenger.ErrUnknownDevice)
+		return
+	}
+
+	st := State{Name: name}
+	if raw, ok := s.Registry.StateRaw(name); ok {
+		if json.Valid(raw) {
+			st.State = raw
+		} else {
+			st.Encoded = raw
+		}
+	}
+	if t, ok := s.Registry.StateTime(name); ok {
+		st.Time = &t
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) setDevice(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := s.Registry.Device(name); !ok {
+		writeError(w, http.StatusNotFound, messenger.ErrUnknownDevice)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxSetBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err := s.Registry.Set(r.Context(), name, body); err != nil {
+		writeError(w, setStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deviceEvents(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := s.Registry.Device(name); !ok {
+		writeError(w, http.StatusNotFound, messenger.ErrUnknownDevice)
+		return
+	}
+
+	events := s.Registry.Events(name)
+	if q := r.URL.Query().Get("limit"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a non-negative integer"))
+			return
+		}
+		if n < len(events) {
+			events = events[len(events)-n:]
+		}
+	}
+	if events == nil {
+		events = []messenger.EventPayload{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// setStatus maps a Registry.Set error to an HTTP status.
+func setStatus(err error) int {
+	switch {
+	case errors.Is(err, messenger.ErrNotSettable), errors.Is(err, messenger.ErrReadOnly):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, messenger.ErrOutOfRange):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, messenger.ErrSetTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	// Anything else is the device codec rejecting the body.
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
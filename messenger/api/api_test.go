@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/rustyeddy/otto/messenger/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedSink struct {
+	*testutils.Sink[int]
+	desc devices.Descriptor
+}
+
+func (d describedSink) Descriptor() devices.Descriptor { return d.desc }
+
+func ptr(f float64) *float64 { return &f }
+
+// newTestServer registers a settable "pump" (0..100, tagged
+// "irrigation") and a "temp" source without a descriptor.
+func newTestServer(t *testing.T) (*Server, *messenger.Registry, *testutils.Sink[int], *testutils.Source[float64]) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	reg := messenger.NewRegistry(memory.New(), messenger.TopicScheme{Prefix: "otto"})
+	reg.Metrics = nil
+	reg.CommandTimeout = 20 * time.Millisecond
+
+	sink := testutils.NewSink[int]("pump", 1)
+	pump := describedSink{Sink: sink, desc: devices.Descriptor{
+		Name: "pump", Kind: "speed", ValueType: "int", Access: devices.ReadWrite, Min: ptr(0), Max: ptr(100),
+		Tags: []string{"irrigation"},
+	}}
+	reg.Add(pump)
+	messenger.WireSink(ctx, reg, pump, codec.JSON[int]{})
+
+	src := testutils.NewSource[float64]("temp", 1)
+	reg.Add(src)
+	messenger.WireSource(ctx, reg, src, codec.JSON[float64]{})
+
+	return New(reg), reg, sink, src
+}
+
+func do(t *testing.T, s http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func TestListDevices(t *testing.T) {
+	t.Parallel()
+
+	s, _, _, _ := newTestServer(t)
+	rec := do(t, s, http.MethodGet, "/api/devices", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var got []Device
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	require.Len(t, got, 2)
+	assert.Equal(t, "pump", got[0].Name)
+	require.NotNil(t, got[0].Meta)
+	assert.Equal(t, "speed", got[0].Meta.Kind)
+	assert.Equal(t, "temp", got[1].Name)
+	assert.Nil(t, got[1].Meta)
+}
+
+func TestGetDeviceState(t *testing.T) {
+	t.Parallel()
+
+	s, reg, _, src := newTestServer(t)
+
+	rec := do(t, s, http.MethodGet, "/api/devices/temp", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"name":"temp"}`, rec.Body.String())
+
+	src.Set() <- 21.5
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if _, ok := reg.StateRaw("temp"); !ok {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}))
+
+	rec = do(t, s, http.MethodGet, "/api/devices/temp", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var st State
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st))
+	assert.JSONEq(t, "21.5", string(st.State))
+	require.NotNil(t, st.Time)
+	assert.WithinDuration(t, time.Now(), *st.Time, time.Second)
+
+	rec = do(t, s, http.MethodGet, "/api/devices/nope", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSetDevice(t *testing.T) {
+	t.Parallel()
+
+	s, _, sink, _ := newTestServer(t)
+
+	rec := do(t, s, http.MethodPut, "/api/devices/pump", "42")
+	require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+	v, ok := testutils.WaitRecv(sink.Get(), time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 42, v)
+
+	tests := []struct {
+		target, body string
+		want         int
+	}{
+		{"/api/devices/pump", "150", http.StatusUnprocessableEntity},
+		{"/api/devices/pump", `"fast"`, http.StatusBadRequest},
+		{"/api/devices/temp", "1", http.StatusMethodNotAllowed},
+		{"/api/devices/nope", "1", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		rec := do(t, s, http.MethodPut, tc.target, tc.body)
+		assert.Equal(t, tc.want, rec.Code, "%s %s: %s", tc.target, tc.body, rec.Body.String())
+	}
+
+	// The one-slot sink is full: delivery times out.
+	require.Equal(t, http.StatusNoContent, do(t, s, http.MethodPut, "/api/devices/pump", "1").Code)
+	rec = do(t, s, http.MethodPut, "/api/devices/pump", "2")
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestDeviceEvents(t *testing.T) {
+	t.Parallel()
+
+	s, _, _, _ := newTestServer(t)
+
+	rec := do(t, s, http.MethodGet, "/api/devices/pump/events", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, "[]", rec.Body.String())
+
+	// Rejected sets are recorded as set_rejected events.
+	do(t, s, http.MethodPut, "/api/devices/pump", "150")
+	do(t, s, http.MethodPut, "/api/devices/pump", "-5")
+
+	rec = do(t, s, http.MethodGet, "/api/devices/pump/events?limit=1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var events []messenger.EventPayload
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 1)
+	assert.Equal(t, "set_rejected", events[0].Kind)
+	assert.Contains(t, events[0].Err, "-5")
+
+	rec = do(t, s, http.MethodGet, "/api/devices/pump/events?limit=x", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
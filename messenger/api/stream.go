@@ -0,0 +1,292 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// Stream message types.
+const (
+	TypeState  = "state"
+	TypeEvent  = "event"
+	TypeStatus = "status"
+)
+
+// StreamBuffer is how many messages a stream client may fall behind
+// before newer messages are dropped for it.
+const StreamBuffer = 256
+
+// Keepalive intervals for idle streams.
+const (
+	ssePing = 15 * time.Second
+	wsPing  = 30 * time.Second
+)
+
+// StreamMessage is one update pushed on /api/stream. Exactly one of
+// State/Encoded, Event or Status is set, according to Type.
+type StreamMessage struct {
+	Type     string                   `json:"type"`
+	Device   string                   `json:"device"`
+	Topic    string                   `json:"topic"`
+	Time     time.Time                `json:"time"`
+	Snapshot bool                     `json:"snapshot,omitempty"` // sent on connect
+	State    json.RawMessage          `json:"state,omitempty"`
+	Encoded  []byte                   `json:"encoded,omitempty"` // non-JSON state
+	Event    *messenger.EventPayload  `json:"event,omitempty"`
+	Status   *messenger.StatusPayload `json:"status,omitempty"`
+}
+
+// StreamFilter selects the messages a stream client receives. Each
+// non-empty list must match (any of its entries); empty lists match
+// everything.
+type StreamFilter struct {
+	Devices []string // device names
+	Tags    []string // descriptor tags
+	Topics  []string // MQTT filters, '+' and '#' allowed
+}
+
+// ParseStreamFilter reads device, tag and topic query parameters. Each
+// may repeat or hold a comma separated list.
+func ParseStreamFilter(q map[string][]string) (StreamFilter, error) {
+	split := func(key string) []string {
+		var out []string
+		for _, v := range q[key] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					out = append(out, s)
+				}
+			}
+		}
+		return out
+	}
+	f := StreamFilter{Devices: split("device"), Tags: split("tag"), Topics: split("topic")}
+	for _, t := range f.Topics {
+		if err := messenger.ValidateFilter(t); err != nil {
+			return f, fmt.Errorf("topic %q: %w", t, err)
+		}
+	}
+	return f, nil
+}
+
+func (s *Server) matches(f StreamFilter, m StreamMessage) bool {
+	if len(f.Devices) > 0 && !slices.Contains(f.Devices, m.Device) {
+		return false
+	}
+	if len(f.Topics) > 0 && !slices.ContainsFunc(f.Topics, func(t string) bool { return messenger.MatchTopic(t, m.Topic) }) {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		dev, ok := s.Registry.Device(m.Device)
+		if !ok {
+			return false
+		}
+		desc, ok := messenger.DescriptorOf(dev)
+		if !ok || !slices.ContainsFunc(f.Tags, func(t string) bool { return slices.Contains(desc.Tags, t) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// hub fans Registry updates out to stream clients.
+type hub struct {
+	mu      sync.Mutex
+	clients map[*client]struct{}
+}
+
+type client struct {
+	filter StreamFilter
+	ch     chan StreamMessage
+}
+
+// watch registers the Registry hooks feeding the hub, once.
+func (s *Server) watch() {
+	s.hubOnce.Do(func() {
+		r := s.Registry
+		r.OnState(func(name string, raw []byte, _ any) {
+			m := StreamMessage{Type: TypeState, Device: name, Topic: r.Topics.State(name), Time: time.Now()}
+			setState(&m, raw)
+			s.broadcast(m)
+		})
+		r.OnEvent(func(name string, ev messenger.EventPayload) {
+			s.broadcast(StreamMessage{Type: TypeEvent, Device: name, Topic: r.Topics.Event(name), Time: ev.Time, Event: &ev})
+		})
+		r.OnStatus(func(name string, st messenger.StatusPayload) {
+			s.broadcast(StreamMessage{Type: TypeStatus, Device: name, Topic: r.Topics.Status(name), Time: st.Time, Status: &st})
+		})
+	})
+}
+
+func (s *Server) broadcast(m StreamMessage) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	for c := range s.hub.clients {
+		if !s.matches(c.filter, m) {
+			continue
+		}
+		select {
+		case c.ch <- m:
+		default:
+			// Slow client: drop rather than stall the Registry.
+		}
+	}
+}
+
+// subscribe registers a client and queues its snapshot: the current
+// status and state of every matching device.
+func (s *Server) subscribe(f StreamFilter) *client {
+	s.watch()
+	c := &client{filter: f, ch: make(chan StreamMessage, StreamBuffer)}
+
+	// Holding the hub lock orders the snapshot before any update
+	// broadcast after it.
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	r := s.Registry
+	var snap []StreamMessage
+	for _, dev := range r.Devices() {
+		name := dev.Name()
+		if st, ok := r.Status(name); ok {
+			snap = append(snap, StreamMessage{Type: TypeStatus, Device: name, Topic: r.Topics.Status(name), Time: st.Time, Status: &st, Snapshot: true})
+		}
+		if raw, ok := r.StateRaw(name); ok {
+			m := StreamMessage{Type: TypeState, Device: name, Topic: r.Topics.State(name), Snapshot: true}
+			m.Time, _ = r.StateTime(name)
+			setState(&m, raw)
+			snap = append(snap, m)
+		}
+	}
+
+	for _, m := range snap {
+		if s.matches(f, m) {
+			select {
+			case c.ch <- m:
+			default:
+			}
+		}
+	}
+	if s.hub.clients == nil {
+		s.hub.clients = map[*client]struct{}{}
+	}
+	s.hub.clients[c] = struct{}{}
+	return c
+}
+
+func (s *Server) unsubscribe(c *client) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	delete(s.hub.clients, c)
+}
+
+func setState(m *StreamMessage, raw []byte) {
+	if json.Valid(raw) {
+		m.State = raw
+	} else {
+		m.Encoded = raw
+	}
+}
+
+// stream serves /api/stream as a WebSocket when the request asks for an
+// upgrade and as Server-Sent Events otherwise.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseStreamFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		s.streamWS(w, r, f)
+		return
+	}
+	s.streamSSE(w, r, f)
+}
+
+func (s *Server) streamSSE(w http.ResponseWriter, r *http.Request, f StreamFilter) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	c := s.subscribe(f)
+	defer s.unsubscribe(c)
+
+	ping := time.NewTicker(ssePing)
+	defer ping.Stop()
+	for {
+		select {
+		case m := <-c.ch:
+			b, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, b); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) streamWS(w http.ResponseWriter, r *http.Request, f StreamFilter) {
+	up := websocket.Upgrader{CheckOrigin: s.CheckOrigin}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+	defer conn.Close()
+
+	c := s.subscribe(f)
+	defer s.unsubscribe(c)
+
+	// The stream is one-way; reading surfaces the client closing.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPing)
+	defer ping.Stop()
+	for {
+		select {
+		case m := <-c.ch:
+			if err := conn.WriteJSON(m); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
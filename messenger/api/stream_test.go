@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := ParseStreamFilter(map[string][]string{
+		"device": {"pump,temp", "fan"},
+		"tag":    {"garden"},
+		"topic":  {"otto/devices/+/state"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pump", "temp", "fan"}, f.Devices)
+	assert.Equal(t, []string{"garden"}, f.Tags)
+	assert.Equal(t, []string{"otto/devices/+/state"}, f.Topics)
+
+	_, err = ParseStreamFilter(map[string][]string{"topic": {"otto/#/state"}})
+	assert.ErrorIs(t, err, messenger.ErrInvalidFilter)
+}
+
+func TestStreamFilterMatches(t *testing.T) {
+	t.Parallel()
+
+	s, _, _, _ := newTestServer(t)
+	pump := StreamMessage{Type: TypeState, Device: "pump", Topic: "otto/devices/pump/state"}
+	temp := StreamMessage{Type: TypeEvent, Device: "temp", Topic: "otto/devices/temp/event"}
+
+	tests := []struct {
+		filter     StreamFilter
+		pump, temp bool
+	}{
+		{StreamFilter{}, true, true},
+		{StreamFilter{Devices: []string{"temp"}}, false, true},
+		{StreamFilter{Topics: []string{"otto/devices/+/state"}}, true, false},
+		{StreamFilter{Topics: []string{"otto/#"}, Devices: []string{"pump"}}, true, false},
+		{StreamFilter{Tags: []string{"irrigation"}}, true, false},
+		{StreamFilter{Tags: []string{"indoor"}}, false, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.pump, s.matches(tc.filter, pump), "%+v", tc.filter)
+		assert.Equal(t, tc.temp, s.matches(tc.filter, temp), "%+v", tc.filter)
+	}
+}
+
+// readSSE returns the next data message on an event stream.
+func readSSE(t *testing.T, sc *bufio.Scanner) StreamMessage {
+	t.Helper()
+	var event string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var m StreamMessage
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m))
+			assert.Equal(t, m.Type, event)
+			return m
+		}
+	}
+	require.FailNow(t, "stream ended", "%v", sc.Err())
+	return StreamMessage{}
+}
+
+func TestStreamSSE(t *testing.T) {
+	t.Parallel()
+
+	s, reg, _, src := newTestServer(t)
+	src.Set() <- 20
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if _, ok := reg.StateRaw("temp"); !ok {
+			return assert.AnError
+		}
+		return nil
+	}))
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL + "/api/stream?device=temp")
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sc := bufio.NewScanner(resp.Body)
+	snap := readSSE(t, sc)
+	assert.True(t, snap.Snapshot)
+	assert.Equal(t, TypeState, snap.Type)
+	assert.JSONEq(t, "20", string(snap.State))
+
+	// pump is filtered out; only temp's update arrives.
+	do(t, s, http.MethodPut, "/api/devices/pump", "150")
+	src.Set() <- 21.5
+
+	m := readSSE(t, sc)
+	assert.False(t, m.Snapshot)
+	assert.Equal(t, "temp", m.Device)
+	assert.Equal(t, "otto/devices/temp/state", m.Topic)
+	assert.JSONEq(t, "21.5", string(m.State))
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	t.Parallel()
+
+	s, reg, _, _ := newTestServer(t)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/stream?topic=otto/devices/pump/%2B"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	// Wait until the stream is subscribed before producing updates.
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		s.hub.mu.Lock()
+		defer s.hub.mu.Unlock()
+		if len(s.hub.clients) == 0 {
+			return assert.AnError
+		}
+		return nil
+	}))
+
+	do(t, s, http.MethodPut, "/api/devices/pump", "150")
+
+	var m StreamMessage
+	require.NoError(t, conn.ReadJSON(&m))
+	assert.Equal(t, TypeEvent, m.Type)
+	require.NotNil(t, m.Event)
+	assert.Equal(t, "set_rejected", m.Event.Kind)
+
+	_ = reg.Remove(t.Context(), "pump")
+	require.NoError(t, conn.ReadJSON(&m))
+	assert.Equal(t, TypeStatus, m.Type)
+	require.NotNil(t, m.Status)
+	assert.Equal(t, messenger.StatusOffline, m.Status.Status)
+}
@@ -0,0 +1,193 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Availability follows device and station status topics and derives
+// each device's effective availability: a device is available while its
+// own status and the status of the station it runs on are both online.
+// A station whose status has not been seen does not hold its devices
+// down.
+//
+// Devices are told apart by station, so stations may reuse device
+// names.
+//
+// A station's will only updates the station status topic. With
+// Republish set, Availability also publishes offline, retained, on the
+// status topic of each device the station had online, so subscribers
+// that only watch device status see the loss too. The station
+// republishes its devices' status when it reconnects.
+//
+// Status topics are found by passing "+" to Registry.Topics, so the
+// scheme must place names in a level of their own. With StationScheme
+// that covers one station; use Station "+" to follow them all.
+type Availability struct {
+	Registry *Registry
+
+	// Publish offline for a station's devices when its will fires.
+	Republish bool
+
+	mu       sync.Mutex
+	stations map[string]string          // station -> status
+	devices  map[DeviceKey]deviceStatus // last status per device
+	hooks    []AvailabilityFunc
+}
+
+// DeviceKey names a device on a station.
+type DeviceKey struct {
+	Station string
+	Device  string
+}
+
+// deviceStatus is the last status seen for a device and the topic it
+// came on, where a Republish goes.
+type deviceStatus struct {
+	st    StatusPayload
+	topic string
+}
+
+// AvailabilityFunc observes a change in a device's effective
+// availability.
+type AvailabilityFunc func(key DeviceKey, available bool)
+
+// OnChange registers fn to be called when a device becomes available or
+// unavailable. fn must not block.
+func (a *Availability) OnChange(fn AvailabilityFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hooks = append(a.hooks, fn)
+}
+
+// Available reports whether device on station is available. ok is
+// false for devices whose status has not been seen.
+func (a *Availability) Available(station, device string) (available, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d, ok := a.devices[DeviceKey{station, device}]
+	if !ok {
+		return false, false
+	}
+	return a.availableLocked(d.st), true
+}
+
+// Devices returns the effective availability of every device seen.
+func (a *Availability) Devices() map[DeviceKey]bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[DeviceKey]bool, len(a.devices))
+	for key, d := range a.devices {
+		out[key] = a.availableLocked(d.st)
+	}
+	return out
+}
+
+// Run subscribes to device and station status topics and tracks them
+// until ctx ends.
+func (a *Availability) Run(ctx context.Context) error {
+	r := a.Registry
+	a.mu.Lock()
+	if a.stations == nil {
+		a.stations = map[string]string{}
+		a.devices = map[DeviceKey]deviceStatus{}
+	}
+	a.mu.Unlock()
+
+	dev := r.WantSub(r.Topics.Status("+"), r.QoSStatus, a.deviceStatus)
+	defer dev.Unsubscribe()
+	station := r.WantSub(StationStatusTopic(r.Topics, "+"), r.QoSStatus, func(m Message) { a.stationStatus(ctx, m) })
+	defer station.Unsubscribe()
+
+	<-ctx.Done()
+	return nil
+}
+
+func (a *Availability) availableLocked(st StatusPayload) bool {
+	if st.Status != StatusOnline {
+		return false
+	}
+	s, ok := a.stations[st.Station]
+	return !ok || s == StatusOnline
+}
+
+func (a *Availability) deviceStatus(m Message) {
+	var st StatusPayload
+	// An empty retained payload clears the topic (see ClearRetained).
+	if len(m.Payload) == 0 || json.Unmarshal(m.Payload, &st) != nil || st.Device == "" {
+		return
+	}
+
+	key := DeviceKey{st.Station, st.Device}
+	a.mu.Lock()
+	old, seen := a.devices[key]
+	was := seen && a.availableLocked(old.st)
+	a.devices[key] = deviceStatus{st: st, topic: m.Topic}
+	now := a.availableLocked(st)
+	hooks := a.hooks
+	a.mu.Unlock()
+
+	if now != was || !seen {
+		for _, fn := range hooks {
+			fn(key, now)
+		}
+	}
+}
+
+func (a *Availability) stationStatus(ctx context.Context, m Message) {
+	var st StatusPayload
+	if len(m.Payload) == 0 || json.Unmarshal(m.Payload, &st) != nil || st.Station == "" || st.Device != "" {
+		return
+	}
+
+	a.mu.Lock()
+	before := map[DeviceKey]bool{}
+	for key, d := range a.devices {
+		if key.Station == st.Station {
+			before[key] = a.availableLocked(d.st)
+		}
+	}
+	a.stations[st.Station] = st.Status
+
+	type change struct {
+		key DeviceKey
+		now bool
+	}
+	var changes []change
+	var lost []deviceStatus
+	for key, was := range before {
+		d := a.devices[key]
+		if now := a.availableLocked(d.st); now != was {
+			changes = append(changes, change{key, now})
+		}
+		if st.Status != StatusOnline && d.st.Status == StatusOnline {
+			lost = append(lost, d)
+		}
+	}
+	hooks := a.hooks
+	a.mu.Unlock()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].key.Device < changes[j].key.Device })
+	for _, c := range changes {
+		for _, fn := range hooks {
+			fn(c.key, c.now)
+		}
+	}
+
+	if !a.Republish {
+		return
+	}
+	r := a.Registry
+	sort.Slice(lost, func(i, j int) bool { return lost[i].st.Device < lost[j].st.Device })
+	for _, d := range lost {
+		off := StatusPayload{Device: d.st.Device, Station: d.st.Station, Status: StatusOffline, Error: "station " + st.Status, Time: time.Now()}
+		b, _ := json.Marshal(off)
+		msg := Message{Topic: d.topic, Payload: b, Retain: true, QoS: r.QoSStatus}
+		if err := PublishMessage(ctx, r.MQTT, msg); err != nil {
+			r.Log.Warn("availability republish failed", "device", d.st.Device, "station", d.st.Station, "error", err)
+		}
+	}
+}
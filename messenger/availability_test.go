@@ -0,0 +1,104 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishStatusJSON(t *testing.T, m MQTT, topic string, st StatusPayload) {
+	t.Helper()
+	b, err := json.Marshal(st)
+	require.NoError(t, err)
+	require.NoError(t, PublishMessage(context.Background(), m, Message{Topic: topic, Payload: b, Retain: true}))
+}
+
+func TestAvailabilityFollowsStation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	loop := newLoopMQTT()
+	reg := NewRegistry(loop, TopicScheme{Prefix: "otto"})
+	reg.ResubscribeAll(ctx)
+
+	a := &Availability{Registry: reg, Republish: true}
+	var mu sync.Mutex
+	changes := map[DeviceKey][]bool{}
+	a.OnChange(func(key DeviceKey, available bool) {
+		mu.Lock()
+		changes[key] = append(changes[key], available)
+		mu.Unlock()
+	})
+	go func() { _ = a.Run(ctx) }()
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if len(reg.subs.Filters()) != 2 {
+			return errors.New("not subscribed")
+		}
+		return nil
+	}))
+
+	// Republished offline statuses are visible to other subscribers.
+	var offline []StatusPayload
+	reg.WantSub("otto/devices/+/status", 1, func(m Message) {
+		var st StatusPayload
+		require.NoError(t, json.Unmarshal(m.Payload, &st))
+		if st.Status == StatusOffline {
+			mu.Lock()
+			offline = append(offline, st)
+			mu.Unlock()
+		}
+	})
+
+	station := StationStatusTopic(reg.Topics, "garden")
+	publishStatusJSON(t, loop, station, StatusPayload{Station: "garden", Status: StatusOnline})
+	publishStatusJSON(t, loop, reg.Topics.Status("lamp"), StatusPayload{Device: "lamp", Station: "garden", Status: StatusOnline})
+	publishStatusJSON(t, loop, reg.Topics.Status("pump"), StatusPayload{Device: "pump", Station: "garden", Status: StatusDegraded})
+	publishStatusJSON(t, loop, reg.Topics.Status("fan"), StatusPayload{Device: "fan", Station: "shed", Status: StatusOnline})
+	// Another station's lamp is a different device.
+	publishStatusJSON(t, loop, "otto/devices/shed-lamp/status", StatusPayload{Device: "lamp", Station: "shed", Status: StatusOnline})
+
+	gardenLamp, shedLamp := DeviceKey{"garden", "lamp"}, DeviceKey{"shed", "lamp"}
+	ok, seen := a.Available("garden", "lamp")
+	assert.True(t, ok && seen)
+	assert.Equal(t, map[DeviceKey]bool{
+		gardenLamp: true, {"garden", "pump"}: false, {"shed", "fan"}: true, shedLamp: true,
+	}, a.Devices())
+	_, seen = a.Available("garden", "valve")
+	assert.False(t, seen)
+	_, seen = a.Available("shed", "pump")
+	assert.False(t, seen)
+
+	// The station's will fires.
+	publishStatusJSON(t, loop, station, StatusPayload{Station: "garden", Status: StatusOffline})
+	assert.Equal(t, map[DeviceKey]bool{
+		gardenLamp: false, {"garden", "pump"}: false, {"shed", "fan"}: true, shedLamp: true,
+	}, a.Devices())
+
+	mu.Lock()
+	assert.Equal(t, []bool{true, false}, changes[gardenLamp])
+	assert.Equal(t, []bool{true}, changes[shedLamp])
+	assert.Equal(t, []bool{false}, changes[DeviceKey{"garden", "pump"}])
+	assert.Equal(t, []bool{true}, changes[DeviceKey{"shed", "fan"}])
+	require.Len(t, offline, 1, "only devices that were online are republished")
+	assert.Equal(t, "lamp", offline[0].Device)
+	assert.Equal(t, "garden", offline[0].Station)
+	assert.Equal(t, "station offline", offline[0].Error)
+	mu.Unlock()
+
+	// The station is back; its devices follow once it republishes them.
+	publishStatusJSON(t, loop, station, StatusPayload{Station: "garden", Status: StatusOnline})
+	ok, _ = a.Available("garden", "lamp")
+	assert.False(t, ok)
+	publishStatusJSON(t, loop, reg.Topics.Status("lamp"), StatusPayload{Device: "lamp", Station: "garden", Status: StatusOnline})
+	ok, _ = a.Available("garden", "lamp")
+	assert.True(t, ok)
+}
@@ -0,0 +1,303 @@
+// Package broker implements a small embedded MQTT 3.1.1 broker.
+//
+// It accepts clients over TCP and, optionally, WebSocket, authenticates
+// them against a static user list, keeps retained messages in memory and
+// publishes wills when clients drop. Sessions are not persisted: every
+// connection starts clean, and outbound QoS is capped at 1.
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// Config configures a Broker.
+type Config struct {
+	Addr   string // TCP listen address, e.g. ":1883"; empty disables TCP
+	WSAddr string // WebSocket listen address, e.g. ":8083"; empty disables WebSocket
+	WSPath string // WebSocket path; defaults to "/mqtt"
+
+	// Users maps usernames to passwords. When empty, anonymous clients
+	// are accepted.
+	Users map[string]string
+
+	// QueueSize bounds each client's outbound queue; messages beyond it
+	// are dropped. Defaults to 256.
+	QueueSize int
+
+	// ConnectTimeout bounds how long a new connection may take to send
+	// CONNECT. Defaults to 10s.
+	ConnectTimeout time.Duration
+}
+
+// Broker is an embedded MQTT broker.
+type Broker struct {
+	cfg Config
+
+	mu       sync.RWMutex
+	sessions map[string]*session // key=client id
+	retained map[string]messenger.Message
+	autoID   uint64
+	closing  bool // set by shutdown; no new sessions are registered
+
+	tcp  net.Listener
+	wsLn net.Listener
+	ws   *http.Server
+
+	wg sync.WaitGroup
+}
+
+// New returns a Broker for cfg. Call Start or Run to begin serving.
+func New(cfg Config) *Broker {
+	if cfg.WSPath == "" {
+		cfg.WSPath = "/mqtt"
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 256
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 10 * time.Second
+	}
+	return &Broker{
+		cfg:      cfg,
+		sessions: map[string]*session{},
+		retained: map[string]messenger.Message{},
+	}
+}
+
+// Start binds the configured listeners and serves clients in the
+// background until ctx is canceled. Use Wait to block until shutdown has
+// finished.
+func (b *Broker) Start(ctx context.Context) error {
+	if b.cfg.Addr == "" && b.cfg.WSAddr == "" {
+		return errors.New("broker: no listen address configured")
+	}
+
+	if b.cfg.Addr != "" {
+		ln, err := net.Listen("tcp", b.cfg.Addr)
+		if err != nil {
+			return fmt.Errorf("broker: listen tcp: %w", err)
+		}
+		b.tcp = ln
+		b.wg.Add(1)
+		go b.acceptTCP(ln)
+		slog.Info("MQTT broker listening", "addr", ln.Addr().String())
+	}
+
+	if b.cfg.WSAddr != "" {
+		ln, err := net.Listen("tcp", b.cfg.WSAddr)
+		if err != nil {
+			if b.tcp != nil {
+				_ = b.tcp.Close()
+			}
+			return fmt.Errorf("broker: listen websocket: %w", err)
+		}
+		b.wsLn = ln
+		mux := http.NewServeMux()
+		mux.HandleFunc(b.cfg.WSPath, b.serveWS)
+		b.ws = &http.Server{Handler: mux}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			if err := b.ws.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("MQTT websocket listener failed", "error", err)
+			}
+		}()
+		slog.Info("MQTT broker listening", "addr", ln.Addr().String(), "transport", "websocket")
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		<-ctx.Done()
+		b.shutdown()
+	}()
+
+	return nil
+}
+
+// Run starts the broker and blocks until ctx is canceled and all
+// connections are closed.
+func (b *Broker) Run(ctx context.Context) error {
+	if err := b.Start(ctx); err != nil {
+		return err
+	}
+	b.Wait()
+	return nil
+}
+
+// Wait blocks until the broker has shut down.
+func (b *Broker) Wait() { b.wg.Wait() }
+
+// Addr returns the TCP listener address, or nil if TCP is disabled.
+func (b *Broker) Addr() net.Addr {
+	if b.tcp == nil {
+		return nil
+	}
+	return b.tcp.Addr()
+}
+
+// WSAddr returns the WebSocket listener address, or nil if disabled.
+func (b *Broker) WSAddr() net.Addr {
+	if b.wsLn == nil {
+		return nil
+	}
+	return b.wsLn.Addr()
+}
+
+// Publish injects a message into the broker as if a client had sent it.
+func (b *Broker) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	if err := messenger.ValidateTopic(topic); err != nil {
+		return err
+	}
+	b.route(messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+	return nil
+}
+
+// Retained returns the retained message stored for topic, if any.
+func (b *Broker) Retained(topic string) (messenger.Message, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// Clients returns the ids of connected clients.
+func (b *Broker) Clients() []string {
+	b.mu.RLock()
+	ids := make([]string, 0, len(b.sessions))
+	for id := range b.sessions {
+		ids = append(ids, id)
+	}
+	b.mu.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+func (b *Broker) acceptTCP(ln net.Listener) {
+	defer b.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("MQTT accept failed", "error", err)
+			}
+			return
+		}
+		b.serve(c)
+	}
+}
+
+// serve handles one client connection in its own goroutine.
+func (b *Broker) serve(c conn) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		newSession(b, c).run()
+	}()
+}
+
+func (b *Broker) shutdown() {
+	if b.tcp != nil {
+		_ = b.tcp.Close()
+	}
+	if b.ws != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = b.ws.Shutdown(shutdownCtx)
+		cancel()
+	}
+
+	b.mu.Lock()
+	b.closing = true
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+func (b *Broker) authenticate(username string, password []byte, hasUser bool) bool {
+	if len(b.cfg.Users) == 0 {
+		return true
+	}
+	if !hasUser {
+		return false
+	}
+	want, ok := b.cfg.Users[username]
+	return subtle.ConstantTimeCompare([]byte(want), password) == 1 && ok
+}
+
+// register adds s under its client id and returns any session it
+// replaces. It returns false once shutdown has begun.
+func (b *Broker) register(s *session) (*session, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		return nil, false
+	}
+	if s.id == "" {
+		b.autoID++
+		s.id = fmt.Sprintf("otto-auto-%d", b.autoID)
+	}
+	old := b.sessions[s.id]
+	b.sessions[s.id] = s
+	return old, true
+}
+
+func (b *Broker) unregister(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+// route stores retained messages and forwards m to matching sessions.
+func (b *Broker) route(m messenger.Message) {
+	b.mu.Lock()
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		if qos, ok := s.match(m.Topic); ok {
+			s.send(m.Topic, m.Payload, false, min(qos, m.QoS))
+		}
+	}
+}
+
+func (b *Broker) retainedFor(filter string) []messenger.Message {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var out []messenger.Message
+	for topic, m := range b.retained {
+		if messenger.MatchTopic(filter, topic) {
+			out = append(out, m)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Topic < out[j].Topic })
+	return out
+}
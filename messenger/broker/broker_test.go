@@ -0,0 +1,263 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startBroker(t *testing.T, cfg Config) *Broker {
+	t.Helper()
+
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := New(cfg)
+	require.NoError(t, b.Start(ctx))
+	t.Cleanup(func() {
+		cancel()
+		b.Wait()
+	})
+	return b
+}
+
+func connect(t *testing.T, url, id string, configure func(*paho.ClientOptions)) paho.Client {
+	t.Helper()
+
+	opts := paho.NewClientOptions().
+		AddBroker(url).
+		SetClientID(id).
+		SetAutoReconnect(false).
+		SetConnectTimeout(2 * time.Second)
+	if configure != nil {
+		configure(opts)
+	}
+	c := paho.NewClient(opts)
+	tok := c.Connect()
+	require.True(t, tok.WaitTimeout(2*time.Second))
+	require.NoError(t, tok.Error())
+	t.Cleanup(func() { c.Disconnect(0) })
+	return c
+}
+
+func subscribe(t *testing.T, c paho.Client, filter string, qos byte) chan paho.Message {
+	t.Helper()
+
+	ch := make(chan paho.Message, 16)
+	tok := c.Subscribe(filter, qos, func(_ paho.Client, m paho.Message) { ch <- m })
+	require.True(t, tok.WaitTimeout(2*time.Second))
+	require.NoError(t, tok.Error())
+	return ch
+}
+
+func recv(t *testing.T, ch chan paho.Message) paho.Message {
+	t.Helper()
+
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "message not received")
+		return nil
+	}
+}
+
+func tcpURL(b *Broker) string { return "tcp://" + b.Addr().String() }
+
+func TestPublishSubscribeWildcards(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{})
+	sub := connect(t, tcpURL(b), "sub", nil)
+	pub := connect(t, tcpURL(b), "pub", nil)
+
+	ch := subscribe(t, sub, "otto/devices/+/state", 1)
+
+	tok := pub.Publish("otto/devices/lamp/state", 1, false, []byte("true"))
+	require.True(t, tok.WaitTimeout(2*time.Second))
+	require.NoError(t, tok.Error())
+
+	m := recv(t, ch)
+	assert.Equal(t, "otto/devices/lamp/state", m.Topic())
+	assert.Equal(t, []byte("true"), m.Payload())
+	assert.Equal(t, byte(1), m.Qos())
+	assert.False(t, m.Retained())
+}
+
+func TestRetainedReplay(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{})
+	pub := connect(t, tcpURL(b), "pub", nil)
+	tok := pub.Publish("otto/devices/lamp/meta", 1, true, []byte(`{"name":"lamp"}`))
+	require.True(t, tok.WaitTimeout(2*time.Second))
+
+	sub := connect(t, tcpURL(b), "sub", nil)
+	m := recv(t, subscribe(t, sub, "otto/#", 0))
+	assert.Equal(t, "otto/devices/lamp/meta", m.Topic())
+	assert.True(t, m.Retained())
+
+	_, ok := b.Retained("otto/devices/lamp/meta")
+	assert.True(t, ok)
+}
+
+func TestWillPublishedWhenClientDrops(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{})
+	watcher := connect(t, tcpURL(b), "watcher", nil)
+	ch := subscribe(t, watcher, "otto/devices/+/status", 1)
+
+	// A raw connection lets the test drop the socket without DISCONNECT.
+	c, err := net.Dial("tcp", b.Addr().String())
+	require.NoError(t, err)
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "station"
+	cp.WillFlag = true
+	cp.WillTopic = "otto/devices/lamp/status"
+	cp.WillMessage = []byte("offline")
+	cp.WillQos = 1
+	require.NoError(t, cp.Write(c))
+	ack, err := packets.ReadPacket(c)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Accepted), ack.(*packets.ConnackPacket).ReturnCode)
+	require.NoError(t, c.Close())
+
+	m := recv(t, ch)
+	assert.Equal(t, "otto/devices/lamp/status", m.Topic())
+	assert.Equal(t, []byte("offline"), m.Payload())
+}
+
+func TestWillNotPublishedOnDisconnect(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{})
+	watcher := connect(t, tcpURL(b), "watcher", nil)
+	ch := subscribe(t, watcher, "#", 1)
+
+	station := connect(t, tcpURL(b), "station", func(o *paho.ClientOptions) {
+		o.SetWill("otto/devices/lamp/status", "offline", 1, true)
+	})
+	station.Disconnect(100)
+
+	select {
+	case m := <-ch:
+		require.Failf(t, "unexpected message", "topic %s", m.Topic())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{Users: map[string]string{"otto": "secret"}})
+
+	connect(t, tcpURL(b), "good", func(o *paho.ClientOptions) {
+		o.SetUsername("otto").SetPassword("secret")
+	})
+
+	opts := paho.NewClientOptions().
+		AddBroker(tcpURL(b)).
+		SetClientID("bad").
+		SetUsername("otto").
+		SetPassword("wrong").
+		SetAutoReconnect(false)
+	c := paho.NewClient(opts)
+	tok := c.Connect()
+	require.True(t, tok.WaitTimeout(2*time.Second))
+	assert.Error(t, tok.Error())
+}
+
+func TestShutdownRefusesPendingHandshake(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := New(Config{Addr: "127.0.0.1:0"})
+	require.NoError(t, b.Start(ctx))
+
+	// Accepted before shutdown, CONNECT sent after it.
+	c, err := net.Dial("tcp", b.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	cancel()
+	require.Eventually(t, func() bool {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return b.closing
+	}, time.Second, time.Millisecond)
+
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.CleanSession = true
+	cp.ClientIdentifier = "late"
+	require.NoError(t, cp.Write(c))
+	ack, err := packets.ReadPacket(c)
+	require.NoError(t, err)
+	assert.Equal(t, byte(packets.ErrRefusedServerUnavailable), ack.(*packets.ConnackPacket).ReturnCode)
+
+	b.Wait()
+	assert.Empty(t, b.Clients())
+}
+
+func TestWebSocketListener(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{WSAddr: "127.0.0.1:0"})
+	sub := connect(t, "ws://"+b.WSAddr().String()+"/mqtt", "ws-sub", nil)
+	ch := subscribe(t, sub, "otto/devices/+/set", 1)
+
+	require.NoError(t, b.Publish("otto/devices/pump/set", []byte("1"), false, 1))
+
+	m := recv(t, ch)
+	assert.Equal(t, "otto/devices/pump/set", m.Topic())
+	assert.Equal(t, []byte("1"), m.Payload())
+}
+
+func TestClientTakeover(t *testing.T) {
+	t.Parallel()
+
+	b := startBroker(t, Config{})
+	connect(t, tcpURL(b), "dup", nil)
+	connect(t, tcpURL(b), "dup", nil)
+
+	assert.Eventually(t, func() bool {
+		return len(b.Clients()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStartRequiresAddress(t *testing.T) {
+	t.Parallel()
+
+	b := New(Config{})
+	require.Error(t, b.Start(context.Background()))
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := New(Config{Addr: "127.0.0.1:0"})
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "broker did not stop")
+	}
+}
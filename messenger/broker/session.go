@@ -0,0 +1,335 @@
+package broker
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// maxQoS is the highest QoS the broker grants to subscribers.
+const maxQoS = 1
+
+// conn is the transport a session runs over (TCP or WebSocket).
+type conn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+}
+
+// session is one connected client.
+type session struct {
+	b    *Broker
+	conn conn
+	id   string
+
+	out       chan packets.ControlPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	subs    map[string]byte // filter -> granted qos
+	will    *messenger.Message
+	nextID  uint16
+	inbound map[uint16]struct{} // QoS 2 publishes awaiting PUBREL
+}
+
+func newSession(b *Broker, c conn) *session {
+	return &session{
+		b:       b,
+		conn:    c,
+		out:     make(chan packets.ControlPacket, b.cfg.QueueSize),
+		done:    make(chan struct{}),
+		subs:    map[string]byte{},
+		inbound: map[uint16]struct{}{},
+	}
+}
+
+func (s *session) run() {
+	defer s.conn.Close()
+
+	keepalive, ok := s.handshake()
+	if !ok {
+		return
+	}
+
+	go s.writeLoop()
+
+	err := s.readLoop(keepalive)
+	s.b.unregister(s)
+
+	s.mu.Lock()
+	will := s.will
+	s.will = nil
+	s.mu.Unlock()
+
+	// A clean DISCONNECT clears the will; any other exit is a dropped client.
+	if will != nil && err != nil {
+		slog.Info("MQTT client lost; publishing will", "client", s.id, "topic", will.Topic, "error", err)
+		s.b.route(*will)
+	}
+	s.close()
+}
+
+// handshake reads CONNECT, authenticates and registers the session.
+func (s *session) handshake() (time.Duration, bool) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.b.cfg.ConnectTimeout))
+	pkt, err := packets.ReadPacket(s.conn)
+	if err != nil {
+		return 0, false
+	}
+	cp, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		slog.Warn("MQTT client sent packet before CONNECT", "remote", s.conn.RemoteAddr().String())
+		return 0, false
+	}
+
+	rc := cp.Validate()
+	if rc == packets.Accepted && !s.b.authenticate(cp.Username, cp.Password, cp.UsernameFlag) {
+		rc = packets.ErrRefusedNotAuthorised
+	}
+	if rc != packets.Accepted {
+		slog.Warn("MQTT connect refused", "client", cp.ClientIdentifier, "code", rc)
+		if rc != packets.ErrProtocolViolation {
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = rc
+			_ = writePacket(s.conn, ack)
+		}
+		return 0, false
+	}
+
+	s.id = cp.ClientIdentifier
+	if cp.WillFlag {
+		s.will = &messenger.Message{
+			Topic:   cp.WillTopic,
+			Payload: cp.WillMessage,
+			Retain:  cp.WillRetain,
+			QoS:     cp.WillQos,
+		}
+	}
+
+	old, ok := s.b.register(s)
+	if !ok {
+		// Shutting down: shutdown has already closed the sessions it
+		// knows of, so this one must not start.
+		ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		ack.ReturnCode = packets.ErrRefusedServerUnavailable
+		_ = writePacket(s.conn, ack)
+		return 0, false
+	}
+	if old != nil {
+		slog.Info("MQTT client taken over", "client", s.id)
+		old.close()
+	}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = packets.Accepted
+	if err := writePacket(s.conn, ack); err != nil {
+		s.b.unregister(s)
+		return 0, false
+	}
+
+	slog.Info("MQTT client connected", "client", s.id, "remote", s.conn.RemoteAddr().String())
+	return time.Duration(cp.Keepalive) * time.Second, true
+}
+
+// readLoop processes client packets. It returns nil on a clean DISCONNECT.
+func (s *session) readLoop(keepalive time.Duration) error {
+	for {
+		if keepalive > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2))
+		} else {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		}
+
+		pkt, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			return err
+		}
+
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			if err := s.handlePublish(p); err != nil {
+				return err
+			}
+
+		case *packets.PubrelPacket:
+			s.mu.Lock()
+			delete(s.inbound, p.MessageID)
+			s.mu.Unlock()
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			s.enqueue(comp)
+
+		case *packets.PubackPacket, *packets.PubcompPacket:
+			// Outbound QoS 1 is fire-and-forget; nothing is retried.
+
+		case *packets.SubscribePacket:
+			s.handleSubscribe(p)
+
+		case *packets.UnsubscribePacket:
+			s.mu.Lock()
+			for _, f := range p.Topics {
+				delete(s.subs, f)
+			}
+			s.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			s.enqueue(ack)
+
+		case *packets.PingreqPacket:
+			s.enqueue(packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			s.mu.Lock()
+			s.will = nil
+			s.mu.Unlock()
+			return nil
+
+		default:
+			return packets.ErrorProtocolViolation
+		}
+	}
+}
+
+func (s *session) handlePublish(p *packets.PublishPacket) error {
+	if err := messenger.ValidateTopic(p.TopicName); err != nil {
+		return err
+	}
+
+	m := messenger.Message{Topic: p.TopicName, Payload: p.Payload, Retain: p.Retain, QoS: p.Qos}
+
+	switch p.Qos {
+	case 0:
+		s.b.route(m)
+	case 1:
+		s.b.route(m)
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		s.enqueue(ack)
+	case 2:
+		// Route once per packet id even if the client retransmits.
+		s.mu.Lock()
+		_, seen := s.inbound[p.MessageID]
+		s.inbound[p.MessageID] = struct{}{}
+		s.mu.Unlock()
+		if !seen {
+			s.b.route(m)
+		}
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		s.enqueue(rec)
+	default:
+		return packets.ErrorProtocolViolation
+	}
+	return nil
+}
+
+func (s *session) handleSubscribe(p *packets.SubscribePacket) {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	granted := map[string]byte{}
+	s.mu.Lock()
+	for i, f := range p.Topics {
+		if messenger.ValidateFilter(f) != nil {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		qos := min(p.Qoss[i], maxQoS)
+		s.subs[f] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+		granted[f] = qos
+	}
+	s.mu.Unlock()
+
+	s.enqueue(ack)
+
+	for f, qos := range granted {
+		for _, m := range s.b.retainedFor(f) {
+			s.send(m.Topic, m.Payload, true, min(qos, m.QoS))
+		}
+	}
+}
+
+// match returns the highest granted QoS among filters matching topic.
+func (s *session) match(topic string) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		best  byte
+		found bool
+	)
+	for f, qos := range s.subs {
+		if messenger.MatchTopic(f, topic) {
+			found = true
+			best = max(best, qos)
+		}
+	}
+	return best, found
+}
+
+func (s *session) send(topic string, payload []byte, retain bool, qos byte) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Retain = retain
+	p.Qos = qos
+	if qos > 0 {
+		s.mu.Lock()
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		p.MessageID = s.nextID
+		s.mu.Unlock()
+	}
+	s.enqueue(p)
+}
+
+func (s *session) enqueue(p packets.ControlPacket) {
+	select {
+	case s.out <- p:
+	case <-s.done:
+	default:
+		slog.Warn("MQTT client queue full; dropping packet", "client", s.id)
+	}
+}
+
+func (s *session) writeLoop() {
+	for {
+		select {
+		case p := <-s.out:
+			if err := writePacket(s.conn, p); err != nil {
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the session and its connection. It is safe to call more than once.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+// writePacket encodes p in one Write so framed transports get whole packets.
+func writePacket(w io.Writer, p packets.ControlPacket) error {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{"mqtt", "mqttv3.1"},
+	CheckOrigin:  func(*http.Request) bool { return true },
+}
+
+func (b *Broker) serveWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("MQTT websocket upgrade failed", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	b.serve(&wsConn{Conn: ws})
+}
+
+// wsConn adapts a WebSocket to the byte stream MQTT packets are read from.
+// Each outbound packet is sent as one binary message.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
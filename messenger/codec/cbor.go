@@ -0,0 +1,17 @@
+package codec
+
+import "github.com/fxamacker/cbor/v2"
+
+// cborDec accepts invalid UTF-8 in text strings, which the encoder
+// passes through, so every encoded value decodes again.
+var cborDec, _ = cbor.DecOptions{UTF8: cbor.UTF8DecodeInvalid}.DecMode()
+
+// CBOR encodes values as CBOR (RFC 8949), a compact binary form of the
+// JSON data model suited to metered links.
+type CBOR[T any] struct{}
+
+func (CBOR[T]) Marshal(v T) ([]byte, error)   { return cbor.Marshal(v) }
+func (CBOR[T]) Unmarshal(b []byte) (T, error) { var v T; return v, cborDec.Unmarshal(b, &v) }
+
+// ContentType returns the MIME type of CBOR payloads.
+func (CBOR[T]) ContentType() string { return "application/cbor" }
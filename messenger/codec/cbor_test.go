@@ -0,0 +1,54 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reading struct {
+	Name  string  `json:"name" cbor:"name" msgpack:"name"`
+	Value float64 `json:"value" cbor:"value" msgpack:"value"`
+	Count int64   `json:"count" cbor:"count" msgpack:"count"`
+	OK    bool    `json:"ok" cbor:"ok" msgpack:"ok"`
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	c := CBOR[reading]{}
+	in := reading{Name: "soil", Value: 21.5, Count: 3, OK: true}
+
+	raw, err := c.Marshal(in)
+	require.NoError(t, err)
+	jraw, err := JSON[reading]{}.Marshal(in)
+	require.NoError(t, err)
+	assert.Less(t, len(raw), len(jraw))
+
+	got, err := c.Unmarshal(raw)
+	require.NoError(t, err)
+	assert.Equal(t, in, got)
+
+	_, err = CBOR[int]{}.Unmarshal([]byte{0x61, 'x'})
+	assert.Error(t, err)
+	assert.Equal(t, "application/cbor", c.ContentType())
+}
+
+func FuzzCBORRoundTrip(f *testing.F) {
+	f.Add("soil", 21.5, int64(3), true)
+	f.Add("", 0.0, int64(-1), false)
+	f.Add("\xff", 1.0, int64(0), true) // invalid UTF-8
+	f.Fuzz(func(t *testing.T, name string, value float64, count int64, ok bool) {
+		if value != value { // NaN never compares equal
+			return
+		}
+		c := CBOR[reading]{}
+		in := reading{Name: name, Value: value, Count: count, OK: ok}
+		raw, err := c.Marshal(in)
+		require.NoError(t, err)
+		got, err := c.Unmarshal(raw)
+		require.NoError(t, err)
+		assert.Equal(t, in, got)
+	})
+}
@@ -4,3 +4,9 @@ type Codec[T any] interface {
 	Marshal(v T) ([]byte, error)
 	Unmarshal(b []byte) (T, error)
 }
+
+// ContentTyper is implemented by codecs that know the MIME type of their
+// encoding. MQTT 5 clients send it as the content-type property.
+type ContentTyper interface {
+	ContentType() string
+}
@@ -6,3 +6,6 @@ type JSON[T any] struct{}
 
 func (JSON[T]) Marshal(v T) ([]byte, error)   { return json.Marshal(v) }
 func (JSON[T]) Unmarshal(b []byte) (T, error) { var v T; return v, json.Unmarshal(b, &v) }
+
+// ContentType returns the MIME type of JSON payloads.
+func (JSON[T]) ContentType() string { return "application/json" }
@@ -27,3 +27,12 @@ func TestJSONUnmarshalInvalid(t *testing.T) {
 	_, err := c.Unmarshal([]byte(`"not-an-int"`))
 	require.Error(t, err)
 }
+
+func TestJSONContentType(t *testing.T) {
+	t.Parallel()
+
+	var c Codec[int] = JSON[int]{}
+	ct, ok := c.(ContentTyper)
+	require.True(t, ok)
+	assert.Equal(t, "application/json", ct.ContentType())
+}
@@ -0,0 +1,12 @@
+package codec
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MsgPack encodes values as MessagePack.
+type MsgPack[T any] struct{}
+
+func (MsgPack[T]) Marshal(v T) ([]byte, error)   { return msgpack.Marshal(v) }
+func (MsgPack[T]) Unmarshal(b []byte) (T, error) { var v T; return v, msgpack.Unmarshal(b, &v) }
+
+// ContentType returns the MIME type of MessagePack payloads.
+func (MsgPack[T]) ContentType() string { return "application/msgpack" }
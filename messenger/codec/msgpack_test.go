@@ -0,0 +1,46 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	c := MsgPack[reading]{}
+	in := reading{Name: "soil", Value: 21.5, Count: 3, OK: true}
+
+	raw, err := c.Marshal(in)
+	require.NoError(t, err)
+	got, err := c.Unmarshal(raw)
+	require.NoError(t, err)
+	assert.Equal(t, in, got)
+
+	b, err := MsgPack[bool]{}.Marshal(true)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xc3}, b)
+
+	_, err = MsgPack[int]{}.Unmarshal([]byte{0xa1, 'x'})
+	assert.Error(t, err)
+	assert.Equal(t, "application/msgpack", c.ContentType())
+}
+
+func FuzzMsgPackRoundTrip(f *testing.F) {
+	f.Add("soil", 21.5, int64(3), true)
+	f.Add("", 0.0, int64(-1), false)
+	f.Fuzz(func(t *testing.T, name string, value float64, count int64, ok bool) {
+		if value != value { // NaN never compares equal
+			return
+		}
+		c := MsgPack[reading]{}
+		in := reading{Name: name, Value: value, Count: count, OK: ok}
+		raw, err := c.Marshal(in)
+		require.NoError(t, err)
+		got, err := c.Unmarshal(raw)
+		require.NoError(t, err)
+		assert.Equal(t, in, got)
+	})
+}
@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Text encodes scalars as bare strings, e.g. "21.5", "42" or "true", as
+// many off-the-shelf devices and dashboards publish them. T must be a
+// string, bool, integer or float type (named types included).
+type Text[T any] struct{}
+
+func (Text[T]) Marshal(v T) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return []byte(rv.String()), nil
+	case reflect.Bool:
+		return strconv.AppendBool(nil, rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(nil, rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.AppendUint(nil, rv.Uint(), 10), nil
+	case reflect.Float32:
+		return strconv.AppendFloat(nil, rv.Float(), 'g', -1, 32), nil
+	case reflect.Float64:
+		return strconv.AppendFloat(nil, rv.Float(), 'g', -1, 64), nil
+	}
+	return nil, fmt.Errorf("text codec: unsupported type %T", v)
+}
+
+func (Text[T]) Unmarshal(b []byte) (T, error) {
+	var v T
+	rv := reflect.ValueOf(&v).Elem()
+	s := string(b)
+	if rv.Kind() != reflect.String {
+		s = strings.TrimSpace(s)
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Bool:
+		x, err := parseBool(s)
+		if err != nil {
+			return v, err
+		}
+		rv.SetBool(x)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(s, 10, rv.Type().Bits())
+		if err != nil {
+			return v, err
+		}
+		rv.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := strconv.ParseUint(s, 10, rv.Type().Bits())
+		if err != nil {
+			return v, err
+		}
+		rv.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, rv.Type().Bits())
+		if err != nil {
+			return v, err
+		}
+		rv.SetFloat(x)
+	default:
+		return v, fmt.Errorf("text codec: unsupported type %T", v)
+	}
+	return v, nil
+}
+
+// ContentType returns the MIME type of plain-text payloads.
+func (Text[T]) ContentType() string { return "text/plain" }
+
+// Bool encodes booleans as a fixed pair of words, e.g. "ON"/"OFF".
+// Unmarshal matches On and Off case-insensitively and also accepts the
+// usual spellings: true/false, 1/0, on/off and yes/no.
+type Bool struct {
+	On  string
+	Off string
+}
+
+var (
+	// OnOff encodes booleans as "ON"/"OFF".
+	OnOff = Bool{On: "ON", Off: "OFF"}
+	// OneZero encodes booleans as "1"/"0".
+	OneZero = Bool{On: "1", Off: "0"}
+)
+
+func (c Bool) Marshal(v bool) ([]byte, error) {
+	if v {
+		return []byte(c.On), nil
+	}
+	return []byte(c.Off), nil
+}
+
+func (c Bool) Unmarshal(b []byte) (bool, error) {
+	s := strings.TrimSpace(string(b))
+	switch {
+	case c.On != "" && strings.EqualFold(s, c.On):
+		return true, nil
+	case c.Off != "" && strings.EqualFold(s, c.Off):
+		return false, nil
+	}
+	return parseBool(s)
+}
+
+// ContentType returns the MIME type of plain-text payloads.
+func (Bool) ContentType() string { return "text/plain" }
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "1", "on", "yes":
+		return true, nil
+	case "false", "0", "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("text codec: invalid bool %q", s)
+}
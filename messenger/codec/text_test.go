@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextScalars(t *testing.T) {
+	t.Parallel()
+
+	b, err := Text[float64]{}.Marshal(21.5)
+	require.NoError(t, err)
+	assert.Equal(t, "21.5", string(b))
+
+	f, err := Text[float64]{}.Unmarshal([]byte(" 21.5\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 21.5, f)
+
+	type celsius float32
+	c, err := Text[celsius]{}.Unmarshal([]byte("-4.25"))
+	require.NoError(t, err)
+	assert.Equal(t, celsius(-4.25), c)
+
+	n, err := Text[int8]{}.Unmarshal([]byte("-12"))
+	require.NoError(t, err)
+	assert.Equal(t, int8(-12), n)
+	_, err = Text[int8]{}.Unmarshal([]byte("300"))
+	assert.Error(t, err)
+
+	on, err := Text[bool]{}.Unmarshal([]byte("on"))
+	require.NoError(t, err)
+	assert.True(t, on)
+
+	s, err := Text[string]{}.Unmarshal([]byte(" keep spaces "))
+	require.NoError(t, err)
+	assert.Equal(t, " keep spaces ", s)
+
+	_, err = Text[[]int]{}.Marshal([]int{1})
+	assert.Error(t, err)
+	_, err = Text[struct{}]{}.Unmarshal([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestBoolWords(t *testing.T) {
+	t.Parallel()
+
+	b, err := OnOff.Marshal(true)
+	require.NoError(t, err)
+	assert.Equal(t, "ON", string(b))
+	b, err = OneZero.Marshal(false)
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(b))
+
+	for in, want := range map[string]bool{"ON": true, "off": false, "1": true, "false": false, " Yes ": true} {
+		got, err := OnOff.Unmarshal([]byte(in))
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	custom := Bool{On: "OPEN", Off: "CLOSED"}
+	got, err := custom.Unmarshal([]byte("closed"))
+	require.NoError(t, err)
+	assert.False(t, got)
+
+	_, err = OnOff.Unmarshal([]byte("maybe"))
+	assert.Error(t, err)
+
+	var c Codec[bool] = OnOff
+	assert.Equal(t, "text/plain", c.(ContentTyper).ContentType())
+}
+
+func FuzzTextFloat64(f *testing.F) {
+	for _, seed := range []float64{0, 21.5, -1e-9, math.MaxFloat64, math.Inf(1), math.NaN()} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, v float64) {
+		c := Text[float64]{}
+		b, err := c.Marshal(v)
+		require.NoError(t, err)
+		got, err := c.Unmarshal(b)
+		require.NoError(t, err)
+		if math.IsNaN(v) {
+			assert.True(t, math.IsNaN(got))
+			return
+		}
+		assert.Equal(t, v, got)
+	})
+}
+
+func FuzzTextInt64(f *testing.F) {
+	for _, seed := range []int64{0, -1, math.MaxInt64, math.MinInt64} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, v int64) {
+		c := Text[int64]{}
+		b, err := c.Marshal(v)
+		require.NoError(t, err)
+		got, err := c.Unmarshal(b)
+		require.NoError(t, err)
+		assert.Equal(t, v, got)
+	})
+}
+
+func FuzzBoolUnmarshal(f *testing.F) {
+	for _, seed := range []string{"ON", "off", "1", "0", "true", "", "garbage"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, c := range []Bool{OnOff, OneZero} {
+			v, err := c.Unmarshal([]byte(s))
+			if err != nil {
+				continue
+			}
+			b, err := c.Marshal(v)
+			require.NoError(t, err)
+			again, err := c.Unmarshal(b)
+			require.NoError(t, err)
+			assert.Equal(t, v, again)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// publishEvent records ev in the device's history and publishes it on
+// its event topic.
+func (r *Registry) publishEvent(ctx context.Context, name string, ev EventPayload) {
+	r.eventMu.Lock()
+	if r.EventHistory > 0 {
+		h := append(r.events[name], ev)
+		if len(h) > r.EventHistory {
+			h = append(h[:0:0], h[len(h)-r.EventHistory:]...)
+		}
+		r.events[name] = h
+	}
+	hooks := r.eventHooks
+	r.eventMu.Unlock()
+
+	for _, fn := range hooks {
+		fn(name, ev)
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		r.Metrics.marshalError(name)
+		return
+	}
+	_ = r.publish(ctx, name, Message{Topic: r.Topics.Event(name), Payload: b, QoS: r.QoSEvent})
+}
+
+// EventFunc observes a device event.
+type EventFunc func(name string, ev EventPayload)
+
+// OnEvent registers fn to be called for each device event before it is
+// published. fn must not block.
+func (r *Registry) OnEvent(fn EventFunc) {
+	r.eventMu.Lock()
+	defer r.eventMu.Unlock()
+	r.eventHooks = append(r.eventHooks, fn)
+}
+
+// Events returns a device's most recent events, oldest first, up to
+// EventHistory of them.
+func (r *Registry) Events(name string) []EventPayload {
+	r.eventMu.Lock()
+	defer r.eventMu.Unlock()
+	return append([]EventPayload(nil), r.events[name]...)
+}
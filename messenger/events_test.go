@@ -0,0 +1,45 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsKeepsRecentHistory(t *testing.T) {
+	t.Parallel()
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.EventHistory = 2
+	var seen []string
+	reg.OnEvent(func(name string, ev EventPayload) { seen = append(seen, name+":"+ev.Msg) })
+
+	ctx := context.Background()
+	for _, msg := range []string{"one", "two", "three"} {
+		reg.reportSet(ctx, "pump", AckPayload{Status: "rejected", Error: msg})
+	}
+
+	got := reg.Events("pump")
+	require.Len(t, got, 2)
+	assert.Equal(t, "two", got[0].Msg)
+	assert.Equal(t, "three", got[1].Msg)
+	assert.Equal(t, "set_rejected", got[1].Kind)
+	assert.Empty(t, reg.Events("lamp"))
+	assert.Equal(t, []string{"pump:one", "pump:two", "pump:three"}, seen)
+
+	publishes, _, _, _ := mqtt.snapshot()
+	var events []EventPayload
+	for _, call := range publishes {
+		if call.topic == "otto/devices/pump/event" {
+			var ev EventPayload
+			require.NoError(t, json.Unmarshal(call.body, &ev))
+			events = append(events, ev)
+		}
+	}
+	require.Len(t, events, 3)
+	assert.Equal(t, "one", events[0].Err)
+}
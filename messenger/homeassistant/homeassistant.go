@@ -0,0 +1,297 @@
+// Package homeassistant publishes Home Assistant MQTT discovery configs
+// for otto devices, so they appear in Home Assistant without YAML.
+//
+// Each device with a descriptor becomes one entity whose config is
+// retained at <prefix>/<component>/<id>/config and points at the
+// Registry's existing state, set and status topics.
+package homeassistant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// DefaultPrefix is Home Assistant's default discovery prefix.
+const DefaultPrefix = "homeassistant"
+
+// Descriptor attributes that override the derived config.
+const (
+	AttrComponent   = "ha_component"
+	AttrDeviceClass = "ha_device_class"
+)
+
+// Device describes the Home Assistant device entities are grouped under.
+type Device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// Availability points Home Assistant at a device or station status topic.
+type Availability struct {
+	Topic               string `json:"topic"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+}
+
+// Config is a discovery config. Fields that do not apply to a component
+// are left empty.
+type Config struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	ObjectID          string         `json:"object_id,omitempty"`
+	StateTopic        string         `json:"state_topic,omitempty"`
+	CommandTopic      string         `json:"command_topic,omitempty"`
+	Availability      []Availability `json:"availability,omitempty"`
+	AvailabilityMode  string         `json:"availability_mode,omitempty"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	StateClass        string         `json:"state_class,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string         `json:"payload_on,omitempty"`
+	PayloadOff        string         `json:"payload_off,omitempty"`
+	StateOn           string         `json:"state_on,omitempty"`
+	StateOff          string         `json:"state_off,omitempty"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+	Step              float64        `json:"step,omitempty"`
+	Device            *Device        `json:"device,omitempty"`
+}
+
+// Publisher emits discovery configs for a Registry's devices.
+type Publisher struct {
+	Registry *messenger.Registry
+
+	// Prefix is the discovery prefix. Defaults to "homeassistant".
+	Prefix string
+
+	// NodeID namespaces unique ids, e.g. the station name, so several
+	// stations can expose devices with the same name.
+	NodeID string
+
+	// Device, if set, groups all entities under one HA device.
+	Device *Device
+}
+
+// New returns a Publisher for r with the default prefix.
+func New(r *messenger.Registry, nodeID string) *Publisher {
+	return &Publisher{Registry: r, Prefix: DefaultPrefix, NodeID: nodeID}
+}
+
+// Component picks the Home Assistant component for a descriptor, or ""
+// if it has no sensible mapping. The ha_component attribute overrides it.
+func Component(desc devices.Descriptor) string {
+	if c := desc.Attributes[AttrComponent]; c != "" {
+		return c
+	}
+	writable := desc.Access == devices.ReadWrite || desc.Access == devices.WriteOnly
+	switch {
+	case desc.ValueType == "bool":
+		if writable {
+			return "switch"
+		}
+		return "binary_sensor"
+	case isNumeric(desc.ValueType):
+		if writable {
+			return "number"
+		}
+		return "sensor"
+	}
+	return ""
+}
+
+func statusAvailability(topic string) Availability {
+	return Availability{
+		Topic:               topic,
+		ValueTemplate:       "{{ 'online' if value_json.status == 'online' else 'offline' }}",
+		PayloadAvailable:    "online",
+		PayloadNotAvailable: "offline",
+	}
+}
+
+// BuildConfig returns the component and discovery config for desc.
+// ok is false when the descriptor has no Home Assistant mapping.
+func (p *Publisher) BuildConfig(desc devices.Descriptor) (component string, cfg Config, ok bool) {
+	component = Component(desc)
+	if component == "" {
+		return "", Config{}, false
+	}
+
+	topics := p.Registry.Topics
+	id := p.uniqueID(desc.Name)
+	cfg = Config{
+		Name:     desc.Name,
+		UniqueID: id,
+		ObjectID: id,
+		// starting, degraded and error all mean unavailable. The
+		// station status carries the connection's will, so the device
+		// is only available while both are online.
+		Availability: []Availability{
+			statusAvailability(topics.Status(desc.Name)),
+			statusAvailability(messenger.StationStatusTopic(topics, p.Registry.Station)),
+		},
+		AvailabilityMode: "all",
+		Device:           p.Device,
+	}
+	if desc.Access != devices.WriteOnly {
+		cfg.StateTopic = topics.State(desc.Name)
+	}
+
+	switch component {
+	case "binary_sensor":
+		cfg.PayloadOn, cfg.PayloadOff = "true", "false"
+		cfg.DeviceClass = desc.Attributes[AttrDeviceClass]
+	case "switch":
+		cfg.CommandTopic = topics.Set(desc.Name)
+		cfg.PayloadOn, cfg.PayloadOff = "true", "false"
+		cfg.StateOn, cfg.StateOff = "true", "false"
+	case "sensor":
+		cfg.UnitOfMeasurement = desc.Unit
+		cfg.DeviceClass = deviceClass(desc)
+		cfg.StateClass = "measurement"
+	case "number":
+		cfg.CommandTopic = topics.Set(desc.Name)
+		cfg.UnitOfMeasurement = desc.Unit
+		cfg.DeviceClass = deviceClass(desc)
+		cfg.Min, cfg.Max = desc.Min, desc.Max
+		if strings.HasPrefix(desc.ValueType, "float") {
+			cfg.Step = 0.1
+		}
+	}
+	return component, cfg, true
+}
+
+// ConfigTopic returns <prefix>/<component>/<id>/config for a device.
+func (p *Publisher) ConfigTopic(component, name string) string {
+	return path.Join(p.prefix(), component, p.uniqueID(name), "config")
+}
+
+// Publish emits the retained discovery config for desc. Descriptors
+// without a mapping are skipped.
+func (p *Publisher) Publish(ctx context.Context, desc devices.Descriptor) error {
+	component, cfg, ok := p.BuildConfig(desc)
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return p.Registry.PublishFor(ctx, desc.Name, messenger.Message{Topic: p.ConfigTopic(component, desc.Name), Payload: b, Retain: true, QoS: 1})
+}
+
+// Remove clears the retained config so Home Assistant drops the entity.
+func (p *Publisher) Remove(ctx context.Context, desc devices.Descriptor) error {
+	component := Component(desc)
+	if component == "" {
+		return nil
+	}
+	return p.Registry.PublishFor(ctx, desc.Name, messenger.Message{Topic: p.ConfigTopic(component, desc.Name), Retain: true, QoS: 1})
+}
+
+// PublishAll emits configs for every registered device with a descriptor.
+func (p *Publisher) PublishAll(ctx context.Context) error {
+	for _, dev := range p.Registry.Devices() {
+		desc, ok := messenger.DescriptorOf(dev)
+		if !ok {
+			continue
+		}
+		if err := p.Publish(ctx, desc); err != nil {
+			return fmt.Errorf("homeassistant: publish %s: %w", desc.Name, err)
+		}
+	}
+	return nil
+}
+
+// WatchBirth republishes all configs whenever Home Assistant announces
+// itself on <prefix>/status, so entities survive an HA restart. Like
+// other Registry subscriptions it is applied by ResubscribeAll.
+func (p *Publisher) WatchBirth(ctx context.Context) {
+	p.Registry.WantSub(path.Join(p.prefix(), "status"), 1, func(m messenger.Message) {
+		if string(m.Payload) != "online" {
+			return
+		}
+		go func() {
+			if err := p.PublishAll(ctx); err != nil {
+				p.Registry.Log.Warn("homeassistant discovery failed", "error", err)
+			}
+		}()
+	})
+}
+
+func (p *Publisher) prefix() string {
+	if p.Prefix == "" {
+		return DefaultPrefix
+	}
+	return p.Prefix
+}
+
+func (p *Publisher) uniqueID(name string) string {
+	parts := []string{"otto"}
+	if p.NodeID != "" {
+		parts = append(parts, p.NodeID)
+	}
+	parts = append(parts, name)
+	return sanitize(strings.Join(parts, "_"))
+}
+
+// sanitize keeps the characters HA allows in discovery ids.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func isNumeric(valueType string) bool {
+	switch valueType {
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64",
+		"float32", "float64", "float", "number":
+		return true
+	}
+	return false
+}
+
+// deviceClass derives a device class from the unit, unless the
+// ha_device_class attribute names one.
+func deviceClass(desc devices.Descriptor) string {
+	if dc := desc.Attributes[AttrDeviceClass]; dc != "" {
+		return dc
+	}
+	switch desc.Unit {
+	case "°C", "°F", "C", "F", "K":
+		return "temperature"
+	case "%":
+		if strings.Contains(strings.ToLower(desc.Kind), "humid") {
+			return "humidity"
+		}
+		if strings.Contains(strings.ToLower(desc.Kind), "batter") {
+			return "battery"
+		}
+	case "hPa", "Pa", "kPa", "mbar", "bar", "inHg", "psi":
+		return "pressure"
+	case "lx":
+		return "illuminance"
+	case "V", "mV":
+		return "voltage"
+	case "A", "mA":
+		return "current"
+	case "W", "kW":
+		return "power"
+	case "Wh", "kWh":
+		return "energy"
+	}
+	return ""
+}
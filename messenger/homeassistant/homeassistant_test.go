@@ -0,0 +1,120 @@
+package homeassistant
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/memory"
+	"github.com/rustyeddy/otto/messenger/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedDevice struct {
+	*testutils.Sink[bool]
+	desc devices.Descriptor
+}
+
+func (d describedDevice) Descriptor() devices.Descriptor { return d.desc }
+
+func ptr(f float64) *float64 { return &f }
+
+func TestComponentMapping(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc devices.Descriptor
+		want string
+	}{
+		{devices.Descriptor{ValueType: "bool", Access: devices.ReadOnly}, "binary_sensor"},
+		{devices.Descriptor{ValueType: "bool", Access: devices.ReadWrite}, "switch"},
+		{devices.Descriptor{ValueType: "float64", Access: devices.ReadOnly}, "sensor"},
+		{devices.Descriptor{ValueType: "int", Access: devices.ReadWrite}, "number"},
+		{devices.Descriptor{ValueType: "string", Access: devices.ReadOnly}, ""},
+		{devices.Descriptor{ValueType: "string", Attributes: map[string]string{AttrComponent: "sensor"}}, "sensor"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, Component(tc.desc), "%+v", tc.desc)
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	t.Parallel()
+
+	reg := messenger.NewRegistry(memory.New(), messenger.TopicScheme{Prefix: "otto"})
+	reg.Station = "garden"
+	p := New(reg, "garden")
+
+	component, cfg, ok := p.BuildConfig(devices.Descriptor{
+		Name: "soil-temp", Kind: "temperature", ValueType: "float64",
+		Access: devices.ReadOnly, Unit: "°C",
+	})
+	require.True(t, ok)
+	assert.Equal(t, "sensor", component)
+	assert.Equal(t, "otto_garden_soil-temp", cfg.UniqueID)
+	assert.Equal(t, "otto/devices/soil-temp/state", cfg.StateTopic)
+	assert.Empty(t, cfg.CommandTopic)
+	assert.Equal(t, "temperature", cfg.DeviceClass)
+	assert.Equal(t, "°C", cfg.UnitOfMeasurement)
+	require.Len(t, cfg.Availability, 2)
+	assert.Equal(t, "otto/devices/soil-temp/status", cfg.Availability[0].Topic)
+	assert.Equal(t, "otto/stations/garden/status", cfg.Availability[1].Topic)
+	assert.Equal(t, "all", cfg.AvailabilityMode)
+
+	component, cfg, ok = p.BuildConfig(devices.Descriptor{
+		Name: "valve", ValueType: "float64", Access: devices.ReadWrite,
+		Unit: "%", Min: ptr(0), Max: ptr(100),
+	})
+	require.True(t, ok)
+	assert.Equal(t, "number", component)
+	assert.Equal(t, "otto/devices/valve/set", cfg.CommandTopic)
+	assert.Equal(t, 100.0, *cfg.Max)
+
+	assert.Equal(t, "homeassistant/number/otto_garden_valve/config", p.ConfigTopic(component, "valve"))
+}
+
+func TestPublishAllAndRebirth(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	client := memory.New()
+	reg := messenger.NewRegistry(client, messenger.TopicScheme{Prefix: "otto"})
+	reg.Metrics = messenger.NewMetrics(metrics.New())
+	reg.Add(describedDevice{
+		Sink: testutils.NewSink[bool]("lamp", 1),
+		desc: devices.Descriptor{Name: "lamp", ValueType: "bool", Access: devices.ReadWrite},
+	})
+	reg.Add(testutils.NewSink[bool]("plain", 1))
+
+	p := New(reg, "")
+	p.WatchBirth(ctx)
+	reg.ResubscribeAll(ctx)
+	require.NoError(t, p.PublishAll(ctx))
+
+	const topic = "homeassistant/switch/otto_lamp/config"
+	m, ok := client.Broker().Retained(topic)
+	require.True(t, ok)
+	var cfg Config
+	require.NoError(t, json.Unmarshal(m.Payload, &cfg))
+	assert.Equal(t, "otto/devices/lamp/set", cfg.CommandTopic)
+	assert.Equal(t, "true", cfg.PayloadOn)
+	assert.Equal(t, uint64(1), reg.Metrics.Publishes.Value("lamp"), "published through the Registry")
+
+	// An HA restart triggers a republish after the config was cleared.
+	require.NoError(t, p.Remove(ctx, devices.Descriptor{Name: "lamp", ValueType: "bool", Access: devices.ReadWrite}))
+	_, ok = client.Broker().Retained(topic)
+	require.False(t, ok)
+
+	require.NoError(t, client.Publish(ctx, "homeassistant/status", []byte("online"), false, 1))
+	assert.Eventually(t, func() bool {
+		_, ok := client.Broker().Retained(topic)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
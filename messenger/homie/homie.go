@@ -0,0 +1,406 @@
+// Package homie exposes a Registry using the Homie 4 convention.
+//
+// The Registry becomes one Homie device and each otto device with a
+// descriptor becomes a node with a single property. Property values
+// mirror the otto state topics, and Homie /set commands are passed to
+// Registry.Set so they reach devices through WireSink.
+package homie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// DefaultPrefix is the Homie base topic.
+const DefaultPrefix = "homie"
+
+// Homie device lifecycle states.
+const (
+	StateInit         = "init"
+	StateReady        = "ready"
+	StateDisconnected = "disconnected"
+	StateLost         = "lost"
+)
+
+// ErrDuplicateNode is returned when two devices map to the same Homie
+// node id.
+var ErrDuplicateNode = errors.New("homie: duplicate node id")
+
+// Publisher publishes a Registry as a Homie device.
+type Publisher struct {
+	Registry *messenger.Registry
+
+	// Prefix is the Homie base topic. Defaults to "homie".
+	Prefix string
+
+	// DeviceID is the Homie device id; it is sanitized to Homie's id rules.
+	DeviceID string
+
+	// Name is the human readable device name. Defaults to DeviceID.
+	Name string
+
+	willSet atomic.Bool
+
+	once    sync.Once
+	changed chan struct{} // signalled by device status changes
+
+	mu    sync.Mutex
+	wired map[string][]*messenger.Subscription // node id -> subscriptions
+	ids   string                               // $nodes last published
+	nodes map[string]node                      // nodes last published, by id
+}
+
+// New returns a Publisher for r under homie/<deviceID>.
+func New(r *messenger.Registry, deviceID string) *Publisher {
+	return &Publisher{Registry: r, Prefix: DefaultPrefix, DeviceID: deviceID}
+}
+
+// node is one otto device as a Homie node with a single property.
+type node struct {
+	id   string
+	prop string
+	desc devices.Descriptor
+}
+
+// Wire registers the subscriptions that mirror otto state into Homie
+// property values and pass Homie /set commands to Registry.Set. Like
+// other Registry subscriptions they are applied by ResubscribeAll, so
+// call Wire before the MQTT client connects. Run keeps them in step
+// with devices added or removed later.
+func (p *Publisher) Wire() error {
+	nodes, err := p.currentNodes()
+	if err != nil {
+		return err
+	}
+	p.wire(nodes)
+	return nil
+}
+
+// wire subscribes nodes not wired yet and drops the subscriptions of
+// nodes that are gone.
+func (p *Publisher) wire(nodes []node) {
+	r := p.Registry
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wired == nil {
+		p.wired = map[string][]*messenger.Subscription{}
+	}
+
+	keep := map[string]bool{}
+	for _, n := range nodes {
+		keep[n.id] = true
+		if _, ok := p.wired[n.id]; ok {
+			continue
+		}
+		valueTopic := p.propTopic(n)
+		var subs []*messenger.Subscription
+
+		if n.desc.Access != devices.WriteOnly {
+			subs = append(subs, r.WantSub(r.Topics.State(n.desc.Name), r.QoSState, func(m messenger.Message) {
+				ctx := context.Background()
+				msg := messenger.Message{Topic: valueTopic, Payload: toHomie(m.Payload), Retain: true, QoS: r.QoSState}
+				if err := r.PublishFor(ctx, n.desc.Name, msg); err != nil {
+					r.Log.Warn("homie value publish failed", "device", n.desc.Name, "error", err)
+				}
+			}))
+		}
+
+		if settable(n.desc) {
+			subs = append(subs, r.WantSub(valueTopic+"/set", r.QoSSet, func(m messenger.Message) {
+				body := fromHomie(n.desc, m.Payload)
+				if err := r.Set(context.Background(), n.desc.Name, body); err != nil {
+					r.Log.Warn("homie set failed", "device", n.desc.Name, "error", err)
+				}
+			}))
+		}
+		p.wired[n.id] = subs
+	}
+
+	for id, subs := range p.wired {
+		if keep[id] {
+			continue
+		}
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+		delete(p.wired, id)
+	}
+}
+
+// SetWill makes the connection's will set $state to "lost". Homie
+// controllers watch $state, so it takes the place of
+// Registry.SetStationWill; call it before connecting.
+func (p *Publisher) SetWill() error {
+	if err := p.Registry.MQTT.SetWill(p.topic("$state"), []byte(StateLost), true, 1); err != nil {
+		return err
+	}
+	p.willSet.Store(true)
+	return nil
+}
+
+// Run publishes the device description through $state init and ready,
+// and publishes "disconnected" when ctx ends. While it runs, devices
+// added to or removed from the Registry are wired and announced again
+// with their $nodes; additions are seen once Registry.Run starts them.
+// A will set by SetWill is changed to "disconnected" too, so a client
+// that publishes its will on a clean disconnect does not report "lost".
+func (p *Publisher) Run(ctx context.Context) error {
+	p.watch()
+	if err := p.Publish(ctx); err != nil {
+		return err
+	}
+
+	for done := false; !done; {
+		select {
+		case <-p.changed:
+			if err := p.refresh(ctx); err != nil {
+				p.Registry.Log.Warn("homie republish failed", "error", err)
+			}
+		case <-ctx.Done():
+			done = true
+		}
+	}
+	if p.willSet.Load() {
+		if err := p.Registry.MQTT.SetWill(p.topic("$state"), []byte(StateDisconnected), true, 1); err != nil {
+			return err
+		}
+	}
+	return p.SetState(context.Background(), StateDisconnected)
+}
+
+// watch registers, once, a status hook that wakes Run when a device
+// may have been added or removed.
+func (p *Publisher) watch() {
+	p.once.Do(func() {
+		p.changed = make(chan struct{}, 1)
+		p.Registry.OnStatus(func(string, messenger.StatusPayload) {
+			select {
+			case p.changed <- struct{}{}:
+			default:
+			}
+		})
+	})
+}
+
+// refresh rewires and republishes the device if its nodes changed since
+// the last Publish, clearing the retained attributes of removed nodes.
+func (p *Publisher) refresh(ctx context.Context) error {
+	nodes, err := p.currentNodes()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	same := nodeIDs(nodes) == p.ids
+	p.mu.Unlock()
+	if same {
+		return nil
+	}
+
+	p.wire(nodes)
+	return p.Publish(ctx)
+}
+
+// Publish announces the device: $state init, the device, node and
+// property attributes, then $state ready. Attributes of nodes removed
+// since the previous Publish are cleared.
+func (p *Publisher) Publish(ctx context.Context) error {
+	nodes, err := p.currentNodes()
+	if err != nil {
+		return err
+	}
+	if err := p.SetState(ctx, StateInit); err != nil {
+		return err
+	}
+
+	name := p.Name
+	if name == "" {
+		name = p.DeviceID
+	}
+	// Attributes are [device, topic, value]; device is "" for the
+	// Homie device's own.
+	attrs := [][3]string{
+		{"", "$homie", "4.0"},
+		{"", "$name", name},
+		{"", "$extensions", ""},
+		{"", "$nodes", nodeIDs(nodes)},
+	}
+	current := map[string]node{}
+	for _, n := range nodes {
+		current[n.id] = n
+		attrs = append(attrs, nodeAttrs(n)...)
+	}
+
+	p.mu.Lock()
+	for id, n := range p.nodes {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		attrs = append(attrs, [3]string{n.desc.Name, path.Join(n.id, n.prop), ""})
+		for _, a := range nodeAttrs(n) {
+			attrs = append(attrs, [3]string{a[0], a[1], ""})
+		}
+	}
+	p.mu.Unlock()
+
+	for _, a := range attrs {
+		msg := messenger.Message{Topic: p.topic(a[1]), Payload: []byte(a[2]), Retain: true, QoS: 1}
+		if err := p.Registry.PublishFor(ctx, a[0], msg); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.ids, p.nodes = nodeIDs(nodes), current
+	p.mu.Unlock()
+	return p.SetState(ctx, StateReady)
+}
+
+// nodeAttrs returns the retained attributes describing n and its
+// property, with topics relative to the Homie device.
+func nodeAttrs(n node) [][3]string {
+	name := n.desc.Name
+	base := n.id
+	prop := path.Join(base, n.prop)
+	attrs := [][3]string{
+		{name, base + "/$name", n.desc.Name},
+		{name, base + "/$type", n.desc.Kind},
+		{name, base + "/$properties", n.prop},
+		{name, prop + "/$name", n.desc.Name},
+		{name, prop + "/$datatype", datatype(n.desc.ValueType)},
+		{name, prop + "/$settable", strconv.FormatBool(settable(n.desc))},
+		{name, prop + "/$retained", strconv.FormatBool(n.desc.Access != devices.WriteOnly)},
+	}
+	if n.desc.Unit != "" {
+		attrs = append(attrs, [3]string{name, prop + "/$unit", n.desc.Unit})
+	}
+	if f := format(n.desc); f != "" {
+		attrs = append(attrs, [3]string{name, prop + "/$format", f})
+	}
+	return attrs
+}
+
+func nodeIDs(nodes []node) string {
+	ids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ids = append(ids, n.id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// SetState publishes the device $state.
+func (p *Publisher) SetState(ctx context.Context, state string) error {
+	return p.Registry.PublishFor(ctx, "", messenger.Message{Topic: p.topic("$state"), Payload: []byte(state), Retain: true, QoS: 1})
+}
+
+// currentNodes returns a node for each Registry device with a
+// descriptor. Two devices whose names map to the same node id return
+// ErrDuplicateNode.
+func (p *Publisher) currentNodes() ([]node, error) {
+	var out []node
+	names := map[string]string{} // node id -> device name
+	for _, dev := range p.Registry.Devices() {
+		desc, ok := messenger.DescriptorOf(dev)
+		if !ok {
+			continue
+		}
+		if desc.Name == "" {
+			desc.Name = dev.Name()
+		}
+		prop := ID(desc.Kind)
+		if prop == "" {
+			prop = "value"
+		}
+		id := ID(desc.Name)
+		if other, ok := names[id]; ok {
+			return nil, fmt.Errorf("%w %q: devices %q and %q", ErrDuplicateNode, id, other, desc.Name)
+		}
+		names[id] = desc.Name
+		out = append(out, node{id: id, prop: prop, desc: desc})
+	}
+	return out, nil
+}
+
+func (p *Publisher) topic(rest string) string {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return path.Join(prefix, ID(p.DeviceID), rest)
+}
+
+func (p *Publisher) propTopic(n node) string { return p.topic(path.Join(n.id, n.prop)) }
+
+// ID converts s to a Homie id: lowercase letters, digits and single
+// hyphens.
+func ID(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+func settable(desc devices.Descriptor) bool {
+	return desc.Access == devices.ReadWrite || desc.Access == devices.WriteOnly
+}
+
+func datatype(valueType string) string {
+	switch {
+	case valueType == "bool":
+		return "boolean"
+	case strings.HasPrefix(valueType, "int"), strings.HasPrefix(valueType, "uint"):
+		return "integer"
+	case strings.HasPrefix(valueType, "float"), valueType == "number":
+		return "float"
+	}
+	return "string"
+}
+
+// format renders Min/Max as a Homie numeric range "min:max". Homie has
+// no open-ended ranges, so it is empty unless both are set.
+func format(desc devices.Descriptor) string {
+	if desc.Min == nil || desc.Max == nil {
+		return ""
+	}
+	num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	return num(*desc.Min) + ":" + num(*desc.Max)
+}
+
+// toHomie converts a JSON state payload into a Homie value: strings are
+// unquoted, other values pass through.
+func toHomie(b []byte) []byte {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		return []byte(s)
+	}
+	return b
+}
+
+// fromHomie converts a Homie /set payload for a JSON codec: string
+// properties are quoted unless already JSON, other values pass through.
+func fromHomie(desc devices.Descriptor, b []byte) []byte {
+	if datatype(desc.ValueType) != "string" || json.Valid(b) {
+		return b
+	}
+	q, _ := json.Marshal(string(b))
+	return q
+}
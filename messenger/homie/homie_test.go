@@ -0,0 +1,227 @@
+package homie
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/rustyeddy/otto/messenger/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedSink struct {
+	*testutils.Sink[float64]
+	desc devices.Descriptor
+}
+
+func (d describedSink) Descriptor() devices.Descriptor { return d.desc }
+
+func ptr(f float64) *float64 { return &f }
+
+func retained(t *testing.T, b *memory.Broker, topic string) string {
+	t.Helper()
+	m, ok := b.Retained(topic)
+	require.True(t, ok, topic)
+	return string(m.Payload)
+}
+
+func TestID(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "soil-temp", ID("Soil_Temp"))
+	assert.Equal(t, "a-b", ID("a--b-"))
+	assert.Equal(t, "x1", ID("X1"))
+}
+
+func TestPublishDescribesDevice(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	client := memory.New()
+	reg := messenger.NewRegistry(client, messenger.TopicScheme{Prefix: "otto"})
+	sink := describedSink{
+		Sink: testutils.NewSink[float64]("Valve", 1),
+		desc: devices.Descriptor{
+			Name: "Valve", Kind: "position", ValueType: "float64",
+			Access: devices.ReadWrite, Unit: "%", Min: ptr(0), Max: ptr(100),
+		},
+	}
+	reg.Add(sink)
+	reg.Add(describedSink{
+		Sink: testutils.NewSink[float64]("pump", 1),
+		desc: devices.Descriptor{Name: "pump", Kind: "speed", ValueType: "float64", Access: devices.ReadWrite, Max: ptr(10)},
+	})
+
+	p := New(reg, "Garden Station")
+	require.NoError(t, p.Publish(ctx))
+
+	b := client.Broker()
+	assert.Equal(t, "4.0", retained(t, b, "homie/garden-station/$homie"))
+	assert.Equal(t, "ready", retained(t, b, "homie/garden-station/$state"))
+	assert.Equal(t, "valve,pump", retained(t, b, "homie/garden-station/$nodes"))
+	assert.Equal(t, "position", retained(t, b, "homie/garden-station/valve/$properties"))
+	assert.Equal(t, "float", retained(t, b, "homie/garden-station/valve/position/$datatype"))
+	assert.Equal(t, "%", retained(t, b, "homie/garden-station/valve/position/$unit"))
+	assert.Equal(t, "0:100", retained(t, b, "homie/garden-station/valve/position/$format"))
+	assert.Equal(t, "true", retained(t, b, "homie/garden-station/valve/position/$settable"))
+
+	// Homie ranges need both ends.
+	_, ok := b.Retained("homie/garden-station/pump/speed/$format")
+	assert.False(t, ok)
+}
+
+func TestPublishRejectsDuplicateNodeIDs(t *testing.T) {
+	t.Parallel()
+
+	reg := messenger.NewRegistry(memory.New(), messenger.TopicScheme{Prefix: "otto"})
+	for _, name := range []string{"Soil Temp", "soil_temp"} {
+		require.NoError(t, reg.Add(describedSink{
+			Sink: testutils.NewSink[float64](name, 1),
+			desc: devices.Descriptor{Name: name, Kind: "temperature", ValueType: "float64"},
+		}))
+	}
+
+	p := New(reg, "garden")
+	assert.ErrorIs(t, p.Publish(context.Background()), ErrDuplicateNode)
+	assert.ErrorIs(t, p.Wire(), ErrDuplicateNode)
+}
+
+func TestWireMirrorsStateAndForwardsSet(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	client := memory.New()
+	reg := messenger.NewRegistry(client, messenger.TopicScheme{Prefix: "otto"})
+	sink := describedSink{
+		Sink: testutils.NewSink[float64]("valve", 1),
+		desc: devices.Descriptor{Name: "valve", Kind: "position", ValueType: "float64", Access: devices.ReadWrite},
+	}
+	reg.Add(sink)
+	messenger.WireSink(ctx, reg, sink, codec.JSON[float64]{})
+
+	p := New(reg, "garden")
+	require.NoError(t, p.Wire())
+	reg.ResubscribeAll(ctx)
+
+	require.NoError(t, client.Publish(ctx, "homie/garden/valve/position/set", []byte("42.5"), false, 1))
+	got, ok := testutils.WaitRecv(sink.Get(), time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 42.5, got)
+
+	require.NoError(t, client.Publish(ctx, "otto/devices/valve/state", []byte("42.5"), true, 0))
+	assert.Equal(t, "42.5", retained(t, client.Broker(), "homie/garden/valve/position"))
+}
+
+func TestRunFollowsAddAndRemove(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	client := memory.New()
+	reg := messenger.NewRegistry(client, messenger.TopicScheme{Prefix: "otto"})
+	require.NoError(t, reg.Add(describedSink{
+		Sink: testutils.NewSink[float64]("valve", 1),
+		desc: devices.Descriptor{Name: "valve", Kind: "position", ValueType: "float64", Access: devices.ReadWrite},
+	}))
+	p := New(reg, "garden")
+	require.NoError(t, p.Wire())
+	reg.ResubscribeAll(ctx)
+	go func() { _ = reg.Run(ctx) }()
+	go func() { _ = p.Run(ctx) }()
+
+	b := client.Broker()
+	nodes := func(want string) func() bool {
+		return func() bool {
+			m, ok := b.Retained("homie/garden/$nodes")
+			return ok && string(m.Payload) == want
+		}
+	}
+	require.Eventually(t, nodes("valve"), time.Second, 5*time.Millisecond)
+
+	pump := describedSink{
+		Sink: testutils.NewSink[float64]("pump", 1),
+		desc: devices.Descriptor{Name: "pump", Kind: "speed", ValueType: "float64", Access: devices.ReadWrite},
+	}
+	require.NoError(t, reg.Add(pump))
+	messenger.WireSink(ctx, reg, pump, codec.JSON[float64]{})
+	require.Eventually(t, nodes("valve,pump"), time.Second, 5*time.Millisecond)
+	assert.Equal(t, "speed", retained(t, b, "homie/garden/pump/$properties"))
+
+	// The new node's /set is wired.
+	require.NoError(t, client.Publish(ctx, "homie/garden/pump/speed/set", []byte("3"), false, 1))
+	got, ok := testutils.WaitRecv(pump.Get(), time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 3.0, got)
+
+	require.NoError(t, reg.Remove(ctx, "pump"))
+	require.Eventually(t, nodes("valve"), time.Second, 5*time.Millisecond)
+	_, ok = b.Retained("homie/garden/pump/$properties")
+	assert.False(t, ok)
+}
+
+func TestRunLifecycle(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.NewBroker()
+	client := broker.NewClient()
+	reg := messenger.NewRegistry(client, messenger.TopicScheme{Prefix: "otto"})
+	p := New(reg, "garden")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		m, ok := broker.Retained("homie/garden/$state")
+		return ok && string(m.Payload) == StateReady
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	_, ok := testutils.WaitRecv(done, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, StateDisconnected, retained(t, broker, "homie/garden/$state"))
+
+	// An unclean disconnect leaves "lost".
+	client2 := broker.NewClient()
+	reg2 := messenger.NewRegistry(client2, messenger.TopicScheme{Prefix: "otto"})
+	p2 := New(reg2, "shed")
+	require.NoError(t, p2.SetWill())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	t.Cleanup(cancel2)
+	go func() { _ = p2.Run(ctx2) }()
+	require.Eventually(t, func() bool {
+		m, ok := broker.Retained("homie/shed/$state")
+		return ok && string(m.Payload) == StateReady
+	}, time.Second, 5*time.Millisecond)
+	client2.Kill()
+	assert.Equal(t, StateLost, retained(t, broker, "homie/shed/$state"))
+
+	// After a clean stop the will agrees with $state, for clients that
+	// publish it on disconnect.
+	client3 := broker.NewClient()
+	reg3 := messenger.NewRegistry(client3, messenger.TopicScheme{Prefix: "otto"})
+	p3 := New(reg3, "barn")
+	require.NoError(t, p3.SetWill())
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	done3 := make(chan error, 1)
+	go func() { done3 <- p3.Run(ctx3) }()
+	require.Eventually(t, func() bool {
+		m, ok := broker.Retained("homie/barn/$state")
+		return ok && string(m.Payload) == StateReady
+	}, time.Second, 5*time.Millisecond)
+	cancel3()
+	_, ok = testutils.WaitRecv(done3, time.Second)
+	require.True(t, ok)
+	client3.Kill()
+	assert.Equal(t, StateDisconnected, retained(t, broker, "homie/barn/$state"))
+}
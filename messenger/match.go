@@ -0,0 +1,70 @@
+package messenger
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidTopic is returned for topic names that cannot be published to.
+	ErrInvalidTopic = errors.New("invalid topic")
+
+	// ErrInvalidFilter is returned for malformed subscription filters.
+	ErrInvalidFilter = errors.New("invalid topic filter")
+)
+
+// ValidateTopic checks that topic is a valid MQTT topic name for publishing:
+// non-empty and free of wildcard characters.
+func ValidateTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// ValidateFilter checks that filter is a valid MQTT subscription filter.
+// '+' must occupy a whole level and '#' must be the whole last level.
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return ErrInvalidFilter
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#":
+			if i != len(levels)-1 {
+				return ErrInvalidFilter
+			}
+		case l == "+":
+		case strings.ContainsAny(l, "+#"):
+			return ErrInvalidFilter
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether topic matches the subscription filter using
+// MQTT wildcard rules: '+' matches exactly one level and '#' matches the
+// remaining levels, including none. Wildcards in the first level do not
+// match topics starting with '$'.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
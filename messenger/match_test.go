@@ -0,0 +1,62 @@
+package messenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "otto/devices/lamp/state", topic: "otto/devices/lamp/state", want: true},
+		{filter: "otto/devices/lamp/state", topic: "otto/devices/lamp/set", want: false},
+		{filter: "otto/devices/+/state", topic: "otto/devices/lamp/state", want: true},
+		{filter: "otto/devices/+/state", topic: "otto/devices/lamp/x/state", want: false},
+		{filter: "otto/devices/+", topic: "otto/devices", want: false},
+		{filter: "otto/#", topic: "otto/devices/lamp/state", want: true},
+		{filter: "otto/#", topic: "otto", want: true},
+		{filter: "#", topic: "otto/devices", want: true},
+		{filter: "+/+", topic: "a/b", want: true},
+		{filter: "+/+", topic: "a/b/c", want: false},
+		{filter: "otto/devices", topic: "otto/devices/lamp", want: false},
+		{filter: "#", topic: "$SYS/broker", want: false},
+		{filter: "+/broker", topic: "$SYS/broker", want: false},
+		{filter: "$SYS/#", topic: "$SYS/broker", want: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.filter+"|"+tc.topic, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, MatchTopic(tc.filter, tc.topic))
+		})
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	t.Parallel()
+
+	valid := []string{"a", "a/b", "+", "#", "a/+/c", "a/#", "+/+/#"}
+	for _, f := range valid {
+		assert.NoError(t, ValidateFilter(f), f)
+	}
+
+	invalid := []string{"", "a/#/c", "a+/b", "a/b#", "#/a"}
+	for _, f := range invalid {
+		assert.ErrorIs(t, ValidateFilter(f), ErrInvalidFilter, f)
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, ValidateTopic("otto/devices/lamp/state"))
+	assert.ErrorIs(t, ValidateTopic(""), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidateTopic("otto/+/state"), ErrInvalidTopic)
+	assert.ErrorIs(t, ValidateTopic("otto/#"), ErrInvalidTopic)
+}
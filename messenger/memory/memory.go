@@ -0,0 +1,255 @@
+// Package memory provides an in-process implementation of messenger.MQTT.
+//
+// A Broker routes messages between any number of Clients with MQTT
+// wildcard matching, retained messages, QoS downgrade and will delivery.
+// It needs no network and is intended for tests, simulations and
+// single-process stations.
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// ErrClosed is returned when using a Client after Close or Kill.
+var ErrClosed = errors.New("memory: client closed")
+
+type subscription struct {
+	id      uint64
+	client  *Client
+	filter  string
+	qos     byte
+	handler func(messenger.Message)
+}
+
+// Broker routes messages between in-process clients.
+type Broker struct {
+	mu       sync.RWMutex
+	nextID   uint64
+	subs     map[uint64]*subscription
+	retained map[string]messenger.Message
+}
+
+// NewBroker returns an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{
+		subs:     map[uint64]*subscription{},
+		retained: map[string]messenger.Message{},
+	}
+}
+
+// New returns a Client connected to a fresh private Broker.
+func New() *Client {
+	return NewBroker().NewClient()
+}
+
+// NewClient returns a new Client connected to the broker.
+func (b *Broker) NewClient() *Client {
+	return &Client{broker: b, subs: map[uint64]struct{}{}}
+}
+
+// Retained returns the retained message stored for topic, if any.
+func (b *Broker) Retained(topic string) (messenger.Message, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+func (b *Broker) publish(m messenger.Message) {
+	b.mu.Lock()
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+
+	// Snapshot matching subscribers; handlers run without the lock held so
+	// they can publish or subscribe themselves.
+	var targets []*subscription
+	for _, s := range b.subs {
+		if messenger.MatchTopic(s.filter, m.Topic) {
+			targets = append(targets, s)
+		}
+	}
+	b.mu.Unlock()
+
+	// Deliver in registration order so routing is deterministic.
+	sort.Slice(targets, func(i, j int) bool { return targets[i].id < targets[j].id })
+	for _, s := range targets {
+		// Live deliveries never carry the retain flag (MQTT 3.1.1 §3.3.1.3).
+		s.deliver(messenger.Message{Topic: m.Topic, Payload: m.Payload, QoS: m.QoS, Properties: m.Properties})
+	}
+}
+
+func (b *Broker) subscribe(s *subscription) []messenger.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	s.id = b.nextID
+	b.subs[s.id] = s
+
+	var replay []messenger.Message
+	for topic, m := range b.retained {
+		if messenger.MatchTopic(s.filter, topic) {
+			replay = append(replay, m)
+		}
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].Topic < replay[j].Topic })
+	return replay
+}
+
+func (b *Broker) unsubscribe(id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, id)
+}
+
+func (s *subscription) deliver(m messenger.Message) {
+	if s.client.isClosed() {
+		return
+	}
+	if s.qos < m.QoS {
+		m.QoS = s.qos
+	}
+	s.handler(m)
+}
+
+// Client is an in-process MQTT client. It implements messenger.MQTT.
+//
+// Handlers run synchronously on the publishing goroutine, so a message
+// has been delivered to every matching subscriber when Publish returns.
+type Client struct {
+	broker *Broker
+
+	mu     sync.Mutex
+	will   *messenger.Message
+	subs   map[uint64]struct{}
+	closed bool
+}
+
+var _ messenger.MQTT = (*Client)(nil)
+
+// Broker returns the broker this client is connected to.
+func (c *Client) Broker() *Broker { return c.broker }
+
+// Publish routes a message to every matching subscription on the broker.
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return c.PublishMessage(ctx, messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+}
+
+// PublishMessage is like Publish but also carries m.Properties to subscribers.
+func (c *Client) PublishMessage(ctx context.Context, m messenger.Message) error {
+	if err := messenger.ValidateTopic(m.Topic); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.isClosed() {
+		return ErrClosed
+	}
+	m.Payload = append([]byte(nil), m.Payload...)
+	c.broker.publish(m)
+	return nil
+}
+
+// Subscribe registers handler for filter and replays matching retained messages.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler func(messenger.Message)) (func() error, error) {
+	if err := messenger.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s := &subscription{client: c, filter: filter, qos: qos, handler: handler}
+	replay := c.broker.subscribe(s)
+	c.subs[s.id] = struct{}{}
+	c.mu.Unlock()
+
+	for _, m := range replay {
+		s.deliver(m)
+	}
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			c.broker.unsubscribe(s.id)
+			c.mu.Lock()
+			delete(c.subs, s.id)
+			c.mu.Unlock()
+		})
+		return nil
+	}, nil
+}
+
+// SetWill stores the message the broker publishes if this client dies (see Kill).
+func (c *Client) SetWill(topic string, payload []byte, retain bool, qos byte) error {
+	if err := messenger.ValidateTopic(topic); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.will = &messenger.Message{
+		Topic:   topic,
+		Payload: append([]byte(nil), payload...),
+		Retain:  retain,
+		QoS:     qos,
+	}
+	return nil
+}
+
+// Close disconnects cleanly: subscriptions are removed and the will is discarded.
+func (c *Client) Close() error {
+	c.disconnect()
+	return nil
+}
+
+// Kill simulates an abrupt connection loss: subscriptions are removed and
+// the broker publishes the client's will, if one was set.
+func (c *Client) Kill() {
+	if will := c.disconnect(); will != nil {
+		c.broker.publish(*will)
+	}
+}
+
+func (c *Client) disconnect() *messenger.Message {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	will := c.will
+	c.will = nil
+	ids := make([]uint64, 0, len(c.subs))
+	for id := range c.subs {
+		ids = append(ids, id)
+	}
+	c.subs = map[uint64]struct{}{}
+	c.mu.Unlock()
+
+	for _, id := range ids {
+		c.broker.unsubscribe(id)
+	}
+	return will
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
@@ -0,0 +1,203 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collect(t *testing.T, c *Client, filter string, qos byte) *[]messenger.Message {
+	t.Helper()
+	var got []messenger.Message
+	_, err := c.Subscribe(context.Background(), filter, qos, func(m messenger.Message) {
+		got = append(got, m)
+	})
+	require.NoError(t, err)
+	return &got
+}
+
+func TestWildcardRouting(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := NewBroker()
+	pub := b.NewClient()
+	sub := b.NewClient()
+
+	exact := collect(t, sub, "otto/devices/lamp/state", 1)
+	plus := collect(t, sub, "otto/devices/+/state", 1)
+	hash := collect(t, sub, "otto/#", 1)
+
+	require.NoError(t, pub.Publish(ctx, "otto/devices/lamp/state", []byte("on"), false, 0))
+	require.NoError(t, pub.Publish(ctx, "otto/devices/fan/state", []byte("off"), false, 0))
+	require.NoError(t, pub.Publish(ctx, "otto/devices/fan/set", []byte("on"), false, 0))
+
+	assert.Len(t, *exact, 1)
+	assert.Len(t, *plus, 2)
+	assert.Len(t, *hash, 3)
+	assert.Equal(t, "otto/devices/lamp/state", (*exact)[0].Topic)
+	assert.Equal(t, []byte("on"), (*exact)[0].Payload)
+}
+
+func TestRetainedReplayAndClear(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := NewBroker()
+	pub := b.NewClient()
+
+	require.NoError(t, pub.Publish(ctx, "otto/devices/lamp/state", []byte("true"), true, 1))
+	require.NoError(t, pub.Publish(ctx, "otto/devices/fan/state", []byte("false"), true, 1))
+
+	got := collect(t, b.NewClient(), "otto/devices/+/state", 1)
+	require.Len(t, *got, 2)
+	assert.Equal(t, "otto/devices/fan/state", (*got)[0].Topic)
+	assert.True(t, (*got)[0].Retain)
+
+	// An empty retained payload clears the stored message.
+	require.NoError(t, pub.Publish(ctx, "otto/devices/lamp/state", nil, true, 1))
+	_, ok := b.Retained("otto/devices/lamp/state")
+	assert.False(t, ok)
+
+	later := collect(t, b.NewClient(), "otto/devices/lamp/state", 1)
+	assert.Empty(t, *later)
+}
+
+func TestLiveDeliveryClearsRetainAndDowngradesQoS(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	got := collect(t, c, "a/b", 0)
+
+	require.NoError(t, c.Publish(context.Background(), "a/b", []byte("x"), true, 1))
+	require.Len(t, *got, 1)
+	assert.False(t, (*got)[0].Retain)
+	assert.Equal(t, byte(0), (*got)[0].QoS)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	var n int
+	unsub, err := c.Subscribe(context.Background(), "a/#", 0, func(messenger.Message) { n++ })
+	require.NoError(t, err)
+
+	require.NoError(t, c.Publish(context.Background(), "a/b", []byte("1"), false, 0))
+	require.NoError(t, unsub())
+	require.NoError(t, unsub())
+	require.NoError(t, c.Publish(context.Background(), "a/b", []byte("2"), false, 0))
+
+	assert.Equal(t, 1, n)
+}
+
+func TestInvalidTopics(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	assert.ErrorIs(t, c.Publish(context.Background(), "a/+", nil, false, 0), messenger.ErrInvalidTopic)
+	_, err := c.Subscribe(context.Background(), "a/#/b", 0, func(messenger.Message) {})
+	assert.ErrorIs(t, err, messenger.ErrInvalidFilter)
+}
+
+func TestWillDeliveredOnKill(t *testing.T) {
+	t.Parallel()
+
+	b := NewBroker()
+	station := b.NewClient()
+	watcher := b.NewClient()
+	got := collect(t, watcher, "otto/devices/+/status", 1)
+
+	require.NoError(t, station.SetWill("otto/devices/lamp/status", []byte("offline"), true, 1))
+	station.Kill()
+
+	require.Len(t, *got, 1)
+	assert.Equal(t, []byte("offline"), (*got)[0].Payload)
+
+	m, ok := b.Retained("otto/devices/lamp/status")
+	require.True(t, ok)
+	assert.Equal(t, []byte("offline"), m.Payload)
+
+	assert.ErrorIs(t, station.Publish(context.Background(), "x", nil, false, 0), ErrClosed)
+}
+
+func TestWillDiscardedOnClose(t *testing.T) {
+	t.Parallel()
+
+	b := NewBroker()
+	station := b.NewClient()
+	got := collect(t, b.NewClient(), "#", 1)
+
+	require.NoError(t, station.SetWill("otto/devices/lamp/status", []byte("offline"), true, 1))
+	require.NoError(t, station.Close())
+
+	assert.Empty(t, *got)
+}
+
+func TestClosedClientStopsReceiving(t *testing.T) {
+	t.Parallel()
+
+	b := NewBroker()
+	sub := b.NewClient()
+	got := collect(t, sub, "#", 0)
+	require.NoError(t, sub.Close())
+
+	require.NoError(t, b.NewClient().Publish(context.Background(), "a", []byte("x"), false, 0))
+	assert.Empty(t, *got)
+}
+
+func TestRegistryEndToEnd(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	b := NewBroker()
+	reg := messenger.NewRegistry(b.NewClient(), messenger.TopicScheme{Prefix: "otto"})
+	dash := b.NewClient()
+
+	src := testutils.NewSource[int]("temp", 8)
+	sink := testutils.NewSink[int]("pump", 8)
+	messenger.WireSource(ctx, reg, src, codec.JSON[int]{})
+	messenger.WireSink(ctx, reg, sink, codec.JSON[int]{})
+	reg.ResubscribeAll(ctx)
+
+	states := make(chan messenger.Message, 4)
+	_, err := dash.Subscribe(ctx, "otto/devices/+/state", 0, func(m messenger.Message) { states <- m })
+	require.NoError(t, err)
+
+	src.Emit(21)
+	m, ok := testutils.WaitRecv(states, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "otto/devices/temp/state", m.Topic)
+	var v int
+	require.NoError(t, json.Unmarshal(m.Payload, &v))
+	assert.Equal(t, 21, v)
+
+	require.NoError(t, dash.Publish(ctx, "otto/devices/pump/set", []byte("3"), false, 1))
+	got, ok := testutils.WaitRecv(sink.Get(), time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 3, got)
+}
+
+func TestPublishMessageCarriesProperties(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	got := collect(t, c, "a/b", 1)
+
+	props := &messenger.Properties{ContentType: "application/json", ResponseTopic: "a/reply"}
+	require.NoError(t, messenger.PublishMessage(context.Background(), c, messenger.Message{
+		Topic: "a/b", Payload: []byte("{}"), QoS: 1, Properties: props,
+	}))
+
+	require.Len(t, *got, 1)
+	assert.Equal(t, props, (*got)[0].Properties)
+}
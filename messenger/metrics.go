@@ -0,0 +1,87 @@
+package messenger
+
+import (
+	"errors"
+
+	"github.com/rustyeddy/otto/messenger/metrics"
+)
+
+// Metrics are the messaging counters recorded by Registry, the Wire*
+// helpers and the MQTT adapters. Device counters carry a "device" label.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	Publishes         *metrics.Counter // device
+	PublishFailures   *metrics.Counter // device
+	MarshalErrors     *metrics.Counter // device
+	SetDeliveries     *metrics.Counter // device
+	SetTimeouts       *metrics.Counter // device
+	SubscribeFailures *metrics.Counter
+	Reconnects        *metrics.Counter
+	ConnectionsLost   *metrics.Counter
+}
+
+// DefaultMetrics records into metrics.Default; NewRegistry and the MQTT
+// adapters use it unless configured otherwise.
+var DefaultMetrics = NewMetrics(metrics.Default)
+
+// NewMetrics registers the messaging counters in s.
+func NewMetrics(s *metrics.Set) *Metrics {
+	return &Metrics{
+		Publishes:         s.Counter("otto_publishes_total", "Device messages published.", "device"),
+		PublishFailures:   s.Counter("otto_publish_failures_total", "Device messages that failed to publish.", "device"),
+		MarshalErrors:     s.Counter("otto_marshal_errors_total", "Device values that failed to encode.", "device"),
+		SetDeliveries:     s.Counter("otto_set_deliveries_total", "Set values delivered to devices.", "device"),
+		SetTimeouts:       s.Counter("otto_set_timeouts_total", "Set values not accepted within CommandTimeout.", "device"),
+		SubscribeFailures: s.Counter("otto_subscribe_failures_total", "MQTT subscriptions that failed."),
+		Reconnects:        s.Counter("otto_mqtt_reconnects_total", "MQTT reconnects after the first connect."),
+		ConnectionsLost:   s.Counter("otto_mqtt_connections_lost_total", "MQTT connections lost."),
+	}
+}
+
+func (m *Metrics) publish(device string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.PublishFailures.Inc(device)
+		return
+	}
+	m.Publishes.Inc(device)
+}
+
+func (m *Metrics) marshalError(device string) {
+	if m != nil {
+		m.MarshalErrors.Inc(device)
+	}
+}
+
+func (m *Metrics) setDelivery(device string, err error) {
+	if m == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		m.SetDeliveries.Inc(device)
+	case errors.Is(err, ErrSetTimeout):
+		m.SetTimeouts.Inc(device)
+	}
+}
+
+// subscribeFailure counts a failed subscription. The topic is logged
+// by the subscription manager, not used as a label, so topic filters
+// cannot grow the series without bound.
+func (m *Metrics) subscribeFailure() {
+	if m != nil {
+		m.SubscribeFailures.Inc()
+	}
+}
+
+// forget drops device's series, for a device removed from the Registry.
+func (m *Metrics) forget(device string) {
+	if m == nil {
+		return
+	}
+	for _, c := range []*metrics.Counter{m.Publishes, m.PublishFailures, m.MarshalErrors, m.SetDeliveries, m.SetTimeouts} {
+		c.Delete(device)
+	}
+}
@@ -0,0 +1,194 @@
+// Package metrics is a small counter registry that renders the
+// Prometheus text exposition format, so otto can be scraped without
+// pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the Set the messenger packages record into unless told
+// otherwise.
+var Default = New()
+
+// Set is a collection of named counters.
+type Set struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// New returns an empty Set.
+func New() *Set {
+	return &Set{counters: map[string]*Counter{}}
+}
+
+// Counter returns the counter called name, creating it with help and
+// label names on first use. Asking for an existing name with different
+// labels panics, as it is a programming error.
+func (s *Set) Counter(name, help string, labels ...string) *Counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[name]; ok {
+		if !slices.Equal(c.labels, labels) {
+			panic(fmt.Sprintf("metrics: %s registered with labels %v, requested with %v", name, c.labels, labels))
+		}
+		return c
+	}
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]*series{}}
+	s.counters[name] = c
+	return c
+}
+
+// WriteTo writes every counter in the Prometheus text format, sorted by
+// name and label values.
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.counters))
+	for name := range s.counters {
+		names = append(names, name)
+	}
+	counters := make([]*Counter, 0, len(names))
+	slices.Sort(names)
+	for _, name := range names {
+		counters = append(counters, s.counters[name])
+	}
+	s.mu.Unlock()
+
+	var b strings.Builder
+	for _, c := range counters {
+		c.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the Set for a Prometheus scrape.
+func (s *Set) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = s.WriteTo(w)
+}
+
+// Counter is a monotonically increasing value, optionally split by
+// label values. A nil *Counter ignores updates.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]*series // by joined label values
+}
+
+type series struct {
+	labels []string
+	n      atomic.Uint64
+}
+
+// Inc adds one to the series for the given label values.
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds n to the series for the given label values, which must match
+// the counter's label names in number.
+func (c *Counter) Add(n uint64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	c.get(labelValues).n.Add(n)
+}
+
+// Value returns the current value of one series.
+func (c *Counter) Value(labelValues ...string) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, ok := c.values[key(labelValues)]; ok {
+		return s.n.Load()
+	}
+	return 0
+}
+
+// Delete drops the series for the given label values, for example when
+// the thing they name goes away.
+func (c *Counter) Delete(labelValues ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key(labelValues))
+}
+
+func (c *Counter) get(labelValues []string) *series {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	k := key(labelValues)
+
+	c.mu.RLock()
+	s, ok := c.values[k]
+	c.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok = c.values[k]; !ok {
+		s = &series{labels: slices.Clone(labelValues)}
+		c.values[k] = s
+	}
+	return s
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	all := make([]*series, len(keys))
+	for i, k := range keys {
+		all[i] = c.values[k]
+	}
+	c.mu.RUnlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", c.name, escapeHelp(c.help))
+	fmt.Fprintf(b, "# TYPE %s counter\n", c.name)
+	if len(all) == 0 && len(c.labels) == 0 {
+		fmt.Fprintf(b, "%s 0\n", c.name)
+	}
+	for _, s := range all {
+		b.WriteString(c.name)
+		if len(c.labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range c.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, "%s=\"%s\"", l, escapeLabel(s.labels[i]))
+			}
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(b, " %d\n", s.n.Load())
+	}
+}
+
+// key joins label values with a byte that cannot appear in UTF-8 text.
+func key(labelValues []string) string { return strings.Join(labelValues, "\xff") }
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterExposition(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	pubs := s.Counter("otto_publishes_total", "Messages published.", "device")
+	pubs.Inc("lamp")
+	pubs.Add(2, "lamp")
+	pubs.Inc(`we"ird\name`)
+	s.Counter("otto_reconnects_total", "Reconnects.")
+
+	var b strings.Builder
+	_, err := s.WriteTo(&b)
+	require.NoError(t, err)
+
+	assert.Equal(t, `# HELP otto_publishes_total Messages published.
+# TYPE otto_publishes_total counter
+otto_publishes_total{device="lamp"} 3
+otto_publishes_total{device="we\"ird\\name"} 1
+# HELP otto_reconnects_total Reconnects.
+# TYPE otto_reconnects_total counter
+otto_reconnects_total 0
+`, b.String())
+
+	assert.EqualValues(t, 3, pubs.Value("lamp"))
+	assert.EqualValues(t, 0, pubs.Value("pump"))
+}
+
+func TestCounterDelete(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	pubs := s.Counter("otto_publishes_total", "Messages published.", "device")
+	pubs.Inc("lamp")
+	pubs.Inc("pump")
+	pubs.Delete("lamp")
+	pubs.Delete("valve")
+
+	var b strings.Builder
+	_, err := s.WriteTo(&b)
+	require.NoError(t, err)
+	assert.NotContains(t, b.String(), "lamp")
+	assert.Contains(t, b.String(), `otto_publishes_total{device="pump"} 1`)
+	assert.Zero(t, pubs.Value("lamp"))
+}
+
+func TestCounterSameNameReturnsSameCounter(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	a := s.Counter("x_total", "x", "device")
+	b := s.Counter("x_total", "x", "device")
+	assert.Same(t, a, b)
+
+	assert.Panics(t, func() { s.Counter("x_total", "x", "topic") })
+	assert.Panics(t, func() { a.Inc() })
+}
+
+func TestNilCounterIgnoresUpdates(t *testing.T) {
+	t.Parallel()
+
+	var c *Counter
+	assert.NotPanics(t, func() { c.Inc("lamp") })
+	assert.NotPanics(t, func() { c.Delete("lamp") })
+	assert.Zero(t, c.Value("lamp"))
+}
+
+func TestCounterConcurrentInc(t *testing.T) {
+	t.Parallel()
+
+	c := New().Counter("n_total", "n", "device")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.Inc("lamp")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 8000, c.Value("lamp"))
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	s := New()
+	s.Counter("up_total", "Up.").Inc()
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "up_total 1\n")
+}
@@ -0,0 +1,78 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/rustyeddy/otto/messenger/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failCodec struct{}
+
+func (failCodec) Marshal(int) ([]byte, error)   { return nil, errors.New("no") }
+func (failCodec) Unmarshal([]byte) (int, error) { return 0, errors.New("no") }
+
+type failSubMQTT struct{ wireMQTT }
+
+func (m *failSubMQTT) Subscribe(context.Context, string, byte, func(Message)) (func() error, error) {
+	return nil, errors.New("not authorized")
+}
+
+func TestRegistryRecordsMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	m := NewMetrics(metrics.New())
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Metrics = m
+	reg.CommandTimeout = 10 * time.Millisecond
+
+	src := testutils.NewSource[int]("temp", 1)
+	WireSource(ctx, reg, src, codec.JSON[int]{})
+	src.Set() <- 21
+	_, ok := testutils.WaitRecv(mqtt.publishCh, time.Second)
+	require.True(t, ok)
+
+	bad := testutils.NewSource[int]("bad", 1)
+	WireSource(ctx, reg, bad, failCodec{})
+	bad.Set() <- 1
+
+	// The second set finds the one-slot buffer full and times out.
+	sink := testutils.NewSink[int]("pump", 1)
+	require.NoError(t, reg.Add(sink))
+	WireSink(ctx, reg, sink, codec.JSON[int]{})
+	require.NoError(t, reg.Set(ctx, "pump", []byte("1")))
+	assert.ErrorIs(t, reg.Set(ctx, "pump", []byte("2")), ErrSetTimeout)
+
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if m.MarshalErrors.Value("bad") != 1 {
+			return errors.New("marshal error not counted")
+		}
+		return nil
+	}))
+	assert.EqualValues(t, 1, m.Publishes.Value("temp"))
+	assert.EqualValues(t, 1, m.SetDeliveries.Value("pump"))
+	assert.EqualValues(t, 1, m.SetTimeouts.Value("pump"))
+
+	// Removing a device drops its series.
+	require.NoError(t, reg.Remove(ctx, "pump"))
+	assert.Zero(t, m.SetDeliveries.Value("pump"))
+	assert.Zero(t, m.SetTimeouts.Value("pump"))
+	assert.Zero(t, m.Publishes.Value("pump"))
+	assert.EqualValues(t, 1, m.Publishes.Value("temp"))
+
+	failing := NewRegistry(&failSubMQTT{}, nil)
+	failing.Metrics = m
+	failing.WantSub("otto/devices/pump/set", 1, func(Message) {})
+	failing.ResubscribeAll(ctx)
+	assert.EqualValues(t, 1, m.SubscribeFailures.Value())
+}
@@ -3,8 +3,11 @@ package mqtt
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
@@ -18,18 +21,73 @@ type Paho struct {
 
 	// Called whenever Paho connects/reconnects.
 	onConnect func()
+
+	// Called before each automatic reconnect.
+	onReconnecting func()
+
+	// Will of the live session and a will set after Connect, sent with
+	// the next reconnect. Disconnect publishes the latest of the two.
+	willMu   sync.Mutex
+	will     *messenger.Message
+	nextWill *messenger.Message
+
+	metrics  *messenger.Metrics
+	connects atomic.Int64
+
+	// Config error reported by Connect
+	err error
+
+	connectTimeout   time.Duration
+	publishTimeout   time.Duration
+	subscribeTimeout time.Duration
+
+	conn connWatch
 }
 
 type Config struct {
-	Broker   string // e.g. "tcp://10.11.0.10:1883"
+	Broker   string // e.g. "tcp://10.11.0.10:1883", "ssl://broker:8883" or "wss://broker/mqtt"
 	ClientID string // if empty, random
-	Username string
-	Password string
+	Username string // if empty, $OTTO_MQTT_USERNAME
+	Password string // if empty, read from PasswordFile, else $OTTO_MQTT_PASSWORD
+
+	// PasswordFile holds the password, keeping it off the command line.
+	PasswordFile string
+
+	// TLS configures ssl://, tls://, mqtts:// and wss:// brokers. When
+	// nil they are verified against the system roots.
+	TLS *TLSConfig
 
 	CleanSession bool
+
+	// Timeouts for broker round trips, applied unless ctx ends first.
+	ConnectTimeout   time.Duration // default 15s
+	PublishTimeout   time.Duration // QoS 1 and 2 acks; default 5s
+	SubscribeTimeout time.Duration // subscribe and unsubscribe acks; default 10s
+
+	// MQTT 5 (V5) only. MaxPacketSize is the largest packet accepted
+	// from the broker and is advertised in CONNECT; default 1 MiB.
+	// InboxSize bounds the received messages waiting for their
+	// handlers; when full, new ones are dropped. Default 1024.
+	MaxPacketSize uint32
+	InboxSize     int
+
+	// Metrics receives reconnect and connection-loss counts. Defaults to
+	// messenger.DefaultMetrics.
+	Metrics *messenger.Metrics
 }
 
+func (cfg Config) metrics() *messenger.Metrics {
+	if cfg.Metrics == nil {
+		return messenger.DefaultMetrics
+	}
+	return cfg.Metrics
+}
+
+// New returns a Paho client for cfg. Errors loading credentials or TLS
+// files are returned by Connect.
 func New(cfg Config) *Paho {
+	cfg, tlsCfg, err := cfg.resolve()
+
 	id := cfg.ClientID
 	if id == "" {
 		id = "otto-" + randSuffix()
@@ -41,17 +99,50 @@ func New(cfg Config) *Paho {
 		SetUsername(cfg.Username).
 		SetPassword(cfg.Password).
 		SetAutoReconnect(true).
-		SetConnectTimeout(10 * time.Second).
+		SetConnectTimeout(orDefault(cfg.ConnectTimeout, defaultConnectTimeout)).
 		SetCleanSession(cfg.CleanSession)
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
 
-	p := &Paho{opts: opts}
+	p := &Paho{
+		opts:             opts,
+		metrics:          cfg.metrics(),
+		err:              err,
+		connectTimeout:   cfg.ConnectTimeout,
+		publishTimeout:   cfg.PublishTimeout,
+		subscribeTimeout: cfg.SubscribeTimeout,
+	}
 
 	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
 		slog.Info("MQTT disconnected", "error", err)
+		p.metrics.ConnectionsLost.Inc()
+		p.conn.set(StateDisconnected, err)
+	})
+
+	opts.SetReconnectingHandler(func(_ paho.Client, o *paho.ClientOptions) {
+		p.conn.set(StateReconnecting, nil)
+		if p.onReconnecting != nil {
+			p.onReconnecting()
+		}
+		p.willMu.Lock()
+		w := p.nextWill
+		p.nextWill = nil
+		if w != nil {
+			p.will = w
+		}
+		p.willMu.Unlock()
+		if w != nil {
+			o.SetWill(w.Topic, string(w.Payload), w.QoS, w.Retain)
+		}
 	})
 
 	opts.OnConnect = func(_ paho.Client) {
 		slog.Info("MQTT connected")
+		p.conn.set(StateConnected, nil)
+		if p.connects.Add(1) > 1 {
+			p.metrics.Reconnects.Inc()
+		}
 		if p.onConnect != nil {
 			p.onConnect()
 		}
@@ -73,38 +164,169 @@ func (p *Paho) SetOnConnect(fn func()) {
 	p.onConnect = fn
 }
 
+// SetOnReconnecting registers fn to run before each automatic reconnect.
+// A will set from fn is sent with that reconnect.
+func (p *Paho) SetOnReconnecting(fn func()) {
+	p.onReconnecting = fn
+}
+
+// Default round-trip timeouts, see Config.
+const (
+	defaultConnectTimeout   = 15 * time.Second
+	defaultPublishTimeout   = 5 * time.Second
+	defaultSubscribeTimeout = 10 * time.Second
+)
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// wait waits for tok until timeout passes or ctx ends. A timeout wraps
+// context.DeadlineExceeded.
+func wait(ctx context.Context, tok paho.Token, timeout time.Duration, op string) error {
+	if dl, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(dl))
+	}
+	done := make(chan bool, 1)
+	go func() { done <- tok.WaitTimeout(timeout) }()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			return fmt.Errorf("mqtt %s timeout: %w", op, context.DeadlineExceeded)
+		}
+		return tok.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("mqtt %s: %w", op, ctx.Err())
+	}
+}
+
+// State returns the current connection state.
+func (p *Paho) State() ConnState { return p.conn.get() }
+
+// WatchState streams connection state changes on a channel holding up
+// to buf events; events are dropped while it is full. Call stop to end
+// the stream and close the channel.
+func (p *Paho) WatchState(buf int) (events <-chan ConnEvent, stop func()) {
+	return p.conn.watch(buf)
+}
+
+// Connect connects to the broker, waiting until ctx ends or
+// ConnectTimeout passes. Paho then reconnects on its own.
 func (p *Paho) Connect(ctx context.Context) error {
+	if p.err != nil {
+		return p.err
+	}
 	if p.c == nil {
 		p.c = paho.NewClient(p.opts)
 	}
-	tok := p.c.Connect()
-	if !tok.WaitTimeout(15 * time.Second) {
-		return errors.New("mqtt connect timeout")
+	p.conn.set(StateConnecting, nil)
+	err := wait(ctx, p.c.Connect(), orDefault(p.connectTimeout, defaultConnectTimeout), "connect")
+	if err != nil {
+		p.conn.set(StateDisconnected, err)
+	}
+	return err
+}
+
+// Disconnect publishes the latest will set by SetWill, then closes the
+// connection. The broker discards the will on a clean disconnect, so
+// without this subscribers would never see the offline status it
+// carries. The will publish and in-flight work are each given until ctx
+// ends, at most a second, to finish.
+func (p *Paho) Disconnect(ctx context.Context) error {
+	if p.c == nil {
+		return nil
+	}
+
+	p.willMu.Lock()
+	w := p.will
+	if p.nextWill != nil {
+		w = p.nextWill
+	}
+	p.willMu.Unlock()
+	var err error
+	if w != nil {
+		wctx, cancel := context.WithTimeout(ctx, time.Second)
+		err = p.Publish(wctx, w.Topic, w.Payload, w.Retain, w.QoS)
+		cancel()
+		if errors.Is(err, messenger.ErrNotConnected) {
+			// The connection is gone and the broker has sent the will.
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("mqtt disconnect: publish will: %w", err)
+		}
+	}
+
+	quiesce := time.Second
+	if dl, ok := ctx.Deadline(); ok {
+		quiesce = max(min(quiesce, time.Until(dl)), 0)
 	}
-	return tok.Error()
+	p.c.Disconnect(uint(quiesce.Milliseconds()))
+	p.conn.set(StateDisconnected, nil)
+	return err
 }
 
+// SetWill sets the will sent with the next CONNECT. A connection has one
+// will, so a later call replaces an earlier one. The broker holds the
+// will of the live session, so once Connect has run it takes effect on
+// the next reconnect. Disconnect publishes the latest will itself.
 func (p *Paho) SetWill(topic string, payload []byte, retain bool, qos byte) error {
 	if p.opts == nil {
 		return errors.New("mqtt options not initialized")
 	}
+	if p.c != nil {
+		p.willMu.Lock()
+		defer p.willMu.Unlock()
+		p.nextWill = &messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos}
+		return nil
+	}
 	// Paho expects string payload for will.
 	p.opts.SetWill(topic, string(payload), qos, retain)
+	p.willMu.Lock()
+	p.will = &messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos}
+	p.willMu.Unlock()
 	return nil
 }
 
+// Publish sends a message. QoS 1 and 2 publishes wait for the broker's
+// ack until ctx ends or PublishTimeout passes.
+//
+// Paho reports itself connected while it reconnects and completes QoS 0
+// publishes it cannot send, so Publish returns messenger.ErrNotConnected
+// unless the connection is open. A QoS 1 or 2 publish that times out stays
+// in Paho's store and may still be delivered; its error wraps
+// messenger.ErrPublishPending.
 func (p *Paho) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p.c == nil || !p.c.IsConnectionOpen() {
+		return messenger.ErrNotConnected
+	}
 	tok := p.c.Publish(topic, qos, retain, payload)
-	// For QoS0, we usually don't need to wait. For QoS1, wait briefly.
-	if qos > 0 {
-		if !tok.WaitTimeout(5 * time.Second) {
-			return errors.New("mqtt publish timeout")
+	// For QoS0, we usually don't need to wait.
+	if qos == 0 {
+		return tok.Error()
+	}
+	err := wait(ctx, tok, orDefault(p.publishTimeout, defaultPublishTimeout), "publish")
+	if err != nil {
+		select {
+		case <-tok.Done():
+		default:
+			return fmt.Errorf("%w: %w", messenger.ErrPublishPending, err)
 		}
 	}
-	return tok.Error()
+	return err
 }
 
+// Subscribe subscribes handler to topic, waiting for the broker's ack
+// until ctx ends or SubscribeTimeout passes.
 func (p *Paho) Subscribe(ctx context.Context, topic string, qos byte, handler func(messenger.Message)) (func() error, error) {
+	timeout := orDefault(p.subscribeTimeout, defaultSubscribeTimeout)
 	tok := p.c.Subscribe(topic, qos, func(_ paho.Client, msg paho.Message) {
 		handler(messenger.Message{
 			Topic:   msg.Topic(),
@@ -113,18 +335,11 @@ func (p *Paho) Subscribe(ctx context.Context, topic string, qos byte, handler fu
 			QoS:     msg.Qos(),
 		})
 	})
-	if !tok.WaitTimeout(10 * time.Second) {
-		return nil, errors.New("mqtt subscribe timeout")
-	}
-	if tok.Error() != nil {
-		return nil, tok.Error()
+	if err := wait(ctx, tok, timeout, "subscribe"); err != nil {
+		return nil, err
 	}
 
 	return func() error {
-		ut := p.c.Unsubscribe(topic)
-		if !ut.WaitTimeout(10 * time.Second) {
-			return errors.New("mqtt unsubscribe timeout")
-		}
-		return ut.Error()
+		return wait(context.Background(), p.c.Unsubscribe(topic), timeout, "unsubscribe")
 	}, nil
 }
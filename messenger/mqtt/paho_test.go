@@ -8,6 +8,8 @@ import (
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/broker"
+	"github.com/rustyeddy/otto/messenger/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,7 +24,9 @@ type fakeToken struct {
 
 func newFakeToken(waitTimeoutResult bool, err error) *fakeToken {
 	ch := make(chan struct{})
-	close(ch)
+	if waitTimeoutResult {
+		close(ch)
+	}
 	return &fakeToken{
 		waitTimeoutResult: waitTimeoutResult,
 		err:               err,
@@ -195,7 +199,7 @@ func TestPublishQoS0DoesNotWait(t *testing.T) {
 	t.Parallel()
 
 	token := newFakeToken(true, nil)
-	client := &fakeClient{publishToken: token}
+	client := &fakeClient{connectedState: true, publishToken: token}
 	p := &Paho{c: client}
 
 	err := p.Publish(context.Background(), "topic", []byte("payload"), false, 0)
@@ -209,7 +213,7 @@ func TestPublishQoS1Waits(t *testing.T) {
 	t.Parallel()
 
 	token := newFakeToken(true, nil)
-	p := &Paho{c: &fakeClient{publishToken: token}}
+	p := &Paho{c: &fakeClient{connectedState: true, publishToken: token}}
 
 	err := p.Publish(context.Background(), "topic", []byte("payload"), false, 1)
 	require.NoError(t, err)
@@ -220,10 +224,25 @@ func TestPublishTimeout(t *testing.T) {
 	t.Parallel()
 
 	token := newFakeToken(false, nil)
-	p := &Paho{c: &fakeClient{publishToken: token}}
+	p := &Paho{c: &fakeClient{connectedState: true, publishToken: token}}
 
 	err := p.Publish(context.Background(), "topic", []byte("payload"), false, 1)
 	require.Error(t, err)
+	assert.ErrorIs(t, err, messenger.ErrPublishPending, "Paho still holds the message")
+}
+
+func TestPublishWhileNotConnected(t *testing.T) {
+	t.Parallel()
+
+	client := &fakeClient{publishToken: newFakeToken(true, nil)}
+	p := &Paho{c: client}
+	err := p.Publish(context.Background(), "topic", []byte("payload"), false, 0)
+	assert.ErrorIs(t, err, messenger.ErrNotConnected)
+	assert.Empty(t, client.published)
+
+	// Before Connect there is no client at all.
+	err = (&Paho{}).Publish(context.Background(), "topic", []byte("payload"), false, 0)
+	assert.ErrorIs(t, err, messenger.ErrNotConnected)
 }
 
 func TestSubscribeSuccessAndUnsubscribe(t *testing.T) {
@@ -288,3 +307,147 @@ func TestSubscribeTokenError(t *testing.T) {
 	_, err := p.Subscribe(context.Background(), "topic", 1, func(messenger.Message) {})
 	require.Error(t, err)
 }
+
+func TestPahoCountsReconnectsAndLosses(t *testing.T) {
+	t.Parallel()
+
+	m := messenger.NewMetrics(metrics.New())
+	p := New(Config{Broker: "tcp://example:1883", Metrics: m})
+
+	p.opts.OnConnect(nil)
+	assert.Zero(t, m.Reconnects.Value(), "first connect is not a reconnect")
+
+	p.opts.OnConnectionLost(nil, errors.New("eof"))
+	p.opts.OnConnect(nil)
+	p.opts.OnConnectionLost(nil, errors.New("eof"))
+	p.opts.OnConnect(nil)
+
+	assert.EqualValues(t, 2, m.Reconnects.Value())
+	assert.EqualValues(t, 2, m.ConnectionsLost.Value())
+}
+
+// stuckToken never completes; WaitTimeout blocks for the full timeout.
+type stuckToken struct{ done chan struct{} }
+
+func (t *stuckToken) Wait() bool { <-t.done; return true }
+func (t *stuckToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+func (t *stuckToken) Done() <-chan struct{} { return t.done }
+func (t *stuckToken) Error() error          { return nil }
+
+func TestPahoHonorsContext(t *testing.T) {
+	t.Parallel()
+
+	stuck := &stuckToken{done: make(chan struct{})}
+	client := &fakeClient{connectToken: stuck, publishToken: stuck, subscribeToken: stuck}
+	p := &Paho{opts: paho.NewClientOptions(), c: client, publishTimeout: 20 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := p.Connect(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, StateDisconnected, p.State())
+
+	// The configured timeout applies when ctx has no deadline.
+	client.connectedState = true
+	err = p.Publish(context.Background(), "topic", nil, false, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// A ctx deadline shorter than the default applies too.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	t.Cleanup(cancel)
+	_, err = p.Subscribe(ctx, "topic", 1, func(messenger.Message) {})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// A done ctx publishes nothing.
+	<-ctx.Done()
+	require.ErrorIs(t, p.Publish(ctx, "topic", nil, false, 0), context.DeadlineExceeded)
+	assert.Len(t, client.published, 1)
+}
+
+func TestPahoDisconnectPublishesWill(t *testing.T) {
+	t.Parallel()
+
+	p := New(Config{Broker: "tcp://example:1883"})
+	require.NoError(t, p.SetWill("otto/stations/garden/status", []byte(`{"status":"offline"}`), true, 1))
+	assert.Equal(t, "otto/stations/garden/status", p.opts.WillTopic)
+
+	client := &fakeClient{connectedState: true, publishToken: newFakeToken(true, nil)}
+	p.c = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	require.NoError(t, p.Disconnect(ctx))
+	require.Len(t, client.published, 1, "the broker drops the will on a clean disconnect")
+	assert.Equal(t, publishArgs{topic: "otto/stations/garden/status", qos: 1, retain: true, payload: []byte(`{"status":"offline"}`)}, client.published[0])
+	assert.Equal(t, StateDisconnected, p.State())
+
+	// A will set after Connect is the one published.
+	require.NoError(t, p.SetWill("otto/stations/garden/status", []byte(`{"status":"stopped"}`), true, 1))
+	require.NoError(t, p.Disconnect(ctx))
+	require.Len(t, client.published, 2)
+	assert.Equal(t, []byte(`{"status":"stopped"}`), client.published[1].payload)
+
+	// Once the connection is gone the broker has sent the will already.
+	client.connectedState = false
+	require.NoError(t, p.Disconnect(ctx))
+	assert.Len(t, client.published, 2)
+
+	assert.NoError(t, (&Paho{}).Disconnect(ctx), "never connected")
+}
+
+func TestPahoDisconnectLeavesWillOnBroker(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	b := broker.New(broker.Config{Addr: "127.0.0.1:0"})
+	require.NoError(t, b.Start(ctx))
+	t.Cleanup(func() {
+		cancel()
+		b.Wait()
+	})
+
+	p := New(Config{Broker: "tcp://" + b.Addr().String()})
+	require.NoError(t, p.SetWill("otto/stations/garden/status", []byte("offline"), true, 1))
+	require.NoError(t, p.Connect(ctx))
+	require.NoError(t, p.Publish(ctx, "otto/stations/garden/status", []byte("online"), true, 1))
+	require.NoError(t, p.Disconnect(ctx))
+
+	m, ok := b.Retained("otto/stations/garden/status")
+	require.True(t, ok)
+	assert.Equal(t, "offline", string(m.Payload))
+}
+
+func TestPahoWillAfterConnect(t *testing.T) {
+	t.Parallel()
+
+	p := New(Config{Broker: "tcp://example:1883"})
+	require.NoError(t, p.SetWill("spBv1.0/plant/NDEATH/edge1", []byte("0"), false, 1))
+	p.c = &fakeClient{connectedState: true}
+
+	// The live session keeps its will; the new one waits for a reconnect,
+	// and one set while reconnecting goes out with it.
+	require.NoError(t, p.SetWill("spBv1.0/plant/NDEATH/edge1", []byte("1"), false, 1))
+	assert.Equal(t, "0", string(p.opts.WillPayload))
+	calls := 0
+	p.SetOnReconnecting(func() {
+		calls++
+		require.NoError(t, p.SetWill("spBv1.0/plant/NDEATH/edge1", []byte("2"), false, 1))
+	})
+
+	o := *p.opts
+	o.OnReconnecting(p.c, &o)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "2", string(o.WillPayload))
+	assert.Equal(t, StateReconnecting, p.State())
+}
@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnState is the connection state of a client.
+type ConnState string
+
+const (
+	StateDisconnected ConnState = "disconnected"
+	StateConnecting   ConnState = "connecting"
+	StateConnected    ConnState = "connected"
+	StateReconnecting ConnState = "reconnecting"
+)
+
+// ConnEvent reports a change of connection state.
+type ConnEvent struct {
+	State   ConnState
+	Err     error // why the connection was lost or an attempt failed
+	Attempt int   // reconnect attempts since the connection was lost
+	Time    time.Time
+}
+
+// connWatch tracks a client's connection state and fans changes out to
+// watchers.
+type connWatch struct {
+	mu       sync.Mutex
+	state    ConnState
+	attempt  int
+	err      error // last connection error, until connected again
+	watchers map[chan ConnEvent]struct{}
+}
+
+func (w *connWatch) get() ConnState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == "" {
+		return StateDisconnected
+	}
+	return w.state
+}
+
+// set records a new state. Reconnecting counts an attempt and carries
+// the error the connection was lost with; connecting and connected
+// reset the count.
+func (w *connWatch) set(s ConnState, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s == StateReconnecting {
+		w.attempt++
+	} else {
+		w.err = err
+	}
+	if s == StateConnected || s == StateConnecting {
+		w.attempt = 0
+	}
+	w.state = s
+
+	ev := ConnEvent{State: s, Err: w.err, Attempt: w.attempt, Time: time.Now()}
+	for ch := range w.watchers {
+		select {
+		case ch <- ev:
+		default:
+			// Slow watcher: drop rather than stall the client.
+		}
+	}
+}
+
+func (w *connWatch) watch(buf int) (<-chan ConnEvent, func()) {
+	ch := make(chan ConnEvent, max(buf, 1))
+	w.mu.Lock()
+	if w.watchers == nil {
+		w.watchers = map[chan ConnEvent]struct{}{}
+	}
+	w.watchers[ch] = struct{}{}
+	w.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.watchers, ch)
+			w.mu.Unlock()
+			close(ch)
+		})
+	}
+}
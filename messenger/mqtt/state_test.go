@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPahoStateEvents(t *testing.T) {
+	t.Parallel()
+
+	p := New(Config{Broker: "tcp://example:1883"})
+	events, stop := p.WatchState(8)
+	assert.Equal(t, StateDisconnected, p.State())
+
+	lost := errors.New("eof")
+	p.opts.OnConnect(nil)
+	p.opts.OnConnectionLost(nil, lost)
+	p.opts.OnReconnecting(nil, nil)
+	p.opts.OnReconnecting(nil, nil)
+	assert.Equal(t, StateReconnecting, p.State())
+	p.opts.OnConnect(nil)
+	assert.Equal(t, StateConnected, p.State())
+
+	want := []ConnEvent{
+		{State: StateConnected},
+		{State: StateDisconnected, Err: lost},
+		{State: StateReconnecting, Err: lost, Attempt: 1},
+		{State: StateReconnecting, Err: lost, Attempt: 2},
+		{State: StateConnected},
+	}
+	for _, w := range want {
+		ev, ok := testutils.WaitRecv(events, time.Second)
+		require.True(t, ok)
+		assert.False(t, ev.Time.IsZero())
+		ev.Time = time.Time{}
+		assert.Equal(t, w, ev)
+	}
+
+	stop()
+	stop()
+	_, open := <-events
+	assert.False(t, open)
+	p.opts.OnConnectionLost(nil, lost) // no watchers left
+}
@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Environment variables consulted for credentials not set in Config.
+const (
+	EnvUsername = "OTTO_MQTT_USERNAME"
+	EnvPassword = "OTTO_MQTT_PASSWORD"
+)
+
+// TLSConfig configures TLS for ssl://, tls://, mqtts:// and wss://
+// brokers. Files are PEM encoded.
+type TLSConfig struct {
+	CAFile   string // CA bundle for the broker certificate; system roots when empty
+	CertFile string // client certificate, for mutual TLS
+	KeyFile  string // client key, for mutual TLS
+
+	ServerName string // name checked against the broker certificate; the URL host when empty
+	MinVersion string // "1.2" (default) or "1.3"
+
+	// InsecureSkipVerify accepts any broker certificate. Testing only.
+	InsecureSkipVerify bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config loads the files named in t into a *tls.Config.
+func (t *TLSConfig) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[strings.TrimPrefix(t.MinVersion, "TLS")]
+		if !ok {
+			return nil, fmt.Errorf("mqtt tls: unknown min version %q", t.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt tls: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt tls: no certificates in %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	switch {
+	case t.CertFile != "" && t.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt tls: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case t.CertFile != "" || t.KeyFile != "":
+		return nil, errors.New("mqtt tls: client certificate and key must be given together")
+	}
+	return cfg, nil
+}
+
+// secureSchemes are the broker URL schemes that use TLS.
+var secureSchemes = map[string]bool{"ssl": true, "tls": true, "mqtts": true, "wss": true}
+
+// resolve fills credentials from PasswordFile and the environment and
+// builds the TLS configuration the broker URL calls for.
+func (cfg Config) resolve() (Config, *tls.Config, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("mqtt: broker url: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ws", "ssl", "tls", "mqtts", "wss":
+	default:
+		return cfg, nil, fmt.Errorf("mqtt: unsupported broker scheme %q", u.Scheme)
+	}
+
+	if cfg.Username == "" {
+		cfg.Username = os.Getenv(EnvUsername)
+	}
+	if cfg.Password == "" && cfg.PasswordFile != "" {
+		b, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("mqtt: password file: %w", err)
+		}
+		cfg.Password = strings.TrimRight(string(b), "\r\n")
+	}
+	if cfg.Password == "" {
+		cfg.Password = os.Getenv(EnvPassword)
+	}
+
+	if !secureSchemes[u.Scheme] {
+		if cfg.TLS != nil {
+			return cfg, nil, fmt.Errorf("mqtt: TLS configured for plaintext broker %s", cfg.Broker)
+		}
+		return cfg, nil, nil
+	}
+	t := cfg.TLS
+	if t == nil {
+		t = &TLSConfig{}
+	}
+	tc, err := t.Config()
+	return cfg, tc, err
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/broker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and
+// "broker.test" and a client certificate, written as PEM files to dir.
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	p := &testPKI{dir: t.TempDir()}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "otto test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	p.ca, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	p.caKey = key
+	p.write(t, "ca.pem", "CERTIFICATE", der)
+
+	p.server = p.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	p.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+// issue signs a certificate and writes <name>.pem and <name>-key.pem.
+func (p *testPKI) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"broker.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	p.write(t, name+".pem", "CERTIFICATE", der)
+	p.write(t, name+"-key.pem", "EC PRIVATE KEY", kb)
+
+	cert, err := tls.LoadX509KeyPair(p.path(name+".pem"), p.path(name+"-key.pem"))
+	require.NoError(t, err)
+	return cert
+}
+
+func (p *testPKI) write(t *testing.T, name, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(p.path(name), b, 0o600))
+}
+
+func (p *testPKI) path(name string) string { return filepath.Join(p.dir, name) }
+
+func (p *testPKI) clientTLS() *TLSConfig {
+	return &TLSConfig{CAFile: p.path("ca.pem"), CertFile: p.path("client.pem"), KeyFile: p.path("client-key.pem")}
+}
+
+// startTLSBroker runs an embedded broker behind a listener requiring a
+// client certificate signed by the test CA, and returns its address.
+func startTLSBroker(t *testing.T, p *testPKI) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := broker.New(broker.Config{Addr: "127.0.0.1:0"})
+	require.NoError(t, b.Start(ctx))
+	t.Cleanup(func() {
+		cancel()
+		b.Wait()
+	})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			in, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer in.Close()
+				out, err := net.Dial("tcp", b.Addr().String())
+				if err != nil {
+					return
+				}
+				defer out.Close()
+				go func() {
+					_, _ = io.Copy(out, in)
+					_ = out.Close()
+				}()
+				_, _ = io.Copy(in, out)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	p := newTestPKI(t)
+	tc := p.clientTLS()
+	tc.ServerName = "broker.test"
+	tc.MinVersion = "1.3"
+
+	cfg, err := tc.Config()
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.RootCAs)
+	assert.Len(t, cfg.Certificates, 1)
+	assert.Equal(t, "broker.test", cfg.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+
+	cfg, err = (&TLSConfig{}).Config()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Nil(t, cfg.RootCAs, "system roots")
+
+	for _, bad := range []*TLSConfig{
+		{MinVersion: "1.4"},
+		{CAFile: p.path("missing.pem")},
+		{CAFile: p.path("client-key.pem")},
+		{CertFile: p.path("client.pem")},
+	} {
+		_, err := bad.Config()
+		assert.Error(t, err, "%+v", bad)
+	}
+}
+
+func TestConfigResolve(t *testing.T) {
+	dir := t.TempDir()
+	pw := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(pw, []byte("s3cret\n"), 0o600))
+	t.Setenv(EnvUsername, "env-user")
+	t.Setenv(EnvPassword, "env-pass")
+
+	cfg, tc, err := Config{Broker: "tcp://b:1883", PasswordFile: pw}.resolve()
+	require.NoError(t, err)
+	assert.Nil(t, tc)
+	assert.Equal(t, "env-user", cfg.Username)
+	assert.Equal(t, "s3cret", cfg.Password)
+
+	cfg, _, err = Config{Broker: "tcp://b:1883", Username: "u", Password: "p"}.resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "u", cfg.Username)
+	assert.Equal(t, "p", cfg.Password)
+
+	cfg, _, err = Config{Broker: "tcp://b:1883"}.resolve()
+	require.NoError(t, err)
+	assert.Equal(t, "env-pass", cfg.Password)
+
+	for _, broker := range []string{"ssl://b", "tls://b", "mqtts://b", "wss://b/mqtt"} {
+		_, tc, err := Config{Broker: broker}.resolve()
+		require.NoError(t, err, broker)
+		assert.NotNil(t, tc, broker)
+	}
+	_, tc, err = Config{Broker: "ws://b/mqtt"}.resolve()
+	require.NoError(t, err)
+	assert.Nil(t, tc)
+
+	_, _, err = Config{Broker: "tcp://b:1883", TLS: &TLSConfig{}}.resolve()
+	assert.Error(t, err, "TLS on a plaintext URL")
+	_, _, err = Config{Broker: "http://b"}.resolve()
+	assert.Error(t, err)
+	_, _, err = Config{Broker: "tcp://b", PasswordFile: filepath.Join(dir, "missing")}.resolve()
+	assert.Error(t, err)
+}
+
+func TestPahoConnectReportsConfigError(t *testing.T) {
+	t.Parallel()
+
+	p := New(Config{Broker: "ssl://b:8883", TLS: &TLSConfig{CAFile: "/nonexistent/ca.pem"}})
+	assert.Error(t, p.Connect(context.Background()))
+}
+
+func TestPahoMutualTLS(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	p := newTestPKI(t)
+	addr := startTLSBroker(t, p)
+
+	c := New(Config{Broker: "ssl://" + addr, TLS: p.clientTLS()})
+	require.NoError(t, c.Connect(ctx))
+	t.Cleanup(func() { c.c.Disconnect(0) })
+
+	got := make(chan messenger.Message, 1)
+	_, err := c.Subscribe(ctx, "otto/devices/lamp/state", 1, func(m messenger.Message) { got <- m })
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(ctx, "otto/devices/lamp/state", []byte("true"), false, 1))
+
+	select {
+	case m := <-got:
+		assert.Equal(t, []byte("true"), m.Payload)
+	case <-ctx.Done():
+		require.Fail(t, "message not received over TLS")
+	}
+
+	// Without a client certificate the handshake is refused.
+	noCert := New(Config{Broker: "tls://" + addr, TLS: &TLSConfig{CAFile: p.path("ca.pem")}})
+	noCert.opts.SetConnectRetry(false).SetAutoReconnect(false)
+	assert.Error(t, noCert.Connect(ctx))
+}
+
+func TestV5BrokerAddrTLSPort(t *testing.T) {
+	t.Parallel()
+
+	addr, err := brokerAddr("mqtts://broker.test")
+	require.NoError(t, err)
+	assert.Equal(t, "broker.test:8883", addr)
+
+	addr, err = brokerAddr("tcp://broker.test")
+	require.NoError(t, err)
+	assert.Equal(t, "broker.test:1883", addr)
+}
@@ -0,0 +1,731 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// ReasonCodeError reports an MQTT 5 reason code of 0x80 or above returned
+// by the broker.
+type ReasonCodeError struct {
+	Op     string // "connect", "publish", "subscribe" or "unsubscribe"
+	Code   byte
+	Reason string // optional reason string sent by the broker
+}
+
+func (e *ReasonCodeError) Error() string {
+	msg := fmt.Sprintf("mqtt %s failed: %s (0x%02x)", e.Op, reasonName(e.Code), e.Code)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+var reasonNames = map[byte]string{
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "qos not supported",
+	0x9E: "shared subscriptions not supported",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+func reasonName(code byte) string {
+	if n, ok := reasonNames[code]; ok {
+		return n
+	}
+	return "error"
+}
+
+var errNotConnected = messenger.ErrNotConnected
+
+// v5Sub is one Subscribe call. Several may share a filter; each is
+// removed only by its own unsubscribe.
+type v5Sub struct {
+	filter  string
+	qos     byte
+	handler func(messenger.Message)
+}
+
+// Defaults for the MQTT 5 limits in Config.
+const (
+	defaultMaxPacketSize = 1 << 20
+	defaultInboxSize     = 1024
+)
+
+// V5 is an MQTT 5 client implementing messenger.MQTT. Unlike Paho it
+// carries Message.Properties on publish and delivery, and reports
+// broker reason codes as *ReasonCodeError.
+//
+// It implements only what messenger.MQTT needs: QoS 0-2, wills set for
+// the next CONNECT, properties, reason codes and reconnects driven by
+// the Registry's ResubscribeAll. Packets from the broker larger than
+// Config.MaxPacketSize end the connection, and packets larger than the
+// broker's own maximum are refused before sending. eclipse/paho.golang covers MQTT 5 in
+// full, but its autopaho connection manager owns reconnects,
+// subscriptions and the will itself, which would bypass the Registry's
+// subscription manager and station will, and it would add a second
+// Paho dependency to the module. Topic aliases, flow control, enhanced
+// auth and in-flight retransmission after a reconnect are not
+// supported; switch to paho.golang if those are needed.
+type V5 struct {
+	cfg       Config
+	id        string
+	keepAlive time.Duration
+
+	// Called whenever the client connects/reconnects.
+	onConnect func()
+
+	// Called before each automatic reconnect attempt.
+	onReconnecting func()
+
+	mu           sync.Mutex
+	conn         net.Conn
+	will         *messenger.Message
+	subs         map[*v5Sub]struct{}
+	pending      map[uint16]chan *v5Packet
+	inbound      map[uint16]struct{} // QoS 2 deliveries awaiting PUBREL
+	nextID       uint16
+	closed       bool
+	reconnecting bool // a lost() loop is running
+
+	dialMu sync.Mutex // serializes Connect and reconnect dials
+	wmu    sync.Mutex // serializes writes to conn
+
+	// Largest packet the broker accepts, from CONNACK; 0 if unlimited.
+	serverMax atomic.Uint32
+
+	// Received messages awaiting their handlers, delivered in order by
+	// one goroutine at a time. Bounded by Config.InboxSize; the read
+	// loop drops messages rather than wait on a handler.
+	inMu        sync.Mutex
+	inbox       []messenger.Message
+	dispatching bool
+}
+
+// NewV5 returns an MQTT 5 client for cfg. Only tcp://, mqtt:// and, with
+// TLS, ssl://, tls:// and mqtts:// broker URLs are supported.
+func NewV5(cfg Config) *V5 {
+	id := cfg.ClientID
+	if id == "" {
+		id = "otto-" + randSuffix()
+	}
+	return &V5{
+		cfg:       cfg,
+		id:        id,
+		keepAlive: 30 * time.Second,
+		subs:      map[*v5Sub]struct{}{},
+		pending:   map[uint16]chan *v5Packet{},
+		inbound:   map[uint16]struct{}{},
+	}
+}
+
+var _ messenger.MQTT = (*V5)(nil)
+var _ messenger.MessagePublisher = (*V5)(nil)
+
+// SetOnConnect registers fn to run after every successful (re)connect.
+func (c *V5) SetOnConnect(fn func()) {
+	c.onConnect = fn
+}
+
+// SetOnReconnecting registers fn to run before each automatic reconnect
+// attempt. A will set from fn is sent with that attempt.
+func (c *V5) SetOnReconnecting(fn func()) {
+	c.onReconnecting = fn
+}
+
+// SetWill sets the will sent with the next CONNECT.
+func (c *V5) SetWill(topic string, payload []byte, retain bool, qos byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.will = &messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos}
+	return nil
+}
+
+// Connect dials the broker and performs the MQTT 5 handshake, waiting
+// at most Config.ConnectTimeout. After a successful connect the client
+// reconnects automatically until Disconnect is called. Connect returns
+// nil without dialing if the client is already connected.
+func (c *V5) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = false
+	c.mu.Unlock()
+
+	dialed, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	if dialed && c.onConnect != nil {
+		c.onConnect()
+	}
+	return nil
+}
+
+// dial connects unless a connection is already up, reporting whether
+// it made a new one. Dials are serialized, so a Connect racing a
+// reconnect loop cannot open a second connection.
+func (c *V5) dial(ctx context.Context) (bool, error) {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+
+	c.mu.Lock()
+	up := c.conn != nil
+	c.mu.Unlock()
+	if up {
+		return false, nil
+	}
+
+	addr, err := brokerAddr(c.cfg.Broker)
+	if err != nil {
+		return false, err
+	}
+	cfg, tlsCfg, err := c.cfg.resolve()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, orDefault(c.cfg.ConnectTimeout, defaultConnectTimeout))
+	defer cancel()
+
+	var conn net.Conn
+	if tlsCfg != nil {
+		d := tls.Dialer{Config: tlsCfg}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	c.mu.Lock()
+	will := c.will
+	c.mu.Unlock()
+
+	cp := &v5Packet{
+		Type:       v5Connect,
+		ClientID:   c.id,
+		Username:   cfg.Username,
+		KeepAlive:  uint16(c.keepAlive / time.Second),
+		CleanStart: c.cfg.CleanSession,
+		Will:       will,
+	}
+	cp.Props.MaxPacketSize = c.maxPacketSize()
+	if cfg.Password != "" {
+		cp.Password = []byte(cfg.Password)
+	}
+	if _, err := conn.Write(cp.encode()); err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	br := bufio.NewReader(conn)
+	ack, err := readV5Packet(br, c.maxPacketSize())
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	if ack.Type != v5Connack {
+		conn.Close()
+		return false, errMalformed
+	}
+	if ack.Reason >= 0x80 {
+		conn.Close()
+		return false, &ReasonCodeError{Op: "connect", Code: ack.Reason, Reason: ack.Props.ReasonString}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	keepAlive := c.keepAlive
+	if ack.Props.ServerKeepAlive > 0 {
+		keepAlive = time.Duration(ack.Props.ServerKeepAlive) * time.Second
+	}
+	c.serverMax.Store(ack.Props.MaxPacketSize)
+
+	c.mu.Lock()
+	if c.closed {
+		// Disconnect was called while dialing.
+		c.mu.Unlock()
+		conn.Close()
+		return false, errNotConnected
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	slog.Info("MQTT connected", "protocol", 5)
+
+	done := make(chan struct{})
+	go c.readLoop(conn, br, keepAlive, done)
+	go c.pingLoop(conn, keepAlive, done)
+	return true, nil
+}
+
+func (c *V5) maxPacketSize() uint32 {
+	if c.cfg.MaxPacketSize == 0 {
+		return defaultMaxPacketSize
+	}
+	return c.cfg.MaxPacketSize
+}
+
+func brokerAddr(broker string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", err
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+	default:
+		return "", fmt.Errorf("mqtt: unsupported broker scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return host, nil
+}
+
+// write sends p, refusing packets larger than the broker's maximum.
+func (c *V5) write(conn net.Conn, p *v5Packet) error {
+	b := p.encode()
+	if max := c.serverMax.Load(); max > 0 && uint64(len(b)) > uint64(max) {
+		return &ReasonCodeError{Op: "publish", Code: 0x95,
+			Reason: fmt.Sprintf("%d bytes exceeds the broker maximum of %d", len(b), max)}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := conn.Write(b)
+	return err
+}
+
+func (c *V5) current() (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, errNotConnected
+	}
+	return c.conn, nil
+}
+
+func (c *V5) readLoop(conn net.Conn, br *bufio.Reader, keepAlive time.Duration, done chan struct{}) {
+	var err error
+	for {
+		if keepAlive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		var p *v5Packet
+		p, err = readV5Packet(br, c.maxPacketSize())
+		if errors.Is(err, errPacketTooLarge) {
+			_ = c.write(conn, &v5Packet{Type: v5Disconnect, Reason: 0x95})
+		}
+		if err != nil {
+			break
+		}
+		c.handle(conn, p)
+		if p.Type == v5Disconnect {
+			err = &ReasonCodeError{Op: "connection", Code: p.Reason, Reason: p.Props.ReasonString}
+			break
+		}
+	}
+	close(done)
+	c.lost(conn, err)
+}
+
+func (c *V5) handle(conn net.Conn, p *v5Packet) {
+	switch p.Type {
+	case v5Publish:
+		switch p.QoS {
+		case 0:
+			c.deliver(p.message())
+		case 1:
+			c.deliver(p.message())
+			_ = c.write(conn, &v5Packet{Type: v5Puback, PacketID: p.PacketID})
+		case 2:
+			c.mu.Lock()
+			_, seen := c.inbound[p.PacketID]
+			c.inbound[p.PacketID] = struct{}{}
+			c.mu.Unlock()
+			if !seen {
+				c.deliver(p.message())
+			}
+			_ = c.write(conn, &v5Packet{Type: v5Pubrec, PacketID: p.PacketID})
+		}
+
+	case v5Pubrel:
+		c.mu.Lock()
+		delete(c.inbound, p.PacketID)
+		c.mu.Unlock()
+		_ = c.write(conn, &v5Packet{Type: v5Pubcomp, PacketID: p.PacketID})
+
+	case v5Puback, v5Pubrec, v5Pubcomp, v5Suback, v5Unsuback:
+		c.mu.Lock()
+		ch, ok := c.pending[p.PacketID]
+		if ok && p.Type != v5Pubrec {
+			delete(c.pending, p.PacketID)
+		}
+		c.mu.Unlock()
+		if ok {
+			ch <- p
+		}
+	}
+}
+
+// deliver queues m for its handlers and starts a dispatcher if none is
+// running. It never blocks, so the read loop keeps reading acks; when
+// the inbox is full m is dropped.
+func (c *V5) deliver(m messenger.Message) {
+	size := c.cfg.InboxSize
+	if size <= 0 {
+		size = defaultInboxSize
+	}
+
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	if len(c.inbox) >= size {
+		slog.Warn("MQTT inbox full, dropping message", "topic", m.Topic, "size", size)
+		return
+	}
+	c.inbox = append(c.inbox, m)
+	if !c.dispatching {
+		c.dispatching = true
+		go c.dispatch()
+	}
+}
+
+// dispatch runs handlers off the read goroutine so they may publish
+// with QoS > 0 without deadlocking on their own acks. It returns when
+// the inbox is empty.
+func (c *V5) dispatch() {
+	for {
+		c.inMu.Lock()
+		if len(c.inbox) == 0 {
+			c.dispatching = false
+			c.inMu.Unlock()
+			return
+		}
+		m := c.inbox[0]
+		c.inbox[0] = messenger.Message{}
+		c.inbox = c.inbox[1:]
+		c.inMu.Unlock()
+
+		c.mu.Lock()
+		var handlers []func(messenger.Message)
+		for s := range c.subs {
+			if messenger.MatchTopic(s.filter, m.Topic) {
+				handlers = append(handlers, s.handler)
+			}
+		}
+		c.mu.Unlock()
+		for _, h := range handlers {
+			h(m)
+		}
+	}
+}
+
+func (c *V5) pingLoop(conn net.Conn, keepAlive time.Duration, done chan struct{}) {
+	if keepAlive <= 0 {
+		return
+	}
+	t := time.NewTicker(keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.write(conn, &v5Packet{Type: v5Pingreq}); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// lost tears down a dead connection and reconnects unless closed. Only
+// the loss of the current connection starts a reconnect loop, and only
+// one loop runs at a time; it stops once any dial, including Connect,
+// has brought the connection back.
+func (c *V5) lost(conn net.Conn, err error) {
+	_ = conn.Close()
+
+	c.mu.Lock()
+	current := c.conn == conn
+	if current {
+		c.conn = nil
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}
+	start := current && !c.closed && !c.reconnecting
+	if start {
+		c.reconnecting = true
+	}
+	c.mu.Unlock()
+
+	if !start {
+		return
+	}
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+	}()
+	slog.Info("MQTT disconnected", "error", err)
+	c.cfg.metrics().ConnectionsLost.Inc()
+
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		c.mu.Lock()
+		stop := c.closed || c.conn != nil
+		c.mu.Unlock()
+		if stop {
+			return
+		}
+		if c.onReconnecting != nil {
+			c.onReconnecting()
+		}
+		dialed, err := c.dial(context.Background())
+		if err != nil {
+			slog.Warn("MQTT reconnect failed", "error", err)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		if !dialed {
+			return
+		}
+		c.cfg.metrics().Reconnects.Inc()
+		if c.onConnect != nil {
+			c.onConnect()
+		}
+		return
+	}
+}
+
+// request sends p with a fresh packet id and returns the channel its
+// acknowledgements are delivered on.
+func (c *V5) request(p *v5Packet) (net.Conn, chan *v5Packet, error) {
+	conn, err := c.current()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *v5Packet, 2)
+	c.mu.Lock()
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		if _, used := c.pending[c.nextID]; !used {
+			break
+		}
+	}
+	p.PacketID = c.nextID
+	c.pending[p.PacketID] = ch
+	c.mu.Unlock()
+
+	if err := c.write(conn, p); err != nil {
+		c.forget(p.PacketID)
+		return nil, nil, err
+	}
+	return conn, ch, nil
+}
+
+func (c *V5) forget(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *V5) await(ctx context.Context, id uint16, ch chan *v5Packet, timeout time.Duration) (*v5Packet, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case p, ok := <-ch:
+		if !ok {
+			return nil, errNotConnected
+		}
+		return p, nil
+	case <-t.C:
+		c.forget(id)
+		return nil, errors.New("mqtt ack timeout")
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// Publish publishes payload without properties.
+func (c *V5) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return c.PublishMessage(ctx, messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+}
+
+// PublishMessage publishes m including its MQTT 5 properties. For QoS 1
+// and 2 it waits for the broker's acknowledgement until ctx ends or
+// Config.PublishTimeout passes.
+func (c *V5) PublishMessage(ctx context.Context, m messenger.Message) error {
+	p := &v5Packet{Type: v5Publish, Topic: m.Topic, Payload: m.Payload, Retain: m.Retain, QoS: m.QoS}
+	if m.Properties != nil {
+		p.Props.Properties = *m.Properties
+	}
+
+	if m.QoS == 0 {
+		conn, err := c.current()
+		if err != nil {
+			return err
+		}
+		return c.write(conn, p)
+	}
+
+	conn, ch, err := c.request(p)
+	if err != nil {
+		return err
+	}
+	ack, err := c.await(ctx, p.PacketID, ch, orDefault(c.cfg.PublishTimeout, defaultPublishTimeout))
+	if err != nil {
+		return err
+	}
+	if ack.Reason >= 0x80 {
+		c.forget(p.PacketID)
+		return &ReasonCodeError{Op: "publish", Code: ack.Reason, Reason: ack.Props.ReasonString}
+	}
+	if ack.Type != v5Pubrec {
+		return nil
+	}
+
+	// QoS 2: release and wait for completion.
+	if err := c.write(conn, &v5Packet{Type: v5Pubrel, PacketID: p.PacketID}); err != nil {
+		c.forget(p.PacketID)
+		return err
+	}
+	comp, err := c.await(ctx, p.PacketID, ch, orDefault(c.cfg.PublishTimeout, defaultPublishTimeout))
+	if err != nil {
+		return err
+	}
+	if comp.Reason >= 0x80 {
+		return &ReasonCodeError{Op: "publish", Code: comp.Reason, Reason: comp.Props.ReasonString}
+	}
+	return nil
+}
+
+// Subscribe subscribes to topic and routes matching messages to handler.
+// It waits for the broker's acknowledgement until ctx ends or
+// Config.SubscribeTimeout passes. A refused subscription returns a
+// *ReasonCodeError. Several subscriptions may share a filter; the
+// returned unsubscribe removes only its own and tells the broker once
+// none is left.
+func (c *V5) Subscribe(ctx context.Context, topic string, qos byte, handler func(messenger.Message)) (func() error, error) {
+	timeout := orDefault(c.cfg.SubscribeTimeout, defaultSubscribeTimeout)
+	sub := &v5Sub{filter: topic, qos: qos, handler: handler}
+	c.mu.Lock()
+	c.subs[sub] = struct{}{}
+	c.mu.Unlock()
+
+	// drop removes sub and reports whether another subscription still
+	// uses its filter.
+	drop := func() (shared bool) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs, sub)
+		for s := range c.subs {
+			if s.filter == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	p := &v5Packet{Type: v5Subscribe, Filters: []string{topic}, SubQoS: []byte{qos}}
+	_, ch, err := c.request(p)
+	if err != nil {
+		drop()
+		return nil, err
+	}
+	ack, err := c.await(ctx, p.PacketID, ch, timeout)
+	if err != nil {
+		drop()
+		return nil, err
+	}
+	if len(ack.Reasons) == 0 {
+		drop()
+		return nil, errMalformed
+	}
+	if code := ack.Reasons[0]; code >= 0x80 {
+		drop()
+		return nil, &ReasonCodeError{Op: "subscribe", Code: code, Reason: ack.Props.ReasonString}
+	}
+
+	return func() error {
+		if drop() {
+			return nil
+		}
+		p := &v5Packet{Type: v5Unsubscribe, Filters: []string{topic}}
+		_, ch, err := c.request(p)
+		if err != nil {
+			return err
+		}
+		ack, err := c.await(context.Background(), p.PacketID, ch, timeout)
+		if err != nil {
+			return err
+		}
+		if len(ack.Reasons) > 0 && ack.Reasons[0] >= 0x80 {
+			return &ReasonCodeError{Op: "unsubscribe", Code: ack.Reasons[0], Reason: ack.Props.ReasonString}
+		}
+		return nil
+	}, nil
+}
+
+// Disconnect sends DISCONNECT and closes the connection. The will is
+// not published and no reconnect is attempted.
+func (c *V5) Disconnect(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(dl)
+	}
+	err := c.write(conn, &v5Packet{Type: v5Disconnect})
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
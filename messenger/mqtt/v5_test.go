@@ -0,0 +1,449 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v5Server is a minimal single-client MQTT 5 broker for tests. It echoes
+// publishes back to matching subscriptions and refuses filters under
+// "denied/".
+type v5Server struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	connect    *v5Packet
+	connects   int
+	conns      []net.Conn
+	subs       map[string]byte
+	disconnect bool
+	maxPacket  uint32 // Maximum Packet Size sent in CONNACK
+}
+
+// drop closes every client connection from the server side.
+func (s *v5Server) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *v5Server) connectCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects
+}
+
+func startV5Server(t *testing.T) *v5Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &v5Server{ln: ln, subs: map[string]byte{}}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *v5Server) url() string { return "tcp://" + s.ln.Addr().String() }
+
+func (s *v5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	send := func(p *v5Packet) { _, _ = conn.Write(p.encode()) }
+
+	for {
+		p, err := readV5Packet(br, 0)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case v5Connect:
+			s.mu.Lock()
+			s.connect = p
+			s.connects++
+			s.conns = append(s.conns, conn)
+			ack := &v5Packet{Type: v5Connack}
+			ack.Props.MaxPacketSize = s.maxPacket
+			s.mu.Unlock()
+			send(ack)
+		case v5Subscribe:
+			codes := make([]byte, len(p.Filters))
+			s.mu.Lock()
+			for i, f := range p.Filters {
+				if messenger.MatchTopic("denied/#", f) {
+					codes[i] = 0x87
+					continue
+				}
+				s.subs[f] = p.SubQoS[i]
+				codes[i] = p.SubQoS[i]
+			}
+			s.mu.Unlock()
+			ack := &v5Packet{Type: v5Suback, PacketID: p.PacketID, Reasons: codes}
+			if codes[0] >= 0x80 {
+				ack.Props.ReasonString = "acl"
+			}
+			send(ack)
+		case v5Unsubscribe:
+			s.mu.Lock()
+			for _, f := range p.Filters {
+				delete(s.subs, f)
+			}
+			s.mu.Unlock()
+			send(&v5Packet{Type: v5Unsuback, PacketID: p.PacketID, Reasons: []byte{0}})
+		case v5Publish:
+			switch p.QoS {
+			case 1:
+				send(&v5Packet{Type: v5Puback, PacketID: p.PacketID})
+			case 2:
+				send(&v5Packet{Type: v5Pubrec, PacketID: p.PacketID})
+			}
+			s.mu.Lock()
+			matched := false
+			for f := range s.subs {
+				matched = matched || messenger.MatchTopic(f, p.Topic)
+			}
+			s.mu.Unlock()
+			if matched {
+				out := *p
+				out.QoS, out.PacketID = 0, 0
+				send(&out)
+			}
+		case v5Pubrel:
+			send(&v5Packet{Type: v5Pubcomp, PacketID: p.PacketID})
+		case v5Pingreq:
+			send(&v5Packet{Type: v5Pingresp})
+		case v5Disconnect:
+			s.mu.Lock()
+			s.disconnect = true
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func connectV5(t *testing.T, s *v5Server, configure func(*V5)) *V5 {
+	t.Helper()
+
+	c := NewV5(Config{Broker: s.url(), ClientID: "v5-test", Username: "user", Password: "pass", CleanSession: true})
+	if configure != nil {
+		configure(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, c.Connect(ctx))
+	t.Cleanup(func() { _ = c.Disconnect(context.Background()) })
+	return c
+}
+
+func TestV5ConnectSendsCredentialsAndWill(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	connectV5(t, s, func(c *V5) {
+		require.NoError(t, c.SetWill("otto/devices/lamp/status", []byte("offline"), true, 1))
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.NotNil(t, s.connect)
+	assert.Equal(t, "v5-test", s.connect.ClientID)
+	assert.Equal(t, "user", s.connect.Username)
+	assert.Equal(t, []byte("pass"), s.connect.Password)
+	assert.True(t, s.connect.CleanStart)
+	require.NotNil(t, s.connect.Will)
+	assert.Equal(t, "otto/devices/lamp/status", s.connect.Will.Topic)
+	assert.True(t, s.connect.Will.Retain)
+	assert.Equal(t, byte(1), s.connect.Will.QoS)
+}
+
+func TestV5PublishPropertiesRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	got := make(chan messenger.Message, 1)
+	_, err := c.Subscribe(ctx, "otto/devices/+/state", 1, func(m messenger.Message) { got <- m })
+	require.NoError(t, err)
+
+	props := &messenger.Properties{
+		ContentType:     "application/json",
+		ResponseTopic:   "otto/reply/1",
+		CorrelationData: []byte{1, 2, 3},
+		MessageExpiry:   30 * time.Second,
+		UserProperties:  []messenger.UserProperty{{Key: "station", Value: "garden"}, {Key: "station", Value: "shed"}},
+	}
+	for _, qos := range []byte{0, 1, 2} {
+		require.NoError(t, messenger.PublishMessage(ctx, c, messenger.Message{
+			Topic: "otto/devices/lamp/state", Payload: []byte("true"), QoS: qos, Properties: props,
+		}))
+
+		select {
+		case m := <-got:
+			assert.Equal(t, "otto/devices/lamp/state", m.Topic)
+			assert.Equal(t, []byte("true"), m.Payload)
+			assert.Equal(t, props, m.Properties)
+		case <-ctx.Done():
+			require.Fail(t, "message not received", "qos %d", qos)
+		}
+	}
+}
+
+func TestV5HandlerPublishDuringBurst(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	// The first delivery publishes at QoS 1, whose ack arrives behind a
+	// burst of deliveries; the reader must get through them to it.
+	const burst = 500
+	replied := make(chan error, 1)
+	got := make(chan struct{}, burst)
+	var once sync.Once
+	_, err := c.Subscribe(ctx, "in/#", 0, func(messenger.Message) {
+		once.Do(func() { replied <- c.Publish(ctx, "out/reply", []byte("ok"), false, 1) })
+		got <- struct{}{}
+	})
+	require.NoError(t, err)
+
+	for range burst {
+		require.NoError(t, c.Publish(ctx, "in/x", []byte("1"), false, 0))
+	}
+	select {
+	case err := <-replied:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		require.Fail(t, "handler publish deadlocked")
+	}
+	for range burst {
+		select {
+		case <-got:
+		case <-ctx.Done():
+			require.Fail(t, "deliveries lost")
+		}
+	}
+}
+
+func TestV5SubscribeReasonCode(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	_, err := c.Subscribe(context.Background(), "denied/topic", 1, func(messenger.Message) {})
+	var rce *ReasonCodeError
+	require.True(t, errors.As(err, &rce))
+	assert.Equal(t, byte(0x87), rce.Code)
+	assert.Equal(t, "acl", rce.Reason)
+	assert.Contains(t, err.Error(), "not authorized")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Empty(t, c.subs)
+}
+
+func TestV5Unsubscribe(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	unsub, err := c.Subscribe(context.Background(), "a/b", 0, func(messenger.Message) {})
+	require.NoError(t, err)
+	require.NoError(t, unsub())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Empty(t, s.subs)
+}
+
+func TestV5Disconnect(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+	require.NoError(t, c.Disconnect(context.Background()))
+
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.disconnect
+	}, time.Second, 10*time.Millisecond)
+
+	err := c.Publish(context.Background(), "a", nil, false, 0)
+	assert.ErrorIs(t, err, errNotConnected)
+}
+
+func TestV5SharedFilterUnsubscribe(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	first, err := c.Subscribe(ctx, "a/+", 0, func(messenger.Message) {})
+	require.NoError(t, err)
+	got := make(chan messenger.Message, 1)
+	second, err := c.Subscribe(ctx, "a/+", 0, func(m messenger.Message) { got <- m })
+	require.NoError(t, err)
+
+	// Dropping the first keeps the second, and the broker subscription.
+	require.NoError(t, first())
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("1"), false, 0))
+	select {
+	case m := <-got:
+		assert.Equal(t, "a/b", m.Topic)
+	case <-ctx.Done():
+		require.Fail(t, "second subscription lost")
+	}
+	s.mu.Lock()
+	assert.Contains(t, s.subs, "a/+")
+	s.mu.Unlock()
+
+	require.NoError(t, second())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Empty(t, s.subs)
+}
+
+func TestV5MaxPacketSize(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	s.maxPacket = 64
+	c := connectV5(t, s, func(c *V5) { c.cfg.MaxPacketSize = 4096 })
+
+	s.mu.Lock()
+	assert.Equal(t, uint32(4096), s.connect.Props.MaxPacketSize)
+	s.mu.Unlock()
+
+	require.NoError(t, c.Publish(context.Background(), "a", []byte("small"), false, 1))
+	err := c.Publish(context.Background(), "a", make([]byte, 100), false, 1)
+	var rce *ReasonCodeError
+	require.True(t, errors.As(err, &rce))
+	assert.Equal(t, byte(0x95), rce.Code)
+
+	// Incoming packets over the limit are refused before their body is
+	// read.
+	big := (&v5Packet{Type: v5Publish, Topic: "a", Payload: make([]byte, 100)}).encode()
+	_, err = readV5Packet(bufio.NewReader(bytes.NewReader(big)), 64)
+	assert.ErrorIs(t, err, errPacketTooLarge)
+	p, err := readV5Packet(bufio.NewReader(bytes.NewReader(big)), uint32(len(big)))
+	require.NoError(t, err)
+	assert.Len(t, p.Payload, 100)
+}
+
+func TestV5InboxBounded(t *testing.T) {
+	t.Parallel()
+
+	c := NewV5(Config{InboxSize: 2})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	got := make(chan string, 10)
+	c.subs[&v5Sub{filter: "#", handler: func(m messenger.Message) {
+		if m.Topic == "1" {
+			close(started)
+			<-release
+		}
+		got <- m.Topic
+	}}] = struct{}{}
+
+	c.deliver(messenger.Message{Topic: "1"})
+	<-started
+	for _, topic := range []string{"2", "3", "4", "5"} {
+		c.deliver(messenger.Message{Topic: topic})
+	}
+	close(release)
+
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case topic := <-got:
+			assert.Equal(t, want, topic)
+		case <-time.After(time.Second):
+			require.Fail(t, "message not delivered", want)
+		}
+	}
+	select {
+	case topic := <-got:
+		assert.Fail(t, "message beyond the inbox delivered", topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestV5ConnectDuringReconnect(t *testing.T) {
+	t.Parallel()
+
+	s := startV5Server(t)
+	c := connectV5(t, s, nil)
+
+	// Connect while connected does not dial again.
+	require.NoError(t, c.Connect(context.Background()))
+	assert.Equal(t, 1, s.connectCount())
+
+	// A Connect that beats the reconnect loop leaves it nothing to do.
+	s.drop()
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.conn == nil
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, c.Connect(context.Background()))
+	assert.Equal(t, 2, s.connectCount())
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 2, s.connectCount())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.False(t, c.reconnecting)
+}
+
+func TestV5RejectsUnsupportedScheme(t *testing.T) {
+	t.Parallel()
+
+	c := NewV5(Config{Broker: "ssl://example:8883"})
+	require.Error(t, c.Connect(context.Background()))
+}
+
+func TestV5PacketDecodeSkipsUnknownProperties(t *testing.T) {
+	t.Parallel()
+
+	// CONNACK with Maximum QoS (0x24) and Topic Alias Maximum (0x22).
+	body := []byte{0x00, 0x00, 0x05, 0x24, 0x01, 0x22, 0x00, 0x0a}
+	p, err := decodeV5(v5Connack, 0, body)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), p.Reason)
+
+	_, err = decodeV5(v5Connack, 0, []byte{0x00, 0x00, 0x02, 0x7f, 0x00})
+	assert.Error(t, err)
+}
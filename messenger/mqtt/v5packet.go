@@ -0,0 +1,559 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// MQTT 5 control packet types.
+const (
+	v5Connect     byte = 1
+	v5Connack     byte = 2
+	v5Publish     byte = 3
+	v5Puback      byte = 4
+	v5Pubrec      byte = 5
+	v5Pubrel      byte = 6
+	v5Pubcomp     byte = 7
+	v5Subscribe   byte = 8
+	v5Suback      byte = 9
+	v5Unsubscribe byte = 10
+	v5Unsuback    byte = 11
+	v5Pingreq     byte = 12
+	v5Pingresp    byte = 13
+	v5Disconnect  byte = 14
+	v5Auth        byte = 15
+)
+
+// MQTT 5 property identifiers used by the adapter.
+const (
+	propMessageExpiry    byte = 0x02
+	propContentType      byte = 0x03
+	propResponseTopic    byte = 0x08
+	propCorrelationData  byte = 0x09
+	propSessionExpiry    byte = 0x11
+	propAssignedClientID byte = 0x12
+	propServerKeepAlive  byte = 0x13
+	propReasonString     byte = 0x1F
+	propTopicAlias       byte = 0x23
+	propUserProperty     byte = 0x26
+	propMaxPacketSize    byte = 0x27
+)
+
+// propKinds gives the wire encoding of every MQTT 5 property so unknown
+// ones can be skipped.
+var propKinds = map[byte]byte{
+	0x01: 'b', 0x02: '4', 0x03: 's', 0x08: 's', 0x09: 'd', 0x0B: 'v',
+	0x11: '4', 0x12: 's', 0x13: '2', 0x15: 's', 0x16: 'd', 0x17: 'b',
+	0x18: '4', 0x19: 'b', 0x1A: 's', 0x1C: 's', 0x1F: 's', 0x21: '2',
+	0x22: '2', 0x23: '2', 0x24: 'b', 0x25: 'b', 0x26: 'p', 0x27: '4',
+	0x28: 'b', 0x29: 'b', 0x2A: 'b',
+}
+
+var (
+	errMalformed      = errors.New("mqtt: malformed packet")
+	errPacketTooLarge = errors.New("mqtt: packet too large")
+)
+
+// v5Props holds the properties the adapter reads or writes.
+type v5Props struct {
+	messenger.Properties
+	SessionExpiry    uint32
+	AssignedClientID string
+	ServerKeepAlive  uint16
+	ReasonString     string
+	TopicAlias       uint16
+	MaxPacketSize    uint32
+}
+
+// v5Packet is one decoded control packet. Fields not used by a packet
+// type are left zero.
+type v5Packet struct {
+	Type  byte
+	Flags byte
+
+	// CONNECT
+	ClientID   string
+	Username   string
+	Password   []byte
+	KeepAlive  uint16
+	CleanStart bool
+	Will       *messenger.Message
+
+	// PUBLISH
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Dup     bool
+
+	PacketID uint16
+	Reason   byte   // CONNACK, PUBACK family, DISCONNECT
+	Reasons  []byte // SUBACK, UNSUBACK
+	Filters  []string
+	SubQoS   []byte // SUBSCRIBE options (QoS bits)
+	Session  bool   // CONNACK session present
+	Props    v5Props
+}
+
+// message converts a PUBLISH packet to a messenger.Message.
+func (p *v5Packet) message() messenger.Message {
+	m := messenger.Message{Topic: p.Topic, Payload: p.Payload, Retain: p.Retain, QoS: p.QoS}
+	if !emptyProps(p.Props.Properties) {
+		props := p.Props.Properties
+		m.Properties = &props
+	}
+	return m
+}
+
+func emptyProps(p messenger.Properties) bool {
+	return p.ContentType == "" && p.ResponseTopic == "" && p.CorrelationData == nil &&
+		p.MessageExpiry == 0 && len(p.UserProperties) == 0
+}
+
+// ---- encoding ----
+
+type v5Writer struct{ bytes.Buffer }
+
+func (w *v5Writer) u8(b byte)    { w.WriteByte(b) }
+func (w *v5Writer) u16(n uint16) { _ = binary.Write(w, binary.BigEndian, n) }
+func (w *v5Writer) u32(n uint32) { _ = binary.Write(w, binary.BigEndian, n) }
+func (w *v5Writer) str(s string) { w.u16(uint16(len(s))); w.WriteString(s) }
+func (w *v5Writer) bin(b []byte) { w.u16(uint16(len(b))); w.Write(b) }
+func (w *v5Writer) varint(n int) { w.Write(appendVarint(nil, n)) }
+func (w *v5Writer) props(p v5Props) {
+	var pw v5Writer
+	if p.MessageExpiry > 0 {
+		pw.u8(propMessageExpiry)
+		pw.u32(uint32(p.MessageExpiry / time.Second))
+	}
+	if p.ContentType != "" {
+		pw.u8(propContentType)
+		pw.str(p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		pw.u8(propResponseTopic)
+		pw.str(p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		pw.u8(propCorrelationData)
+		pw.bin(p.CorrelationData)
+	}
+	if p.SessionExpiry > 0 {
+		pw.u8(propSessionExpiry)
+		pw.u32(p.SessionExpiry)
+	}
+	if p.AssignedClientID != "" {
+		pw.u8(propAssignedClientID)
+		pw.str(p.AssignedClientID)
+	}
+	if p.ServerKeepAlive > 0 {
+		pw.u8(propServerKeepAlive)
+		pw.u16(p.ServerKeepAlive)
+	}
+	if p.ReasonString != "" {
+		pw.u8(propReasonString)
+		pw.str(p.ReasonString)
+	}
+	if p.MaxPacketSize > 0 {
+		pw.u8(propMaxPacketSize)
+		pw.u32(p.MaxPacketSize)
+	}
+	for _, up := range p.UserProperties {
+		pw.u8(propUserProperty)
+		pw.str(up.Key)
+		pw.str(up.Value)
+	}
+	w.varint(pw.Len())
+	w.Write(pw.Bytes())
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// encode returns the wire form of p.
+func (p *v5Packet) encode() []byte {
+	var w v5Writer
+	flags := p.Flags
+
+	switch p.Type {
+	case v5Connect:
+		w.str("MQTT")
+		w.u8(5)
+		var cf byte
+		if p.CleanStart {
+			cf |= 0x02
+		}
+		if p.Will != nil {
+			cf |= 0x04 | p.Will.QoS<<3
+			if p.Will.Retain {
+				cf |= 0x20
+			}
+		}
+		if p.Password != nil {
+			cf |= 0x40
+		}
+		if p.Username != "" {
+			cf |= 0x80
+		}
+		w.u8(cf)
+		w.u16(p.KeepAlive)
+		w.props(p.Props)
+		w.str(p.ClientID)
+		if p.Will != nil {
+			var wp v5Props
+			if p.Will.Properties != nil {
+				wp.Properties = *p.Will.Properties
+			}
+			w.props(wp)
+			w.str(p.Will.Topic)
+			w.bin(p.Will.Payload)
+		}
+		if p.Username != "" {
+			w.str(p.Username)
+		}
+		if p.Password != nil {
+			w.bin(p.Password)
+		}
+
+	case v5Connack:
+		if p.Session {
+			w.u8(1)
+		} else {
+			w.u8(0)
+		}
+		w.u8(p.Reason)
+		w.props(p.Props)
+
+	case v5Publish:
+		flags = p.QoS << 1
+		if p.Retain {
+			flags |= 0x01
+		}
+		if p.Dup {
+			flags |= 0x08
+		}
+		w.str(p.Topic)
+		if p.QoS > 0 {
+			w.u16(p.PacketID)
+		}
+		w.props(p.Props)
+		w.Write(p.Payload)
+
+	case v5Puback, v5Pubrec, v5Pubrel, v5Pubcomp:
+		if p.Type == v5Pubrel {
+			flags = 0x02
+		}
+		w.u16(p.PacketID)
+		if p.Reason != 0 || p.Props.ReasonString != "" {
+			w.u8(p.Reason)
+			w.props(p.Props)
+		}
+
+	case v5Subscribe:
+		flags = 0x02
+		w.u16(p.PacketID)
+		w.props(p.Props)
+		for i, f := range p.Filters {
+			w.str(f)
+			w.u8(p.SubQoS[i] & 0x03)
+		}
+
+	case v5Suback, v5Unsuback:
+		w.u16(p.PacketID)
+		w.props(p.Props)
+		w.Write(p.Reasons)
+
+	case v5Unsubscribe:
+		flags = 0x02
+		w.u16(p.PacketID)
+		w.props(p.Props)
+		for _, f := range p.Filters {
+			w.str(f)
+		}
+
+	case v5Disconnect:
+		if p.Reason != 0 || p.Props.ReasonString != "" {
+			w.u8(p.Reason)
+			w.props(p.Props)
+		}
+	}
+
+	out := []byte{p.Type<<4 | flags}
+	out = appendVarint(out, w.Len())
+	return append(out, w.Bytes()...)
+}
+
+// ---- decoding ----
+
+type v5Reader struct {
+	b   []byte
+	err error
+}
+
+func (r *v5Reader) take(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errMalformed
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *v5Reader) u8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *v5Reader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *v5Reader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *v5Reader) bin() []byte {
+	n := int(r.u16())
+	if b := r.take(n); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (r *v5Reader) str() string { return string(r.bin()) }
+
+func (r *v5Reader) varint() int {
+	n, mult := 0, 1
+	for i := 0; i < 4; i++ {
+		d := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		n += int(d&0x7f) * mult
+		if d&0x80 == 0 {
+			return n
+		}
+		mult *= 128
+	}
+	r.err = errMalformed
+	return 0
+}
+
+func (r *v5Reader) props() v5Props {
+	var p v5Props
+	sub := v5Reader{b: r.take(r.varint())}
+	if r.err != nil {
+		return p
+	}
+	for len(sub.b) > 0 && sub.err == nil {
+		id := sub.u8()
+		switch id {
+		case propMessageExpiry:
+			p.MessageExpiry = time.Duration(sub.u32()) * time.Second
+		case propContentType:
+			p.ContentType = sub.str()
+		case propResponseTopic:
+			p.ResponseTopic = sub.str()
+		case propCorrelationData:
+			p.CorrelationData = sub.bin()
+		case propSessionExpiry:
+			p.SessionExpiry = sub.u32()
+		case propAssignedClientID:
+			p.AssignedClientID = sub.str()
+		case propServerKeepAlive:
+			p.ServerKeepAlive = sub.u16()
+		case propReasonString:
+			p.ReasonString = sub.str()
+		case propTopicAlias:
+			p.TopicAlias = sub.u16()
+		case propMaxPacketSize:
+			p.MaxPacketSize = sub.u32()
+		case propUserProperty:
+			k := sub.str()
+			p.UserProperties = append(p.UserProperties, messenger.UserProperty{Key: k, Value: sub.str()})
+		default:
+			switch propKinds[id] {
+			case 'b':
+				sub.take(1)
+			case '2':
+				sub.take(2)
+			case '4':
+				sub.take(4)
+			case 'v':
+				sub.varint()
+			case 's', 'd':
+				sub.bin()
+			case 'p':
+				sub.bin()
+				sub.bin()
+			default:
+				sub.err = fmt.Errorf("mqtt: unknown property 0x%02x", id)
+			}
+		}
+	}
+	if sub.err != nil {
+		r.err = sub.err
+	}
+	return p
+}
+
+// readV5Packet reads and decodes one control packet. A packet longer
+// than max bytes, when max is above zero, returns errPacketTooLarge
+// without reading its body.
+func readV5Packet(br *bufio.Reader, max uint32) (*v5Packet, error) {
+	h, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformed
+		}
+		d, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n += int(d&0x7f) * mult
+		if d&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	// Fixed header: type byte, then the varint length just read.
+	if size := 1 + len(appendVarint(nil, n)) + n; max > 0 && uint64(size) > uint64(max) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", errPacketTooLarge, size, max)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	return decodeV5(h>>4, h&0x0f, body)
+}
+
+func decodeV5(typ, flags byte, body []byte) (*v5Packet, error) {
+	p := &v5Packet{Type: typ, Flags: flags}
+	r := &v5Reader{b: body}
+
+	switch typ {
+	case v5Connect:
+		if r.str() != "MQTT" || r.u8() != 5 {
+			return nil, errMalformed
+		}
+		cf := r.u8()
+		p.CleanStart = cf&0x02 != 0
+		p.KeepAlive = r.u16()
+		p.Props = r.props()
+		p.ClientID = r.str()
+		if cf&0x04 != 0 {
+			wp := r.props()
+			will := &messenger.Message{Topic: r.str(), Payload: r.bin(), QoS: (cf >> 3) & 0x03, Retain: cf&0x20 != 0}
+			if !emptyProps(wp.Properties) {
+				will.Properties = &wp.Properties
+			}
+			p.Will = will
+		}
+		if cf&0x80 != 0 {
+			p.Username = r.str()
+		}
+		if cf&0x40 != 0 {
+			p.Password = r.bin()
+		}
+
+	case v5Connack:
+		p.Session = r.u8()&0x01 != 0
+		p.Reason = r.u8()
+		if len(r.b) > 0 {
+			p.Props = r.props()
+		}
+
+	case v5Publish:
+		p.QoS = (flags >> 1) & 0x03
+		p.Retain = flags&0x01 != 0
+		p.Dup = flags&0x08 != 0
+		p.Topic = r.str()
+		if p.QoS > 0 {
+			p.PacketID = r.u16()
+		}
+		p.Props = r.props()
+		if r.err == nil {
+			p.Payload = append([]byte{}, r.b...)
+		}
+
+	case v5Puback, v5Pubrec, v5Pubrel, v5Pubcomp:
+		p.PacketID = r.u16()
+		if len(r.b) > 0 {
+			p.Reason = r.u8()
+		}
+		if len(r.b) > 0 {
+			p.Props = r.props()
+		}
+
+	case v5Subscribe:
+		p.PacketID = r.u16()
+		p.Props = r.props()
+		for len(r.b) > 0 && r.err == nil {
+			p.Filters = append(p.Filters, r.str())
+			p.SubQoS = append(p.SubQoS, r.u8()&0x03)
+		}
+
+	case v5Suback, v5Unsuback:
+		p.PacketID = r.u16()
+		p.Props = r.props()
+		if r.err == nil {
+			p.Reasons = append([]byte{}, r.b...)
+		}
+
+	case v5Unsubscribe:
+		p.PacketID = r.u16()
+		p.Props = r.props()
+		for len(r.b) > 0 && r.err == nil {
+			p.Filters = append(p.Filters, r.str())
+		}
+
+	case v5Disconnect, v5Auth:
+		if len(r.b) > 0 {
+			p.Reason = r.u8()
+		}
+		if len(r.b) > 0 {
+			p.Props = r.props()
+		}
+
+	case v5Pingreq, v5Pingresp:
+
+	default:
+		return nil, fmt.Errorf("mqtt: unknown packet type %d", typ)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
@@ -1,6 +1,10 @@
 package messenger
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 // Message is a decoded MQTT message delivered to a handler.
 type Message struct {
@@ -8,8 +12,37 @@ type Message struct {
 	Payload []byte
 	Retain  bool
 	QoS     byte
+
+	// Properties carries optional MQTT 5 metadata. It is nil for
+	// messages from MQTT 3.1.1 clients, which ignore it on publish.
+	Properties *Properties
+}
+
+// Properties are the optional MQTT 5 publish properties otto uses.
+type Properties struct {
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	MessageExpiry   time.Duration // zero means no expiry
+	UserProperties  []UserProperty
 }
 
+// UserProperty is one MQTT 5 user property; keys may repeat.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// ErrNotConnected is returned by clients that refuse to publish while
+// they have no connection, so wrappers such as queue.Queue keep the
+// message instead of losing it.
+var ErrNotConnected = errors.New("mqtt not connected")
+
+// ErrPublishPending reports a publish the client has taken but the
+// broker has not acknowledged in time. The client still holds it and may
+// deliver it later, so it must not be sent again.
+var ErrPublishPending = errors.New("mqtt publish not yet acknowledged")
+
 // MQTT abstracts the MQTT client operations used by the messenger.
 type MQTT interface {
 	// Publish should be safe to call from multiple goroutines.
@@ -17,3 +50,18 @@ type MQTT interface {
 	Subscribe(ctx context.Context, topic string, qos byte, handler func(Message)) (unsubscribe func() error, err error)
 	SetWill(topic string, payload []byte, retain bool, qos byte) error
 }
+
+// MessagePublisher is implemented by clients that can publish a full
+// Message, including its Properties.
+type MessagePublisher interface {
+	PublishMessage(ctx context.Context, m Message) error
+}
+
+// PublishMessage publishes m with its properties when c supports them,
+// and falls back to a plain Publish otherwise.
+func PublishMessage(ctx context.Context, c MQTT, m Message) error {
+	if mp, ok := c.(MessagePublisher); ok {
+		return mp.PublishMessage(ctx, m)
+	}
+	return c.Publish(ctx, m.Topic, m.Payload, m.Retain, m.QoS)
+}
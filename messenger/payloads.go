@@ -1,11 +1,41 @@
 package messenger
 
-import "time"
+import (
+	"encoding/json"
+	"time"
 
-// StatusPayload is the JSON body for status topics.
+	"github.com/rustyeddy/devices"
+)
+
+// Device lifecycle states published on status topics.
+const (
+	StatusStarting = "starting" // Run is being (re)started
+	StatusOnline   = "online"   // Run has kept running for RestartPolicy.Settle
+	StatusDegraded = "degraded" // Run failed and a restart is pending
+	StatusError    = "error"    // Run failed and will not be restarted
+	StatusOffline  = "offline"  // stopped, or the connection was lost
+)
+
+// StatusPayload is the JSON body for device and station status topics.
+// Station status has no Device; a device is only available while both
+// it and its station are online (see Availability).
 type StatusPayload struct {
-	Status string    `json:"status"` // "online"|"offline"
-	Time   time.Time `json:"time"`
+	Device   string    `json:"device,omitempty"`   // "" for station status
+	Station  string    `json:"station,omitempty"`  // station the device runs on
+	Status   string    `json:"status"`             // one of the Status* constants
+	Error    string    `json:"error,omitempty"`    // last Run error, if any
+	Restarts int       `json:"restarts,omitempty"` // restarts since Run began
+	Time     time.Time `json:"time"`
+}
+
+// EventPayload is the JSON body for device event topics.
+type EventPayload struct {
+	Device string            `json:"device"`
+	Kind   string            `json:"kind"`
+	Time   time.Time         `json:"time"`
+	Msg    string            `json:"msg"`
+	Meta   map[string]string `json:"meta"`
+	Err    string            `json:"err,omitempty"`
 }
 
 // MetaPayload is the JSON body for device metadata topics.
@@ -20,3 +50,44 @@ type MetaPayload struct {
 	Tags      []string          `json:"tags,omitempty"`
 	Attrs     map[string]string `json:"attrs,omitempty"`
 }
+
+// NewMetaPayload converts a device descriptor into its meta payload.
+func NewMetaPayload(desc devices.Descriptor) MetaPayload {
+	return MetaPayload{
+		Name:      desc.Name,
+		Kind:      desc.Kind,
+		ValueType: desc.ValueType,
+		Access:    string(desc.Access),
+		Unit:      desc.Unit,
+		Min:       desc.Min,
+		Max:       desc.Max,
+		Tags:      desc.Tags,
+		Attrs:     desc.Attributes,
+	}
+}
+
+// AckPayload is the JSON body for device ack topics, reporting the
+// outcome of a set command.
+type AckPayload struct {
+	ID     string          `json:"id,omitempty"`    // command id, see SetCommand
+	Status string          `json:"status"`          // one of the Ack* constants
+	Value  json.RawMessage `json:"value,omitempty"` // value delivered, when it differs from the request
+	Error  string          `json:"error,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+// RPCRequest is the JSON body for device RPC topics.
+type RPCRequest struct {
+	ID      string          `json:"id"`
+	Method  string          `json:"method"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+}
+
+// RPCResponse is the JSON body sent to an RPC request's reply topic.
+type RPCResponse struct {
+	ID     string          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Time   time.Time       `json:"time"`
+}
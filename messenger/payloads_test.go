@@ -26,6 +26,16 @@ func TestStatusPayloadJSON(t *testing.T) {
 
 	assert.Equal(t, "online", got["status"])
 	assert.Equal(t, ts.Format(time.RFC3339Nano), got["time"])
+	assert.NotContains(t, got, "error")
+	assert.NotContains(t, got, "restarts")
+
+	raw, err = json.Marshal(StatusPayload{Status: StatusDegraded, Error: "i2c: nack", Restarts: 2, Time: ts})
+	require.NoError(t, err)
+	got = nil
+	require.NoError(t, json.Unmarshal(raw, &got))
+	assert.Equal(t, "degraded", got["status"])
+	assert.Equal(t, "i2c: nack", got["error"])
+	assert.EqualValues(t, 2, got["restarts"])
 }
 
 func TestMetaPayloadJSONOmitEmpty(t *testing.T) {
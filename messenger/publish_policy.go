@@ -0,0 +1,190 @@
+package messenger
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rustyeddy/devices"
+)
+
+// Descriptor attributes that configure a device's PublishPolicy. They
+// override Registry.Publish field by field; SetPublishPolicy overrides
+// both.
+const (
+	AttrDeadband    = "publish_deadband"     // "0.5", or "2%" for DeadbandPercent
+	AttrMinInterval = "publish_min_interval" // duration, e.g. "500ms"
+	AttrMaxInterval = "publish_max_interval" // duration, e.g. "5m"
+	AttrOnChange    = "publish_on_change"    // "true" or "false"
+)
+
+// PublishPolicy decides which values WireSource publishes. The zero
+// value publishes every value.
+type PublishPolicy struct {
+	// Numeric values closer than Deadband to the last published value
+	// are not published.
+	Deadband float64
+
+	// Like Deadband, as a percentage of the descriptor's Min..Max span,
+	// or of the last published value when the device has no range.
+	DeadbandPercent float64
+
+	// Least time between publishes. A value arriving sooner is held and
+	// the latest held value is published once MinInterval has passed.
+	MinInterval time.Duration
+
+	// Heartbeat: the latest value is republished when nothing was
+	// published for MaxInterval, changed or not.
+	MaxInterval time.Duration
+
+	// Only publish values whose encoding differs from the last
+	// published one.
+	OnChange bool
+}
+
+// ParsePublishPolicy applies the publish_* attributes in attrs to p.
+func ParsePublishPolicy(p PublishPolicy, attrs map[string]string) (PublishPolicy, error) {
+	if s, ok := attrs[AttrDeadband]; ok {
+		pct := strings.HasSuffix(s, "%")
+		f, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || f < 0 {
+			return p, fmt.Errorf("%s: invalid deadband %q", AttrDeadband, s)
+		}
+		if pct {
+			p.Deadband, p.DeadbandPercent = 0, f
+		} else {
+			p.Deadband, p.DeadbandPercent = f, 0
+		}
+	}
+	for attr, d := range map[string]*time.Duration{AttrMinInterval: &p.MinInterval, AttrMaxInterval: &p.MaxInterval} {
+		s, ok := attrs[attr]
+		if !ok {
+			continue
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil || v < 0 {
+			return p, fmt.Errorf("%s: invalid duration %q", attr, s)
+		}
+		*d = v
+	}
+	if s, ok := attrs[AttrOnChange]; ok {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", AttrOnChange, err)
+		}
+		p.OnChange = v
+	}
+	return p, nil
+}
+
+// SetPublishPolicy overrides Registry.Publish and the descriptor's
+// publish_* attributes for one device. It takes effect for WireSource
+// calls made after it.
+func (r *Registry) SetPublishPolicy(name string, p PublishPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.publishPolicies[name] = p
+}
+
+// publishPolicy returns the policy WireSource applies to dev.
+func (r *Registry) publishPolicy(dev devices.Device) PublishPolicy {
+	name := dev.Name()
+	r.mu.RLock()
+	p, ok := r.publishPolicies[name]
+	if !ok {
+		p = r.Publish
+	}
+	r.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	if desc, ok := DescriptorOf(dev); ok {
+		q, err := ParsePublishPolicy(p, desc.Attributes)
+		if err != nil {
+			r.Log.Warn("publish policy ignored", "device", name, "error", err)
+			return p
+		}
+		p = q
+	}
+	return p
+}
+
+// publishGate applies a PublishPolicy to one device's values.
+type publishGate struct {
+	p    PublishPolicy
+	span float64 // descriptor Min..Max, 0 if unknown
+
+	has     bool
+	last    []byte
+	lastNum float64
+	lastAt  time.Time
+}
+
+func newPublishGate(p PublishPolicy, dev devices.Device) *publishGate {
+	g := &publishGate{p: p}
+	if desc, ok := DescriptorOf(dev); ok && desc.Min != nil && desc.Max != nil {
+		g.span = math.Abs(*desc.Max - *desc.Min)
+	}
+	return g
+}
+
+// changed reports whether v, encoded as b, differs enough from the last
+// published value to be published.
+func (g *publishGate) changed(v any, b []byte) bool {
+	if !g.has {
+		return true
+	}
+	if g.p.OnChange && bytes.Equal(b, g.last) {
+		return false
+	}
+	f, ok := numeric(v)
+	if !ok {
+		return true
+	}
+	band := g.p.Deadband
+	if g.p.DeadbandPercent > 0 {
+		base := g.span
+		if base == 0 {
+			base = math.Abs(g.lastNum)
+		}
+		band = max(band, base*g.p.DeadbandPercent/100)
+	}
+	return band <= 0 || math.Abs(f-g.lastNum) >= band
+}
+
+// early reports whether a publish now would come sooner than MinInterval
+// after the last one, and if so when it may happen.
+func (g *publishGate) early(now time.Time) (time.Duration, bool) {
+	if !g.has || g.p.MinInterval <= 0 {
+		return 0, false
+	}
+	wait := g.p.MinInterval - now.Sub(g.lastAt)
+	return wait, wait > 0
+}
+
+// published records v, encoded as b, as the last published value.
+func (g *publishGate) published(v any, b []byte, now time.Time) {
+	g.has = true
+	g.last = b
+	g.lastNum, _ = numeric(v)
+	g.lastAt = now
+}
+
+// numeric returns v as a float64 if it is a number.
+func numeric(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
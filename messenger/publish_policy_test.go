@@ -0,0 +1,166 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedSource struct {
+	*testutils.Source[float64]
+	desc devices.Descriptor
+}
+
+func (d describedSource) Descriptor() devices.Descriptor { return d.desc }
+
+// statePayloads reads the next n publishes.
+func statePayloads(t *testing.T, m *wireMQTT, n int) []string {
+	t.Helper()
+	var out []string
+	for range n {
+		call, ok := testutils.WaitRecv(m.publishCh, time.Second)
+		require.True(t, ok, "publish %d of %d", len(out)+1, n)
+		out = append(out, string(call.body))
+	}
+	return out
+}
+
+func TestParsePublishPolicy(t *testing.T) {
+	t.Parallel()
+
+	base := PublishPolicy{Deadband: 1, MaxInterval: time.Minute}
+	p, err := ParsePublishPolicy(base, map[string]string{
+		AttrDeadband:    "2.5%",
+		AttrMinInterval: "500ms",
+		AttrOnChange:    "true",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, PublishPolicy{DeadbandPercent: 2.5, MinInterval: 500 * time.Millisecond, MaxInterval: time.Minute, OnChange: true}, p)
+
+	p, err = ParsePublishPolicy(base, nil)
+	require.NoError(t, err)
+	assert.Equal(t, base, p)
+
+	for _, attrs := range []map[string]string{
+		{AttrDeadband: "-1"},
+		{AttrDeadband: "x%"},
+		{AttrMaxInterval: "soon"},
+		{AttrOnChange: "maybe"},
+	} {
+		_, err := ParsePublishPolicy(base, attrs)
+		assert.Error(t, err, "%v", attrs)
+	}
+}
+
+func TestWireSourceDeadband(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, nil)
+	reg.Metrics = nil
+	reg.Publish = PublishPolicy{Deadband: 1}
+	src := testutils.NewSource[float64]("adc", 8)
+	WireSource(ctx, reg, src, codec.JSON[float64]{})
+
+	for _, v := range []float64{10, 10.5, 11.2, 11.5, 9} {
+		src.Set() <- v
+	}
+	assert.Equal(t, []string{"10", "11.2", "9"}, statePayloads(t, mqtt, 3))
+
+	raw, _ := reg.StateRaw("adc")
+	assert.Equal(t, "9", string(raw), "suppressed values are not cached")
+}
+
+func TestWireSourceDeadbandPercentFromAttributes(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, nil)
+	reg.Metrics = nil
+	src := describedSource{Source: testutils.NewSource[float64]("level", 8), desc: devices.Descriptor{
+		Name: "level", Min: fptr(0), Max: fptr(200),
+		Attributes: map[string]string{AttrDeadband: "5%"},
+	}}
+	WireSource(ctx, reg, src, codec.JSON[float64]{})
+
+	// 5% of the 0..200 span is 10.
+	for _, v := range []float64{100, 109, 111, 102, 100} {
+		src.Set() <- v
+	}
+	assert.Equal(t, []string{"100", "111", "100"}, statePayloads(t, mqtt, 3))
+}
+
+func TestWireSourceOnChange(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, nil)
+	reg.Metrics = nil
+	reg.SetPublishPolicy("door", PublishPolicy{OnChange: true})
+	src := testutils.NewSource[string]("door", 8)
+	WireSource(ctx, reg, src, codec.JSON[string]{})
+
+	for _, v := range []string{"open", "open", "closed", "closed", "open"} {
+		src.Set() <- v
+	}
+	assert.Equal(t, []string{`"open"`, `"closed"`, `"open"`}, statePayloads(t, mqtt, 3))
+}
+
+func TestWireSourceMinInterval(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, nil)
+	reg.Metrics = nil
+	reg.Publish = PublishPolicy{MinInterval: 50 * time.Millisecond}
+	src := testutils.NewSource[int]("adc", 8)
+	WireSource(ctx, reg, src, codec.JSON[int]{})
+
+	start := time.Now()
+	for v := 1; v <= 4; v++ {
+		src.Set() <- v
+	}
+	// The first value goes out at once; the rest are held and only the
+	// latest is published after the interval.
+	assert.Equal(t, []string{"1", "4"}, statePayloads(t, mqtt, 2))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	_, ok := testutils.WaitRecv(mqtt.publishCh, 80*time.Millisecond)
+	assert.False(t, ok)
+}
+
+func TestWireSourceHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, nil)
+	reg.Metrics = nil
+	reg.Publish = PublishPolicy{OnChange: true, MaxInterval: 20 * time.Millisecond}
+	src := testutils.NewSource[int]("adc", 8)
+	WireSource(ctx, reg, src, codec.JSON[int]{})
+
+	src.Set() <- 7
+	src.Set() <- 7
+	assert.Equal(t, []string{"7", "7", "7"}, statePayloads(t, mqtt, 3))
+}
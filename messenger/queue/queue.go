@@ -0,0 +1,436 @@
+// Package queue provides a store-and-forward wrapper for messenger.MQTT.
+//
+// A Queue passes publishes straight through while the broker is
+// reachable. When a publish fails, the message is kept (optionally on
+// disk) and later flushed in order, so readings taken while a station is
+// offline are not lost.
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// Policy decides what happens to a message that cannot be published.
+type Policy int
+
+const (
+	// Default keeps the latest retained message per topic and every
+	// non-retained message.
+	Default Policy = iota
+	// KeepAll queues every message.
+	KeepAll
+	// KeepLatest keeps only the newest queued message per topic.
+	KeepLatest
+	// Drop never queues; the publish error is returned to the caller.
+	Drop
+)
+
+// Rule applies a Policy to topics matching Filter (MQTT wildcards allowed).
+type Rule struct {
+	Filter string
+	Policy Policy
+}
+
+// Config configures a Queue.
+type Config struct {
+	// Dir holds the spool file. Empty keeps the queue in memory only.
+	Dir string
+
+	// MaxMessages bounds the queue; the oldest message is discarded
+	// when it is full. Defaults to 10000.
+	MaxMessages int
+
+	// Rules are checked in order; the first match wins. Topics with no
+	// matching rule use Default.
+	Rules []Rule
+
+	// RetryInterval is how often Run retries a pending flush. Defaults to 5s.
+	RetryInterval time.Duration
+}
+
+const spoolFile = "spool.jsonl"
+
+// record is one line of the spool file. A record with Drop set removes
+// the message with the same Seq.
+type record struct {
+	Seq   uint64                `json:"seq"`
+	Drop  bool                  `json:"drop,omitempty"`
+	Topic string                `json:"topic,omitempty"`
+	Body  []byte                `json:"payload,omitempty"`
+	Ret   bool                  `json:"retain,omitempty"`
+	QoS   byte                  `json:"qos,omitempty"`
+	Props *messenger.Properties `json:"props,omitempty"`
+}
+
+func (r record) message() messenger.Message {
+	return messenger.Message{Topic: r.Topic, Payload: r.Body, Retain: r.Ret, QoS: r.QoS, Properties: r.Props}
+}
+
+// Queue wraps a messenger.MQTT with a store-and-forward publish queue.
+// It implements messenger.MQTT.
+type Queue struct {
+	next messenger.MQTT
+	cfg  Config
+
+	flushMu sync.Mutex // one flush at a time
+
+	mu      sync.Mutex
+	items   []record
+	seq     uint64
+	file    *os.File
+	records int  // lines in the spool file, for compaction
+	rewrite bool // a write failed; the spool must be rewritten
+}
+
+var _ messenger.MQTT = (*Queue)(nil)
+var _ messenger.MessagePublisher = (*Queue)(nil)
+
+// New wraps next. If cfg.Dir is set, messages spooled by a previous run
+// are loaded and will be flushed first.
+func New(next messenger.MQTT, cfg Config) (*Queue, error) {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = 10000
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = 5 * time.Second
+	}
+	q := &Queue{next: next, cfg: cfg}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+		if err := q.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Pending returns the number of queued messages.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Close closes the spool file. Queued messages stay on disk.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// Publish publishes through the wrapped client, queueing on failure.
+func (q *Queue) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return q.PublishMessage(ctx, messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+}
+
+// PublishMessage publishes m through the wrapped client. While older
+// messages are still queued, m is queued behind them to keep order.
+// A queued message is not an error; only the Drop policy reports
+// publish failures, and Drop messages are never held behind the queue.
+//
+// A message the client reports as messenger.ErrPublishPending is left to
+// the client, which still holds it; queueing it too could deliver it
+// twice.
+func (q *Queue) PublishMessage(ctx context.Context, m messenger.Message) error {
+	policy := q.policy(m)
+	if policy == Drop {
+		return messenger.PublishMessage(ctx, q.next, m)
+	}
+
+	if q.Pending() == 0 {
+		err := messenger.PublishMessage(ctx, q.next, m)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, messenger.ErrPublishPending) {
+			slog.Warn("MQTT publish unacknowledged; left to the client", "topic", m.Topic, "error", err)
+			return nil
+		}
+		slog.Warn("MQTT publish failed; queueing", "topic", m.Topic, "error", err)
+	}
+
+	return q.enqueue(m, policy)
+}
+
+// Subscribe passes through to the wrapped client.
+func (q *Queue) Subscribe(ctx context.Context, topic string, qos byte, handler func(messenger.Message)) (func() error, error) {
+	return q.next.Subscribe(ctx, topic, qos, handler)
+}
+
+// SetWill passes through to the wrapped client.
+func (q *Queue) SetWill(topic string, payload []byte, retain bool, qos byte) error {
+	return q.next.SetWill(topic, payload, retain, qos)
+}
+
+// Flush publishes queued messages in order. It stops at the first
+// failure and returns it; the failed message stays at the head.
+func (q *Queue) Flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	sent := 0
+	defer func() {
+		if sent > 0 {
+			slog.Info("MQTT queue flushed", "sent", sent, "pending", q.Pending())
+		}
+	}()
+
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return q.compact()
+		}
+		head := q.items[0]
+		q.mu.Unlock()
+
+		err := messenger.PublishMessage(ctx, q.next, head.message())
+		if err != nil && !errors.Is(err, messenger.ErrPublishPending) {
+			return err
+		}
+		sent++
+
+		q.mu.Lock()
+		// The head may have been replaced by a newer KeepLatest message
+		// while we were publishing.
+		if len(q.items) > 0 && q.items[0].Seq == head.Seq {
+			q.items = q.items[1:]
+			q.appendRecord(record{Seq: head.Seq, Drop: true})
+		}
+		q.mu.Unlock()
+
+		// The client holds the head now; the connection is likely down,
+		// so leave the rest for the next flush.
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Run retries Flush every RetryInterval until ctx is canceled. Call
+// Flush directly from the client's on-connect hook for prompt delivery.
+func (q *Queue) Run(ctx context.Context) error {
+	t := time.NewTicker(q.cfg.RetryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if q.Pending() > 0 {
+				if err := q.Flush(ctx); err != nil {
+					slog.Debug("MQTT queue flush failed", "pending", q.Pending(), "error", err)
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (q *Queue) policy(m messenger.Message) Policy {
+	p := Default
+	for _, r := range q.cfg.Rules {
+		if messenger.MatchTopic(r.Filter, m.Topic) {
+			p = r.Policy
+			break
+		}
+	}
+	if p == Default {
+		if m.Retain {
+			return KeepLatest
+		}
+		return KeepAll
+	}
+	return p
+}
+
+func (q *Queue) enqueue(m messenger.Message, policy Policy) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if policy == KeepLatest {
+		kept := q.items[:0]
+		for _, it := range q.items {
+			if it.Topic == m.Topic {
+				q.appendRecord(record{Seq: it.Seq, Drop: true})
+				continue
+			}
+			kept = append(kept, it)
+		}
+		q.items = kept
+	}
+
+	for len(q.items) >= q.cfg.MaxMessages {
+		old := q.items[0]
+		q.items = q.items[1:]
+		q.appendRecord(record{Seq: old.Seq, Drop: true})
+		slog.Warn("MQTT queue full; discarding oldest", "topic", old.Topic)
+	}
+
+	q.seq++
+	r := record{
+		Seq:   q.seq,
+		Topic: m.Topic,
+		Body:  append([]byte(nil), m.Payload...),
+		Ret:   m.Retain,
+		QoS:   m.QoS,
+		Props: m.Properties,
+	}
+	q.items = append(q.items, r)
+	if err := q.appendRecord(r); err != nil {
+		return err
+	}
+	// Replacements and discards only append drop records, so rewrite
+	// the spool here too or it grows without bound while offline.
+	if err := q.compactLocked(); err != nil {
+		slog.Warn("MQTT queue compaction failed", "error", err)
+	}
+	return nil
+}
+
+// appendRecord writes r to the spool and syncs it, so a queued message
+// survives a power cut. q.mu must be held.
+func (q *Queue) appendRecord(r record) error {
+	// While a rewrite is due, memory is the record; compaction writes it.
+	if q.file == nil || q.rewrite {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	q.records++
+	b = append(b, '\n')
+	n, err := q.file.Write(b)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		// A torn line would also garble the next record appended to
+		// it, so rewrite the spool from items at the next compaction.
+		q.rewrite = true
+		return fmt.Errorf("queue: spool write: %w", err)
+	}
+	return nil
+}
+
+// load replays the spool file. A torn final line from a crash is ignored.
+func (q *Queue) load() error {
+	f, err := os.Open(filepath.Join(q.cfg.Dir, spoolFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var items []record
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			continue
+		}
+		q.seq = max(q.seq, r.Seq)
+		if r.Drop {
+			for i, it := range items {
+				if it.Seq == r.Seq {
+					items = append(items[:i], items[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+		items = append(items, r)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	q.items = items
+	if len(items) > 0 {
+		slog.Info("MQTT queue loaded", "pending", len(items))
+	}
+	return nil
+}
+
+// compact rewrites the spool with only the pending messages once it
+// holds more than twice as many records as there are pending messages.
+func (q *Queue) compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.compactLocked()
+}
+
+// compactLocked is compact with q.mu held.
+func (q *Queue) compactLocked() error {
+	if q.cfg.Dir == "" {
+		return nil
+	}
+	if q.file != nil && !q.rewrite && q.records <= 2*len(q.items)+64 {
+		return nil
+	}
+
+	path := filepath.Join(q.cfg.Dir, spoolFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, it := range q.items {
+		b, err := json.Marshal(it)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.records = len(q.items)
+	q.rewrite = false
+	return nil
+}
@@ -0,0 +1,325 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/broker"
+	"github.com/rustyeddy/otto/messenger/mqtt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errOffline = errors.New("offline")
+
+// flakyMQTT records publishes and fails them while offline.
+type flakyMQTT struct {
+	mu      sync.Mutex
+	offline bool
+	err     error // returned instead of errOffline when set
+	sent    []messenger.Message
+}
+
+func (m *flakyMQTT) setOffline(v bool) {
+	m.mu.Lock()
+	m.offline = v
+	m.mu.Unlock()
+}
+
+func (m *flakyMQTT) topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, s := range m.sent {
+		out = append(out, s.Topic+"="+string(s.Payload))
+	}
+	return out
+}
+
+func (m *flakyMQTT) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return m.PublishMessage(ctx, messenger.Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+}
+
+func (m *flakyMQTT) PublishMessage(ctx context.Context, msg messenger.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.offline {
+		if m.err != nil {
+			return m.err
+		}
+		return errOffline
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *flakyMQTT) Subscribe(ctx context.Context, topic string, qos byte, handler func(messenger.Message)) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (m *flakyMQTT) SetWill(topic string, payload []byte, retain bool, qos byte) error { return nil }
+
+func TestQueuePassesThroughWhenOnline(t *testing.T) {
+	t.Parallel()
+
+	next := &flakyMQTT{}
+	q, err := New(next, Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Publish(context.Background(), "a", []byte("1"), false, 0))
+	assert.Equal(t, []string{"a=1"}, next.topics())
+	assert.Equal(t, 0, q.Pending())
+}
+
+func TestQueueFlushesInOrderWithPolicies(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{})
+	require.NoError(t, err)
+
+	// Retained state keeps only the latest value; events keep all.
+	require.NoError(t, q.Publish(ctx, "otto/devices/t/state", []byte("20"), true, 1))
+	require.NoError(t, q.Publish(ctx, "otto/devices/t/event", []byte("e1"), false, 1))
+	require.NoError(t, q.Publish(ctx, "otto/devices/t/state", []byte("21"), true, 1))
+	require.NoError(t, q.Publish(ctx, "otto/devices/t/event", []byte("e2"), false, 1))
+	assert.Equal(t, 3, q.Pending())
+
+	require.ErrorIs(t, q.Flush(ctx), errOffline)
+	assert.Equal(t, 3, q.Pending())
+
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, 0, q.Pending())
+	assert.Equal(t, []string{
+		"otto/devices/t/event=e1",
+		"otto/devices/t/state=21",
+		"otto/devices/t/event=e2",
+	}, next.topics())
+}
+
+func TestQueueHoldsNewPublishesBehindPending(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Publish(ctx, "a", []byte("1"), false, 0))
+	next.setOffline(false)
+	require.NoError(t, q.Publish(ctx, "a", []byte("2"), false, 0))
+	assert.Empty(t, next.topics())
+
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"a=1", "a=2"}, next.topics())
+}
+
+func TestQueueRules(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{Rules: []Rule{
+		{Filter: "otto/devices/+/meta", Policy: Drop},
+		{Filter: "otto/devices/cam/#", Policy: KeepLatest},
+	}})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, q.Publish(ctx, "otto/devices/t/meta", []byte("{}"), true, 1), errOffline)
+	require.NoError(t, q.Publish(ctx, "otto/devices/cam/frame", []byte("f1"), false, 0))
+	require.NoError(t, q.Publish(ctx, "otto/devices/cam/frame", []byte("f2"), false, 0))
+	assert.Equal(t, 1, q.Pending())
+
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"otto/devices/cam/frame=f2"}, next.topics())
+}
+
+func TestQueueBounded(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{MaxMessages: 2})
+	require.NoError(t, err)
+
+	for _, v := range []string{"1", "2", "3"} {
+		require.NoError(t, q.Publish(ctx, "e", []byte(v), false, 0))
+	}
+	assert.Equal(t, 2, q.Pending())
+
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"e=2", "e=3"}, next.topics())
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	next := &flakyMQTT{offline: true}
+
+	q, err := New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, q.Publish(ctx, "s", []byte("old"), true, 1))
+	require.NoError(t, q.PublishMessage(ctx, messenger.Message{
+		Topic: "e", Payload: []byte("1"),
+		Properties: &messenger.Properties{ContentType: "text/plain"},
+	}))
+	require.NoError(t, q.Publish(ctx, "s", []byte("new"), true, 1))
+	require.NoError(t, q.Close())
+
+	// Simulate a crash mid-write.
+	f, err := os.OpenFile(filepath.Join(dir, spoolFile), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":99,"topic":"tor`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+	assert.Equal(t, 2, q.Pending())
+
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"e=1", "s=new"}, next.topics())
+	next.mu.Lock()
+	require.NotNil(t, next.sent[0].Properties)
+	assert.Equal(t, "text/plain", next.sent[0].Properties.ContentType)
+	assert.True(t, next.sent[1].Retain)
+	next.mu.Unlock()
+
+	// Nothing is replayed after a full flush.
+	require.NoError(t, q.Close())
+	q, err = New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Pending())
+	require.NoError(t, q.Close())
+}
+
+func TestQueueCompactsWhileOffline(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	// Each replacement appends a drop record; the spool must stay
+	// proportional to what is pending, not to what was published.
+	const n = 5000
+	for i := range n {
+		require.NoError(t, q.Publish(ctx, "station/status", []byte(strconv.Itoa(i)), true, 1))
+	}
+	assert.Equal(t, 1, q.Pending())
+
+	fi, err := os.Stat(filepath.Join(dir, spoolFile))
+	require.NoError(t, err)
+	assert.Less(t, fi.Size(), int64(16*1024), "spool grew with replacements")
+
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"station/status=" + strconv.Itoa(n-1)}, next.topics())
+}
+
+func TestQueueLeavesPendingPublishToClient(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	next := &flakyMQTT{offline: true, err: fmt.Errorf("%w: timeout", messenger.ErrPublishPending)}
+	q, err := New(next, Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Publish(ctx, "e", []byte("1"), false, 1))
+	assert.Equal(t, 0, q.Pending(), "the client still holds it")
+}
+
+func TestQueueThroughPahoReconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	b1 := broker.New(broker.Config{Addr: "127.0.0.1:0"})
+	ctx1, stop1 := context.WithCancel(ctx)
+	require.NoError(t, b1.Start(ctx1))
+	addr := b1.Addr().String()
+
+	client := mqtt.New(mqtt.Config{Broker: "tcp://" + addr, CleanSession: true})
+	q, err := New(client, Config{})
+	require.NoError(t, err)
+	client.SetOnConnect(func() { go func() { _ = q.Flush(ctx) }() })
+	require.NoError(t, client.Connect(ctx))
+	t.Cleanup(func() { _ = client.Disconnect(context.Background()) })
+
+	waitState := func(connected bool) {
+		require.NoError(t, testutils.Eventually(5*time.Second, 5*time.Millisecond, func() error {
+			if (client.State() == mqtt.StateConnected) != connected {
+				return fmt.Errorf("state %v", client.State())
+			}
+			return nil
+		}))
+	}
+	waitState(true)
+
+	// Paho still says it is connected while it reconnects, and completes
+	// QoS 0 publishes it cannot send; the queue must keep them.
+	stop1()
+	b1.Wait()
+	waitState(false)
+	require.NoError(t, q.Publish(ctx, "otto/devices/temp/state", []byte("21.5"), true, 0))
+	assert.Equal(t, 1, q.Pending())
+
+	b2 := broker.New(broker.Config{Addr: addr})
+	require.NoError(t, b2.Start(ctx))
+	require.NoError(t, testutils.Eventually(5*time.Second, 10*time.Millisecond, func() error {
+		m, ok := b2.Retained("otto/devices/temp/state")
+		if !ok || string(m.Payload) != "21.5" {
+			return errors.New("not delivered after reconnect")
+		}
+		return nil
+	}))
+	assert.Equal(t, 0, q.Pending())
+}
+
+func TestQueueRewritesSpoolAfterWriteError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	next := &flakyMQTT{offline: true}
+	q, err := New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, q.Publish(ctx, "e", []byte("1"), false, 1))
+
+	// Break the spool under the queue: the failed write is reported and
+	// the spool is rebuilt from memory with the next message.
+	q.mu.Lock()
+	require.NoError(t, q.file.Close())
+	q.mu.Unlock()
+	require.Error(t, q.Publish(ctx, "e", []byte("2"), false, 1))
+	require.NoError(t, q.Publish(ctx, "e", []byte("3"), false, 1))
+	require.NoError(t, q.Close())
+
+	q, err = New(next, Config{Dir: dir})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+	next.setOffline(false)
+	require.NoError(t, q.Flush(ctx))
+	assert.Equal(t, []string{"e=1", "e=2", "e=3"}, next.topics())
+}
@@ -3,6 +3,8 @@ package messenger
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
 	"time"
@@ -10,6 +12,12 @@ import (
 	"github.com/rustyeddy/devices"
 )
 
+// ErrUnknownDevice is returned for names that are not in the registry.
+var ErrUnknownDevice = errors.New("unknown device")
+
+// ErrDuplicateDevice is returned by Add for a name already registered.
+var ErrDuplicateDevice = errors.New("device already registered")
+
 // Logger is the minimal logging interface used by Registry.
 type Logger interface {
 	Info(msg string, args ...any)
@@ -20,9 +28,14 @@ type Logger interface {
 // Registry wires devices to MQTT topics and keeps a small state cache.
 type Registry struct {
 	MQTT   MQTT
-	Topics TopicScheme
+	Topics Topics
 	Log    Logger
 
+	// Station names this registry's connection. Its status topic
+	// (StationStatusTopic) carries the connection's will, since MQTT
+	// allows only one; defaults to the hostname.
+	Station string
+
 	// Defaults (override after NewRegistry if desired)
 	QoSState    byte
 	QoSSet      byte
@@ -34,16 +47,63 @@ type Registry struct {
 	// Command delivery guard (prevents wedging MQTT callback path)
 	CommandTimeout time.Duration
 
+	// Default deadline for Call and RPC handlers when ctx has none
+	RPCTimeout time.Duration
+
+	// Serve the "set" RPC method of WireSink devices on their RPC topic.
+	// Off by default so a sink subscribes only to its set topic;
+	// Registry.Set works either way.
+	SetRPC bool
+
+	// Clamp out-of-range set values to the descriptor's Min/Max instead
+	// of rejecting them (see ValidateSet)
+	ClampSets bool
+
+	// How Run restarts devices whose Run returns (see SetRestartPolicy
+	// for per-device overrides)
+	Restart RestartPolicy
+
+	// Which values WireSource publishes (see SetPublishPolicy and the
+	// publish_* descriptor attributes); the zero value publishes all
+	Publish PublishPolicy
+
+	// Counters for publishes, set deliveries and subscriptions
+	// (DefaultMetrics unless replaced; nil disables)
+	Metrics *Metrics
+
+	// Recent events kept per device for Events (0 keeps none)
+	EventHistory int
+
+	// Optional persistence for the state cache. Run loads it on start;
+	// call LoadState to load earlier.
+	Store StateStore
+
 	// Internal
 	mu sync.RWMutex
 
 	devs []devices.Device
 
-	// Desired subscriptions (topic -> spec)
-	subs map[string]subSpec
+	// Desired subscriptions and their handlers
+	subs *Subscriptions
+
+	// Subscriptions made for a device, dropped by Remove
+	deviceSubs map[string][]*Subscription
 
-	// Active unsubscribers (topic -> unsub)
-	unsubs map[string]func() error
+	// Active Run, nil when not running
+	run *runState
+
+	// Live contexts scoped to a device (see deviceContext)
+	scopes map[string]map[*deviceScope]struct{}
+
+	// Per-device restart policies and last published status
+	restarts map[string]RestartPolicy
+	status   map[string]StatusPayload
+
+	// Per-device publish policies
+	publishPolicies map[string]PublishPolicy
+
+	// Set commands waiting for their applied ack
+	acks ackTracker
 
 	// ---- State cache ----
 	stateMu sync.RWMutex
@@ -53,14 +113,62 @@ type Registry struct {
 
 	// decoded state cache (optional, populated by WireSource)
 	stateAny map[string]any
+
+	// when each state was recorded
+	stateTime map[string]time.Time
+
+	// per-device decoders registered by WireSource, used to rebuild
+	// stateAny from stored payloads
+	stateDecode map[string]func([]byte) (any, error)
+
+	stateLoaded bool
+
+	// observers of state updates (see OnState)
+	stateHooks []StateFunc
+
+	// state watchers (see Watch)
+	watchMu  sync.Mutex
+	watchers map[*Watcher]struct{}
+
+	// ---- Event history ----
+	eventMu    sync.Mutex
+	events     map[string][]EventPayload
+	eventHooks []EventFunc
+
+	// observers of status changes (see OnStatus), guarded by mu
+	statusHooks []StatusFunc
+
+	// called on every (re)connect (see OnConnect), guarded by mu
+	connectHooks []func(context.Context)
+
+	// ---- RPC ----
+	rpcMu sync.Mutex
+
+	// device -> method -> handler
+	rpcHandlers map[string]map[string]RPCHandler
+
+	// devices whose RPC topic is subscribed
+	rpcServed map[string]bool
+
+	// in-flight calls (correlation id -> reply)
+	rpcPending map[string]chan RPCResponse
+
+	// reply topic for calls made by this registry ("" until first Call)
+	rpcReplyMu sync.Mutex
+	rpcReply   string
 }
 
 // NewRegistry builds a Registry with defaults set for QoS and retention.
-func NewRegistry(m MQTT, topics TopicScheme) *Registry {
-	return &Registry{
+// A nil topics uses TopicScheme{Prefix: "otto"}.
+func NewRegistry(m MQTT, topics Topics) *Registry {
+	if topics == nil {
+		topics = TopicScheme{Prefix: "otto"}
+	}
+	r := &Registry{
 		MQTT:           m,
 		Topics:         topics,
 		Log:            slog.Default(),
+		Station:        defaultStation(),
 		QoSState:       0,
 		QoSSet:         1,
 		QoSEvent:       0,
@@ -68,120 +176,335 @@ func NewRegistry(m MQTT, topics TopicScheme) *Registry {
 		RetainState:    true,
 		RetainMeta:     true,
 		CommandTimeout: 2 * time.Second,
-
-		subs:     map[string]subSpec{},
-		unsubs:   map[string]func() error{},
-		stateRaw: make(map[string][]byte),
-		stateAny: make(map[string]any),
+		RPCTimeout:     5 * time.Second,
+		Restart:        DefaultRestartPolicy,
+		Metrics:        DefaultMetrics,
+		EventHistory:   50,
+
+		subs:            NewSubscriptions(m),
+		deviceSubs:      map[string][]*Subscription{},
+		scopes:          map[string]map[*deviceScope]struct{}{},
+		restarts:        map[string]RestartPolicy{},
+		publishPolicies: map[string]PublishPolicy{},
+		status:          map[string]StatusPayload{},
+		stateRaw:        make(map[string][]byte),
+		stateAny:        make(map[string]any),
+		stateTime:       make(map[string]time.Time),
+		stateDecode:     map[string]func([]byte) (any, error){},
+		events:          map[string][]EventPayload{},
+		watchers:        map[*Watcher]struct{}{},
+		rpcHandlers:     map[string]map[string]RPCHandler{},
+		rpcServed:       map[string]bool{},
+		rpcPending:      map[string]chan RPCResponse{},
 	}
+	r.subs.Log = registryLog{r}
+	r.subs.OnError = func(string, error) { r.Metrics.subscribeFailure() }
+	return r
 }
 
-// Add appends a device to the registry.
-func (r *Registry) Add(dev devices.Device) {
+// registryLog forwards to the Registry's Log, which may be replaced
+// after NewRegistry.
+type registryLog struct{ r *Registry }
+
+func (l registryLog) Info(msg string, args ...any)  { l.r.Log.Info(msg, args...) }
+func (l registryLog) Warn(msg string, args ...any)  { l.r.Log.Warn(msg, args...) }
+func (l registryLog) Error(msg string, args ...any) { l.r.Log.Error(msg, args...) }
+
+// Add appends a device to the registry. If Run is active the device is
+// started right away: its status and meta are published, events
+// are wired and its Run goroutine is launched. Wire its values with
+// WireSource/WireSink as usual; their subscriptions apply immediately
+// once the registry is connected. Device names share topics, so a name
+// already registered is rejected with ErrDuplicateDevice.
+func (r *Registry) Add(dev devices.Device) error {
+	name := dev.Name()
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	for _, d := range r.devs {
+		if d.Name() == name {
+			r.mu.Unlock()
+			return fmt.Errorf("%s: %w", name, ErrDuplicateDevice)
+		}
+	}
 	r.devs = append(r.devs, dev)
+	run := r.run
+	if run != nil {
+		run.wg.Add(1)
+	}
+	r.mu.Unlock()
+
+	if run != nil {
+		r.startDevice(run, dev)
+	}
+	return nil
+}
+
+// RemoveOption configures Remove.
+type RemoveOption func(*removeConfig)
+
+type removeConfig struct {
+	clearRetained bool
+}
+
+// ClearRetained makes Remove also clear the device's retained state and
+// meta topics, so new subscribers no longer see it.
+func ClearRetained() RemoveOption {
+	return func(c *removeConfig) { c.clearRetained = true }
+}
+
+// Remove takes a device out of the registry. Its Run, event and
+// WireSource/WireSink goroutines are stopped, its set and RPC
+// subscriptions are dropped, its cached state is forgotten, also by the
+// Store, offline status is published and its Metrics series are
+// dropped. Remove waits for the device's Run to return
+// until ctx ends.
+func (r *Registry) Remove(ctx context.Context, name string, opts ...RemoveOption) error {
+	var cfg removeConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	r.mu.Lock()
+	idx := -1
+	for i, d := range r.devs {
+		if d.Name() == name {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		r.mu.Unlock()
+		return fmt.Errorf("%s: %w", name, ErrUnknownDevice)
+	}
+	r.devs = append(r.devs[:idx:idx], r.devs[idx+1:]...)
+
+	var done chan struct{}
+	if r.run != nil {
+		done = r.run.done[name]
+		delete(r.run.done, name)
+	}
+	scopes := r.scopes[name]
+	delete(r.scopes, name)
+	subs := r.deviceSubs[name]
+	delete(r.deviceSubs, name)
+	r.mu.Unlock()
+
+	for s := range scopes {
+		s.cancel()
+	}
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+
+	r.rpcMu.Lock()
+	delete(r.rpcHandlers, name)
+	delete(r.rpcServed, name)
+	r.rpcMu.Unlock()
+
+	r.eventMu.Lock()
+	delete(r.events, name)
+	r.eventMu.Unlock()
+
+	r.acks.forget(name)
+
+	r.stateMu.Lock()
+	delete(r.stateRaw, name)
+	delete(r.stateAny, name)
+	delete(r.stateTime, name)
+	delete(r.stateDecode, name)
+	r.stateMu.Unlock()
+	if r.Store != nil {
+		if err := r.Store.Delete(name); err != nil {
+			r.Log.Warn("state store delete failed", "device", name, "error", err)
+		}
+	}
+
+	var err error
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	r.publishStatus(ctx, name, StatusPayload{Status: StatusOffline})
+	r.mu.Lock()
+	delete(r.status, name)
+	delete(r.restarts, name)
+	delete(r.publishPolicies, name)
+	r.mu.Unlock()
+	if cfg.clearRetained {
+		// An empty retained payload deletes the broker's retained message.
+		_ = r.publish(ctx, name, Message{Topic: r.Topics.State(name), Retain: true, QoS: r.QoSState})
+		_ = r.publish(ctx, name, Message{Topic: r.Topics.Meta(name), Retain: true, QoS: r.QoSStatus})
+	}
+	r.Metrics.forget(name)
+
+	r.Log.Info("device removed", "device", name)
+	return err
+}
+
+// deviceContext derives a context from ctx that also ends when the
+// device is removed.
+func (r *Registry) deviceContext(ctx context.Context, name string) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &deviceScope{cancel: cancel}
+	r.mu.Lock()
+	if r.scopes[name] == nil {
+		r.scopes[name] = map[*deviceScope]struct{}{}
+	}
+	r.scopes[name][s] = struct{}{}
+	r.mu.Unlock()
+
+	// Forget the scope once it ends on its own, so repeated wiring does
+	// not pile up cancels until Remove.
+	context.AfterFunc(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.scopes[name], s)
+		if len(r.scopes[name]) == 0 {
+			delete(r.scopes, name)
+		}
+	})
+	return ctx
+}
+
+// deviceScope is a context handed out by deviceContext.
+type deviceScope struct {
+	cancel context.CancelFunc
+}
+
+// Devices returns a snapshot of the registered devices.
+func (r *Registry) Devices() []devices.Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]devices.Device(nil), r.devs...)
+}
+
+// Device returns the registered device called name.
+func (r *Registry) Device(name string) (devices.Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, d := range r.devs {
+		if d.Name() == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// DescriptorOf returns dev's descriptor if it publishes one.
+func DescriptorOf(dev devices.Device) (devices.Descriptor, bool) {
+	d, ok := dev.(interface{ Descriptor() devices.Descriptor })
+	if !ok {
+		return devices.Descriptor{}, false
+	}
+	return d.Descriptor(), true
 }
 
 // WantSub registers a subscription that should be active whenever MQTT is connected.
-// Registry will apply these on every connect/reconnect.
-func (r *Registry) WantSub(topic string, qos byte, handler func(Message)) {
+// Registry will apply these on every connect/reconnect. Once ResubscribeAll
+// has run, the subscription is also applied right away. Several handlers
+// may share a topic, and wildcard filters are fanned out in process (see
+// Subscriptions); Unsubscribe the returned Subscription to drop one.
+func (r *Registry) WantSub(topic string, qos byte, handler func(Message)) *Subscription {
+	return r.subs.Add(topic, qos, handler)
+}
+
+// wantDeviceSub is WantSub for a subscription Remove drops with the device.
+func (r *Registry) wantDeviceSub(name, topic string, qos byte, handler func(Message)) {
+	sub := r.WantSub(topic, qos, handler)
 	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.subs[topic] = subSpec{topic: topic, qos: qos, handler: handler}
+	r.deviceSubs[name] = append(r.deviceSubs[name], sub)
+	r.mu.Unlock()
 }
 
 // ResubscribeAll applies all desired subscriptions (call on connect and reconnect).
+// While Run is active it also announces the station again, since the
+// broker may have published its will while the connection was down.
+// OnConnect hooks run last.
 func (r *Registry) ResubscribeAll(ctx context.Context) {
+	r.subs.ResubscribeAll(ctx)
+	r.rebirth(ctx)
+
 	r.mu.RLock()
-	subs := make([]subSpec, 0, len(r.subs))
-	for _, s := range r.subs {
-		subs = append(subs, s)
-	}
+	hooks := r.connectHooks
 	r.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx)
+	}
+}
 
-	r.Log.Info("MQTT connected; (re)subscribing", "count", len(subs))
+// PublishFor sends msg about device through the Registry's client and
+// counts it in Metrics, as the Registry's own publishes are. Bridges
+// such as Home Assistant, Homie and Sparkplug publish through it; device
+// is "" for messages not about one device.
+func (r *Registry) PublishFor(ctx context.Context, device string, msg Message) error {
+	return r.publish(ctx, device, msg)
+}
 
-	for _, s := range subs {
-		// Unsubscribe previous if any (best effort)
-		r.mu.Lock()
-		if u, ok := r.unsubs[s.topic]; ok && u != nil {
-			_ = u()
-			delete(r.unsubs, s.topic)
-		}
-		r.mu.Unlock()
+// publish sends a message about a device and counts it in Metrics.
+func (r *Registry) publish(ctx context.Context, name string, msg Message) error {
+	err := PublishMessage(ctx, r.MQTT, msg)
+	r.Metrics.publish(name, err)
+	return err
+}
 
-		unsub, err := r.MQTT.Subscribe(ctx, s.topic, s.qos, s.handler)
-		if err != nil {
-			r.Log.Error("MQTT subscribe failed", "topic", s.topic, "error", err)
-			continue
-		}
-		r.mu.Lock()
-		r.unsubs[s.topic] = unsub
-		r.mu.Unlock()
+// publishStatus stamps and records st as the device's status and
+// publishes it retained.
+func (r *Registry) publishStatus(ctx context.Context, name string, st StatusPayload) {
+	st.Time = time.Now()
+	st.Device, st.Station = name, r.Station
+	r.mu.Lock()
+	r.status[name] = st
+	hooks := r.statusHooks
+	r.mu.Unlock()
 
-		r.Log.Info("MQTT subscribed", "topic", s.topic, "qos", s.qos)
+	for _, fn := range hooks {
+		fn(name, st)
 	}
-}
 
-func (r *Registry) publishStatus(ctx context.Context, name, status string) {
-	b, _ := json.Marshal(StatusPayload{Status: status, Time: time.Now()})
-	_ = r.MQTT.Publish(ctx, r.Topics.Status(name), b, true, r.QoSStatus)
+	b, _ := json.Marshal(st)
+	_ = r.publish(ctx, name, Message{Topic: r.Topics.Status(name), Payload: b, Retain: true, QoS: r.QoSStatus})
 }
 
 func (r *Registry) publishMeta(ctx context.Context, dev devices.Device) {
-	d, ok := dev.(interface{ Descriptor() devices.Descriptor })
+	desc, ok := DescriptorOf(dev)
 	if !ok {
 		return
 	}
-	desc := d.Descriptor()
-	mp := MetaPayload{
-		Name:      desc.Name,
-		Kind:      desc.Kind,
-		ValueType: desc.ValueType,
-		Access:    string(desc.Access),
-		Unit:      desc.Unit,
-		Min:       desc.Min,
-		Max:       desc.Max,
-		Tags:      desc.Tags,
-		Attrs:     desc.Attributes,
-	}
-	b, err := json.Marshal(mp)
+	b, err := json.Marshal(NewMetaPayload(desc))
 	if err != nil {
 		r.Log.Warn("meta marshal failed", "device", dev.Name(), "error", err)
+		r.Metrics.marshalError(dev.Name())
 		return
 	}
-	_ = r.MQTT.Publish(ctx, r.Topics.Meta(dev.Name()), b, r.RetainMeta, r.QoSStatus)
+	_ = r.publish(ctx, dev.Name(), Message{Topic: r.Topics.Meta(dev.Name()), Payload: b, Retain: r.RetainMeta, QoS: r.QoSStatus})
 }
 
-func (r *Registry) wireEvents(ctx context.Context, dev devices.Device) {
-	name := dev.Name()
-
+// wireEvents forwards a device's events from ch until it closes or ctx
+// ends.
+func (r *Registry) wireEvents(ctx context.Context, name string, ch <-chan devices.Event) {
 	go func() {
 		for {
 			select {
-			case evt, ok := <-dev.Events():
+			case evt, ok := <-ch:
 				if !ok {
 					return
 				}
 
 				// JSON-friendly event payload
-				wire := map[string]any{
-					"device": evt.Device,
-					"kind":   evt.Kind,
-					"time":   evt.Time,
-					"msg":    evt.Msg,
-					"meta":   evt.Meta,
+				ev := EventPayload{
+					Device: evt.Device,
+					Kind:   string(evt.Kind),
+					Time:   evt.Time,
+					Msg:    evt.Msg,
+					Meta:   evt.Meta,
 				}
 				if evt.Err != nil {
-					wire["err"] = evt.Err.Error()
-				}
-
-				b, err := json.Marshal(wire)
-				if err != nil {
-					continue
+					ev.Err = evt.Err.Error()
 				}
-				_ = r.MQTT.Publish(ctx, r.Topics.Event(name), b, false, r.QoSEvent)
+				r.publishEvent(ctx, name, ev)
 
 			case <-ctx.Done():
 				return
@@ -190,72 +513,94 @@ func (r *Registry) wireEvents(ctx context.Context, dev devices.Device) {
 	}()
 }
 
+// runState tracks an active Run so devices added later can join it.
+type runState struct {
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	// closed when a device's Run returns (guarded by Registry.mu)
+	done map[string]chan struct{}
+}
+
 // Run starts device goroutines, wires events, and publishes status/meta.
+// Devices added while Run is active are started the same way. Each device
+// is supervised on its own according to its RestartPolicy, so a failing
+// device never stops the others; Run returns when ctx ends.
 // For reconnect-resubscribe to work, your MQTT adapter must call ResubscribeAll on connect.
 func (r *Registry) Run(ctx context.Context) error {
-	// Snapshot devices
-	r.mu.RLock()
-	devs := append([]devices.Device(nil), r.devs...)
-	r.mu.RUnlock()
-
-	// Prepare LWT + birth/meta and wire events
-	for _, dev := range devs {
-		name := dev.Name()
-
-		// Set LWT (offline retained)
-		offline, _ := json.Marshal(StatusPayload{Status: "offline", Time: time.Now()})
-		_ = r.MQTT.SetWill(r.Topics.Status(name), offline, true, r.QoSStatus)
-
-		// Birth online
-		r.publishStatus(ctx, name, "online")
-
-		// Meta retained (optional)
-		r.publishMeta(ctx, dev)
+	r.stateMu.RLock()
+	loaded := r.stateLoaded
+	r.stateMu.RUnlock()
+	if !loaded {
+		if err := r.LoadState(); err != nil {
+			r.Log.Warn("state store load failed", "error", err)
+		}
+	}
 
-		// Events -> MQTT
-		r.wireEvents(ctx, dev)
+	run := &runState{
+		ctx:  ctx,
+		done: map[string]chan struct{}{},
 	}
 
-	// Start devices
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(devs))
+	r.publishStationStatus(ctx, StatusOnline)
+
+	// Snapshot devices; later Adds start themselves
+	r.mu.Lock()
+	r.run = run
+	devs := append([]devices.Device(nil), r.devs...)
+	run.wg.Add(len(devs))
+	r.mu.Unlock()
 
 	for _, dev := range devs {
-		wg.Add(1)
-		go func(d devices.Device) {
-			defer wg.Done()
-			if err := d.Run(ctx); err != nil {
-				errCh <- err
-			}
-		}(dev)
+		r.startDevice(run, dev)
 	}
 
-	select {
-	case err := <-errCh:
-		// first fatal error
-		return err
-	case <-ctx.Done():
-		// graceful shutdown
-	}
+	<-ctx.Done()
 
 	// Best effort: unsubscribe
+	r.subs.Suspend()
 	r.mu.Lock()
-	for topic, u := range r.unsubs {
-		_ = u()
-		delete(r.unsubs, topic)
-	}
+	r.run = nil
+	devs = append(devs[:0], r.devs...)
 	r.mu.Unlock()
 
-	wg.Wait()
+	run.wg.Wait()
 
 	// Publish offline retained
 	for _, dev := range devs {
-		r.publishStatus(context.Background(), dev.Name(), "offline")
+		r.publishStatus(context.Background(), dev.Name(), StatusPayload{Status: StatusOffline})
 	}
+	r.publishStationStatus(context.Background(), StatusOffline)
 
+	if f, ok := r.Store.(StateFlusher); ok {
+		if err := f.Flush(); err != nil {
+			r.Log.Warn("state store flush failed", "error", err)
+		}
+	}
 	return nil
 }
 
+// startDevice publishes a device's meta, wires its events and
+// supervises it in a goroutine. The caller has done run.wg.Add(1).
+func (r *Registry) startDevice(run *runState, dev devices.Device) {
+	name := dev.Name()
+	ctx := r.deviceContext(run.ctx, name)
+	done := make(chan struct{})
+
+	r.mu.Lock()
+	run.done[name] = done
+	r.mu.Unlock()
+
+	// Meta retained (optional)
+	r.publishMeta(ctx, dev)
+
+	go func() {
+		defer run.wg.Done()
+		defer close(done)
+		r.supervise(ctx, dev)
+	}()
+}
+
 // StateRaw returns the last published state payload for a device.
 func (r *Registry) StateRaw(name string) ([]byte, bool) {
 	r.stateMu.RLock()
@@ -272,6 +617,116 @@ func (r *Registry) StateAny(name string) (any, bool) {
 	return v, ok
 }
 
+// StateTime returns when the last state for a device was recorded.
+func (r *Registry) StateTime(name string) (time.Time, bool) {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+	t, ok := r.stateTime[name]
+	return t, ok
+}
+
+// LoadState fills the state cache from Store. Values already cached by a
+// running WireSource are kept. Stored payloads are decoded for devices
+// whose WireSource is registered; others are decoded when it is.
+func (r *Registry) LoadState() error {
+	if r.Store == nil {
+		return nil
+	}
+	recs, err := r.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.stateLoaded = true
+	for name, rec := range recs {
+		if _, ok := r.stateRaw[name]; ok {
+			continue
+		}
+		r.stateRaw[name] = rec.Payload
+		r.stateTime[name] = rec.Time
+		if dec, ok := r.stateDecode[name]; ok {
+			r.decodeStateLocked(name, dec)
+		}
+	}
+	return nil
+}
+
+// StateFunc observes a state update: the device name, the encoded
+// payload and the decoded value.
+type StateFunc func(name string, raw []byte, v any)
+
+// OnState registers fn to be called after WireSource caches each new
+// state. fn runs on the source's goroutine and must not block.
+func (r *Registry) OnState(fn StateFunc) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.stateHooks = append(r.stateHooks, fn)
+}
+
+// setState caches and persists a freshly published state.
+func (r *Registry) setState(name string, b []byte, v any) {
+	now := time.Now()
+	r.stateMu.Lock()
+	r.stateRaw[name] = b
+	r.stateAny[name] = v
+	r.stateTime[name] = now
+	hooks := r.stateHooks
+	r.stateMu.Unlock()
+
+	for _, fn := range hooks {
+		fn(name, b, v)
+	}
+	r.notifyWatchers(StateUpdate{Device: name, Raw: b, Value: v, Time: now})
+	r.stateApplied(name, b)
+
+	if r.Store != nil {
+		if err := r.Store.Save(name, StateRecord{Payload: b, Time: now}); err != nil {
+			r.Log.Warn("state store save failed", "device", name, "error", err)
+		}
+	}
+}
+
+// cacheState records a state observed from another station. Unlike
+// setState it only feeds StateRaw, StateAny and StateAs: the value is not
+// this station's to report, so hooks, watchers, acks and the Store never
+// see it. A local device of the same name keeps its own state.
+func (r *Registry) cacheState(name string, b []byte, v any) {
+	if _, local := r.Device(name); local {
+		return
+	}
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.stateRaw[name] = b
+	r.stateAny[name] = v
+	r.stateTime[name] = time.Now()
+}
+
+// setStateDecoder registers how to rebuild a device's typed state from
+// its stored payload, decoding an already loaded payload right away.
+func (r *Registry) setStateDecoder(name string, dec func([]byte) (any, error)) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.stateDecode[name] = dec
+	if _, ok := r.stateAny[name]; !ok {
+		r.decodeStateLocked(name, dec)
+	}
+}
+
+func (r *Registry) decodeStateLocked(name string, dec func([]byte) (any, error)) {
+	b, ok := r.stateRaw[name]
+	if !ok {
+		return
+	}
+	v, err := dec(b)
+	if err != nil {
+		r.Log.Warn("stored state decode failed", "device", name, "error", err)
+		return
+	}
+	r.stateAny[name] = v
+}
+
 // StateAs returns the last decoded state as a concrete type.
 func StateAs[T any](r *Registry, name string) (T, bool) {
 	var zero T
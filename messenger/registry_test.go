@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -127,7 +130,7 @@ func TestRegistryResubscribeAll(t *testing.T) {
 	assert.Equal(t, 1, unsubs["otto/devices/lamp/state"])
 }
 
-func TestRegistryRunReturnsError(t *testing.T) {
+func TestRegistryRunIsolatesDeviceError(t *testing.T) {
 	t.Parallel()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -135,6 +138,8 @@ func TestRegistryRunReturnsError(t *testing.T) {
 
 	mqtt := newRegistryMQTT()
 	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Station = "garden"
+	reg.Restart = RestartPolicy{Mode: RestartNever, Settle: testSettle}
 
 	events := make(chan devices.Event)
 	close(events)
@@ -150,24 +155,51 @@ func TestRegistryRunReturnsError(t *testing.T) {
 	}
 	reg.Add(dev)
 
-	err := reg.Run(ctx)
-	require.Error(t, err)
+	healthy := &fakeDevice{name: "sensor", events: make(chan devices.Event)}
+	reg.Add(healthy)
 
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if st, _ := reg.Status("lamp"); st.Status != StatusError {
+			return errors.New("lamp not in error")
+		}
+		return nil
+	}))
+	st, _ := reg.Status("lamp")
+	assert.Equal(t, "boom", st.Error)
+
+	// The failure does not stop Run or the other devices.
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if st, _ := reg.Status("sensor"); st.Status != StatusOnline {
+			return errors.New("sensor not online")
+		}
+		return nil
+	}))
+	select {
+	case err := <-done:
+		require.Failf(t, "Run returned", "%v", err)
+	default:
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+
+	// The will is set before connecting, never by Run.
 	publishes, wills, _, _ := mqtt.snapshot()
-	require.Len(t, wills, 1)
-	assert.Equal(t, "otto/devices/lamp/status", wills[0].topic)
+	assert.Empty(t, wills)
 
-	var status StatusPayload
+	var statuses []string
 	var meta MetaPayload
-	var gotStatus bool
 	var gotMeta bool
 
 	for _, call := range publishes {
 		switch call.topic {
 		case "otto/devices/lamp/status":
+			var status StatusPayload
 			require.NoError(t, json.Unmarshal(call.body, &status))
-			assert.Equal(t, "online", status.Status)
-			gotStatus = true
+			statuses = append(statuses, status.Status)
 		case "otto/devices/lamp/meta":
 			require.NoError(t, json.Unmarshal(call.body, &meta))
 			assert.Equal(t, "lamp", meta.Name)
@@ -175,7 +207,7 @@ func TestRegistryRunReturnsError(t *testing.T) {
 		}
 	}
 
-	assert.True(t, gotStatus)
+	assert.Equal(t, []string{StatusStarting, StatusError, StatusOffline}, statuses)
 	assert.True(t, gotMeta)
 }
 
@@ -189,6 +221,7 @@ func TestRegistryRunGracefulShutdownPublishesOffline(t *testing.T) {
 
 	mqtt := newRegistryMQTT()
 	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Restart.Settle = time.Millisecond
 
 	started := make(chan struct{})
 	events := make(chan devices.Event)
@@ -212,6 +245,12 @@ func TestRegistryRunGracefulShutdownPublishesOffline(t *testing.T) {
 	case <-waitCtx.Done():
 		require.Fail(t, "device did not start")
 	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if st, _ := reg.Status("sensor"); st.Status != StatusOnline {
+			return errors.New("sensor not online")
+		}
+		return nil
+	}))
 
 	cancel()
 
@@ -242,3 +281,217 @@ func TestRegistryRunGracefulShutdownPublishesOffline(t *testing.T) {
 	assert.True(t, gotOnline)
 	assert.True(t, gotOffline)
 }
+
+func TestRegistryAddWhileRunning(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Station = "garden"
+	reg.Restart.Settle = time.Millisecond
+	reg.ResubscribeAll(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+
+	started := make(chan struct{})
+	sink := testutils.NewSink[bool]("lamp", 1)
+	dev := &fakeDevice{
+		name:   "lamp",
+		events: make(chan devices.Event),
+		run: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return nil
+		},
+	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		reg.mu.RLock()
+		defer reg.mu.RUnlock()
+		if reg.run == nil {
+			return errors.New("not running")
+		}
+		return nil
+	}))
+	reg.Add(dev)
+	WireSink(ctx, reg, sink, codec.JSON[bool]{})
+
+	select {
+	case <-started:
+	case <-ctx.Done():
+		require.Fail(t, "device added after Run was not started")
+	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if st, _ := reg.Status("lamp"); st.Status != StatusOnline {
+			return errors.New("lamp not online")
+		}
+		return nil
+	}))
+
+	publishes, wills, subs, _ := mqtt.snapshot()
+	assert.Empty(t, wills, "adding a device does not set a will")
+	assert.Equal(t, 1, subs["otto/devices/lamp/set"], "set topic subscribed without ResubscribeAll")
+	assert.Zero(t, subs["otto/devices/lamp/rpc"], "set RPC is off by default")
+
+	var online bool
+	for _, call := range publishes {
+		if call.topic == "otto/devices/lamp/status" {
+			var status StatusPayload
+			require.NoError(t, json.Unmarshal(call.body, &status))
+			online = online || status.Status == "online"
+		}
+	}
+	assert.True(t, online)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRegistryAddRejectsDuplicate(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(newRegistryMQTT(), TopicScheme{Prefix: "otto"})
+	first := &fakeDevice{name: "lamp", events: make(chan devices.Event)}
+	require.NoError(t, reg.Add(first))
+
+	err := reg.Add(&fakeDevice{name: "lamp", events: make(chan devices.Event)})
+	require.ErrorIs(t, err, ErrDuplicateDevice)
+	dev, ok := reg.Device("lamp")
+	require.True(t, ok)
+	assert.Same(t, first, dev)
+
+	// The name is free again once removed.
+	require.NoError(t, reg.Remove(context.Background(), "lamp"))
+	assert.NoError(t, reg.Add(&fakeDevice{name: "lamp", events: make(chan devices.Event)}))
+}
+
+func TestRegistryRemove(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.SetRPC = true
+
+	sink := testutils.NewSink[bool]("lamp", 1)
+	reg.Add(sink)
+	WireSink(ctx, reg, sink, codec.JSON[bool]{})
+	reg.setState("lamp", []byte("true"), true)
+	reg.ResubscribeAll(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		reg.mu.RLock()
+		defer reg.mu.RUnlock()
+		if reg.run == nil || reg.run.done["lamp"] == nil {
+			return errors.New("not started")
+		}
+		return nil
+	}))
+
+	require.NoError(t, reg.Remove(ctx, "lamp", ClearRetained()))
+
+	assert.Empty(t, reg.Devices())
+	_, ok := reg.StateRaw("lamp")
+	assert.False(t, ok)
+	assert.ErrorIs(t, reg.Set(ctx, "lamp", []byte("true")), ErrNotSettable)
+	assert.ErrorIs(t, reg.Remove(ctx, "lamp"), ErrUnknownDevice)
+
+	publishes, _, _, unsubs := mqtt.snapshot()
+	assert.Equal(t, 1, unsubs["otto/devices/lamp/set"])
+	assert.Equal(t, 1, unsubs["otto/devices/lamp/rpc"])
+
+	last := map[string]publishCall{}
+	for _, call := range publishes {
+		last[call.topic] = call
+	}
+	var status StatusPayload
+	require.NoError(t, json.Unmarshal(last["otto/devices/lamp/status"].body, &status))
+	assert.Equal(t, "offline", status.Status)
+	for _, topic := range []string{"otto/devices/lamp/state", "otto/devices/lamp/meta"} {
+		call, ok := last[topic]
+		require.True(t, ok, topic)
+		assert.Empty(t, call.body, topic)
+		assert.True(t, call.retain, topic)
+	}
+
+	// A removed device is not resubscribed on reconnect.
+	reg.ResubscribeAll(ctx)
+	_, _, subs, _ := mqtt.snapshot()
+	assert.Equal(t, 1, subs["otto/devices/lamp/set"])
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRegistryDeviceContextReleased(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(newRegistryMQTT(), TopicScheme{Prefix: "otto"})
+	scopes := func() int {
+		reg.mu.RLock()
+		defer reg.mu.RUnlock()
+		return len(reg.scopes["lamp"])
+	}
+
+	// Scopes whose parent ends are forgotten without a Remove.
+	for range 10 {
+		ctx, cancel := context.WithCancel(context.Background())
+		reg.deviceContext(ctx, "lamp")
+		cancel()
+	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if n := scopes(); n != 0 {
+			return fmt.Errorf("%d scopes left", n)
+		}
+		return nil
+	}))
+
+	// A live one is still ended by Remove.
+	reg.Add(testutils.NewSink[bool]("lamp", 1))
+	ctx := reg.deviceContext(context.Background(), "lamp")
+	assert.Equal(t, 1, scopes())
+	require.NoError(t, reg.Remove(context.Background(), "lamp"))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		require.Fail(t, "scope not canceled")
+	}
+	assert.Equal(t, 0, scopes())
+}
+
+func TestRegistryWantSubSharesTopic(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	sink := testutils.NewSink[bool]("lamp", 1)
+	reg.Add(sink)
+	WireSink(ctx, reg, sink, codec.JSON[bool]{})
+	monitor := reg.WantSub("otto/devices/lamp/set", 0, func(Message) {})
+	reg.ResubscribeAll(ctx)
+
+	_, _, subs, _ := mqtt.snapshot()
+	assert.Equal(t, 1, subs["otto/devices/lamp/set"])
+	assert.Len(t, handlers(reg.subs, "otto/devices/lamp/set"), 2)
+
+	// Removing the device leaves the other handler subscribed.
+	require.NoError(t, reg.Remove(ctx, "lamp"))
+	assert.Len(t, handlers(reg.subs, "otto/devices/lamp/set"), 1)
+	_, _, _, unsubs := mqtt.snapshot()
+	assert.Zero(t, unsubs["otto/devices/lamp/set"])
+
+	monitor.Unsubscribe()
+	_, _, _, unsubs = mqtt.snapshot()
+	assert.Equal(t, 1, unsubs["otto/devices/lamp/set"])
+}
@@ -0,0 +1,189 @@
+package messenger
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/messenger/codec"
+)
+
+// DefaultRemoteBuffer is the capacity of a remote device's Out and In
+// channels.
+const DefaultRemoteBuffer = 16
+
+// Remote is a device on another station, used through its MQTT topics.
+// Values on its state topic are decoded onto Out, and values sent to In
+// are encoded and published to its set topic, so rules can link devices
+// on different stations as if they were local.
+//
+// Decoded state is also recorded in the Registry's state cache under
+// the device's name, so StateAs works for it as for a local device. It
+// is only cached: OnState hooks, watchers, acks and the Store are left
+// to the station that owns the device, and a local device of the same
+// name keeps its own state.
+//
+// Remote devices are not added to a Registry: they have no status or
+// meta of their own, and their Run only waits for ctx to end.
+type Remote[T any] struct {
+	devices.Base
+
+	r      *Registry
+	topics Topics
+	c      codec.Codec[T]
+
+	mu     sync.Mutex
+	out    chan T
+	closed bool
+	in     chan T
+	sub    *Subscription
+}
+
+// RemoteSource returns a Source for device name on the station whose
+// topics are given. Out is closed when ctx ends.
+func RemoteSource[T any](ctx context.Context, r *Registry, topics Topics, name string, c codec.Codec[T]) devices.Source[T] {
+	d := newRemote(r, topics, name, c)
+	d.subscribe(ctx)
+	return d
+}
+
+// RemoteSink returns a Sink for device name on the station whose topics
+// are given. Values sent to In are published until ctx ends.
+func RemoteSink[T any](ctx context.Context, r *Registry, topics Topics, name string, c codec.Codec[T]) devices.Sink[T] {
+	d := newRemote(r, topics, name, c)
+	d.forward(ctx)
+	return d
+}
+
+// RemoteDuplex is RemoteSource and RemoteSink for one device.
+func RemoteDuplex[T any](ctx context.Context, r *Registry, topics Topics, name string, c codec.Codec[T]) *Remote[T] {
+	d := newRemote(r, topics, name, c)
+	d.subscribe(ctx)
+	d.forward(ctx)
+	return d
+}
+
+func newRemote[T any](r *Registry, topics Topics, name string, c codec.Codec[T]) *Remote[T] {
+	return &Remote[T]{
+		Base:   devices.NewBase(name, 1),
+		r:      r,
+		topics: topics,
+		c:      c,
+		out:    make(chan T, DefaultRemoteBuffer),
+		in:     make(chan T, DefaultRemoteBuffer),
+	}
+}
+
+// Out returns the device's decoded state values. When the buffer is
+// full the oldest value is dropped, so a slow reader sees the latest.
+func (d *Remote[T]) Out() <-chan T { return d.out }
+
+// In accepts values to publish on the device's set topic.
+func (d *Remote[T]) In() chan<- T { return d.in }
+
+// Run waits for ctx to end; the device is driven by the ctx it was
+// built with.
+func (d *Remote[T]) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// Close drops the state subscription and closes Out and Events.
+func (d *Remote[T]) Close() error {
+	d.stop()
+	return d.Base.Close()
+}
+
+// subscribe follows the remote state topic until ctx ends.
+func (d *Remote[T]) subscribe(ctx context.Context) {
+	name := d.Name()
+	topic := d.topics.State(name)
+	sub := d.r.WantSub(topic, d.r.QoSState, func(m Message) {
+		// An empty retained payload clears the topic (see ClearRetained).
+		if len(m.Payload) == 0 {
+			return
+		}
+		v, err := d.c.Unmarshal(m.Payload)
+		if err != nil {
+			d.r.Log.Warn("remote state unmarshal failed", "device", name, "topic", m.Topic, "error", err)
+			return
+		}
+		d.r.cacheState(name, m.Payload, v)
+		d.send(v)
+	})
+
+	d.mu.Lock()
+	d.sub = sub
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		sub.Unsubscribe()
+		return
+	}
+	context.AfterFunc(ctx, d.stop)
+}
+
+func (d *Remote[T]) send(v T) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for {
+		select {
+		case d.out <- v:
+			return
+		default:
+		}
+		select {
+		case <-d.out:
+		default:
+		}
+	}
+}
+
+// stop closes Out and unsubscribes. It is safe to call more than once.
+func (d *Remote[T]) stop() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.out)
+	sub := d.sub
+	d.mu.Unlock()
+
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+}
+
+// forward publishes values sent to In on the remote set topic until ctx
+// ends.
+func (d *Remote[T]) forward(ctx context.Context) {
+	name := d.Name()
+	topic := d.topics.Set(name)
+	go func() {
+		for {
+			select {
+			case v := <-d.in:
+				b, err := d.c.Marshal(v)
+				if err != nil {
+					d.r.Log.Warn("remote set marshal failed", "device", name, "error", err)
+					d.r.Metrics.marshalError(name)
+					continue
+				}
+				msg := Message{Topic: topic, Payload: b, QoS: d.r.QoSSet}
+				if ct, ok := d.c.(codec.ContentTyper); ok {
+					msg.Properties = &Properties{ContentType: ct.ContentType()}
+				}
+				if err := d.r.publish(ctx, name, msg); err != nil {
+					d.r.Log.Error("failed to publish", "topic", topic, "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteDuplex(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	// Two stations on one broker.
+	broker := newLoopMQTT()
+	shedTopics := StationScheme{Prefix: "otto", Station: "shed"}
+	shed := NewRegistry(broker, shedTopics)
+	garden := NewRegistry(broker, StationScheme{Prefix: "otto", Station: "garden"})
+	shed.ResubscribeAll(ctx)
+	garden.ResubscribeAll(ctx)
+
+	// Remote state is the shed's to report, not the garden's.
+	store := &recordingStore{}
+	garden.Store = store
+	garden.OnState(func(name string, _ []byte, _ any) { t.Errorf("state hook for remote %q", name) })
+	w := garden.WatchAll()
+	t.Cleanup(w.Stop)
+
+	relay := valve{Sink: testutils.NewSink[bool]("relay", 1), state: testutils.NewSource[bool]("relay", 1)}
+	WireDuplex(ctx, shed, relay, codec.JSON[bool]{})
+
+	remoteCtx, stop := context.WithCancel(ctx)
+	remote := RemoteDuplex(remoteCtx, garden, shedTopics, "relay", codec.JSON[bool]{})
+	assert.Equal(t, "relay", remote.Name())
+
+	remote.In() <- true
+	got, ok := testutils.WaitRecv(relay.Get(), time.Second)
+	require.True(t, ok)
+	assert.True(t, got)
+
+	relay.state.Set() <- true
+	got, ok = testutils.WaitRecv(remote.Out(), time.Second)
+	require.True(t, ok)
+	assert.True(t, got)
+	cur, ok := StateAs[bool](garden, "relay")
+	assert.True(t, ok && cur, "remote state is cached")
+	assert.True(t, testutils.WaitNoRecv(w.C, 20*time.Millisecond), "watchers see remote state")
+	assert.Empty(t, store.saved())
+
+	// Undecodable state is skipped.
+	require.NoError(t, broker.Publish(ctx, "otto/shed/relay/state", []byte("on"), true, 0))
+	assert.True(t, testutils.WaitNoRecv(remote.Out(), 20*time.Millisecond))
+
+	stop()
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		_, ok := <-remote.Out()
+		if ok {
+			return errors.New("out still open")
+		}
+		return nil
+	}))
+	assert.NotContains(t, garden.subs.Filters(), "otto/shed/relay/state")
+}
+
+func TestRemoteSourceKeepsLatest(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	broker := newLoopMQTT()
+	reg := NewRegistry(broker, TopicScheme{Prefix: "otto"})
+	reg.ResubscribeAll(ctx)
+	src := RemoteSource(ctx, reg, FlatScheme{Prefix: "pi2"}, "level", codec.JSON[int]{})
+
+	for v := range DefaultRemoteBuffer + 4 {
+		require.NoError(t, broker.Publish(ctx, "pi2/level/state", []byte(strconv.Itoa(v)), false, 0))
+	}
+	var got []int
+	for len(got) < DefaultRemoteBuffer {
+		v, ok := testutils.WaitRecv(src.Out(), time.Second)
+		require.True(t, ok)
+		got = append(got, v)
+	}
+	assert.Equal(t, 4, got[0], "oldest values dropped")
+	assert.Equal(t, DefaultRemoteBuffer+3, got[len(got)-1])
+
+	require.NoError(t, src.Close())
+	_, ok := <-src.Out()
+	assert.False(t, ok)
+}
+
+// recordingStore is a StateStore that records the devices saved.
+type recordingStore struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *recordingStore) Load() (map[string]StateRecord, error) { return nil, nil }
+
+func (s *recordingStore) Save(name string, _ StateRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, name)
+	return nil
+}
+
+func (s *recordingStore) Delete(string) error { return nil }
+
+func (s *recordingStore) saved() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.names...)
+}
@@ -0,0 +1,263 @@
+package messenger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RPCHandler serves one RPC method for a device. args holds the
+// JSON-encoded arguments (nil when none were sent); a non-nil result is
+// JSON-encoded into the reply.
+type RPCHandler func(ctx context.Context, args json.RawMessage) (any, error)
+
+// ErrUnknownMethod is reported to callers of a method with no handler.
+var ErrUnknownMethod = errors.New("unknown rpc method")
+
+// RPCError is returned by Call when the remote handler reports an error.
+type RPCError struct {
+	Device string
+	Method string
+	Msg    string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %s.%s: %s", e.Device, e.Method, e.Msg)
+}
+
+// Handle registers fn to serve method on device's RPC topic. Like
+// WantSub, the subscription is applied by ResubscribeAll.
+func (r *Registry) Handle(device, method string, fn RPCHandler) {
+	r.handle(device, method, fn, true)
+}
+
+// handle registers fn and, when serve is set, subscribes to device's RPC
+// topic unless already subscribed. Methods registered without serve are
+// still called by Set, and over MQTT once another method subscribes.
+func (r *Registry) handle(device, method string, fn RPCHandler, serve bool) {
+	r.rpcMu.Lock()
+	methods, ok := r.rpcHandlers[device]
+	if !ok {
+		methods = map[string]RPCHandler{}
+		r.rpcHandlers[device] = methods
+	}
+	methods[method] = fn
+	subscribe := serve && !r.rpcServed[device]
+	if subscribe {
+		r.rpcServed[device] = true
+	}
+	r.rpcMu.Unlock()
+
+	if subscribe {
+		r.wantDeviceSub(device, r.Topics.RPC(device), r.QoSSet, func(m Message) { r.serveRPC(device, m) })
+	}
+}
+
+func (r *Registry) serveRPC(device string, m Message) {
+	var req RPCRequest
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		r.Log.Warn("rpc request unmarshal failed", "device", device, "topic", m.Topic, "error", err)
+		return
+	}
+	// MQTT 5 callers may carry routing in properties instead of the body.
+	if p := m.Properties; p != nil {
+		if req.ReplyTo == "" {
+			req.ReplyTo = p.ResponseTopic
+		}
+		if req.ID == "" {
+			req.ID = string(p.CorrelationData)
+		}
+	}
+
+	r.rpcMu.Lock()
+	fn := r.rpcHandlers[device][req.Method]
+	r.rpcMu.Unlock()
+
+	// Run off the MQTT callback path so slow handlers don't stall delivery.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), r.rpcTimeout())
+		defer cancel()
+
+		var (
+			result any
+			err    error
+		)
+		if fn == nil {
+			err = fmt.Errorf("%w %q", ErrUnknownMethod, req.Method)
+		} else {
+			result, err = fn(ctx, req.Args)
+		}
+
+		if req.ReplyTo == "" {
+			if err != nil {
+				r.Log.Warn("rpc failed", "device", device, "method", req.Method, "error", err)
+			}
+			return
+		}
+
+		resp := RPCResponse{ID: req.ID, Time: time.Now()}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if result != nil {
+			b, merr := json.Marshal(result)
+			if merr != nil {
+				resp.Error = merr.Error()
+			} else {
+				resp.Result = b
+			}
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			r.Log.Warn("rpc response marshal failed", "device", device, "error", err)
+			return
+		}
+		msg := Message{
+			Topic:      req.ReplyTo,
+			Payload:    b,
+			QoS:        r.QoSSet,
+			Properties: &Properties{ContentType: "application/json", CorrelationData: []byte(req.ID)},
+		}
+		if err := PublishMessage(ctx, r.MQTT, msg); err != nil {
+			r.Log.Error("rpc reply publish failed", "device", device, "topic", req.ReplyTo, "error", err)
+		}
+	}()
+}
+
+// Call invokes method on device and waits for its reply. args is
+// JSON-encoded; the raw JSON result is returned. A handler error is
+// returned as *RPCError. If ctx has no deadline, RPCTimeout applies.
+func (r *Registry) Call(ctx context.Context, device, method string, args any) (json.RawMessage, error) {
+	var raw json.RawMessage
+	if args != nil {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("rpc %s.%s: marshal args: %w", device, method, err)
+		}
+		raw = b
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.rpcTimeout())
+		defer cancel()
+	}
+
+	reply, err := r.replyTopic(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("rpc %s.%s: subscribe reply: %w", device, method, err)
+	}
+
+	id := newCorrelationID()
+	ch := make(chan RPCResponse, 1)
+	r.rpcMu.Lock()
+	r.rpcPending[id] = ch
+	r.rpcMu.Unlock()
+	defer func() {
+		r.rpcMu.Lock()
+		delete(r.rpcPending, id)
+		r.rpcMu.Unlock()
+	}()
+
+	b, err := json.Marshal(RPCRequest{ID: id, Method: method, Args: raw, ReplyTo: reply})
+	if err != nil {
+		return nil, err
+	}
+	msg := Message{
+		Topic:   r.Topics.RPC(device),
+		Payload: b,
+		QoS:     r.QoSSet,
+		Properties: &Properties{
+			ContentType:     "application/json",
+			ResponseTopic:   reply,
+			CorrelationData: []byte(id),
+		},
+	}
+	if err := PublishMessage(ctx, r.MQTT, msg); err != nil {
+		return nil, fmt.Errorf("rpc %s.%s: %w", device, method, err)
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return nil, &RPCError{Device: device, Method: method, Msg: resp.Error}
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rpc %s.%s: %w", device, method, ctx.Err())
+	}
+}
+
+// CallAs invokes method on device and decodes the result as T.
+func CallAs[T any](ctx context.Context, r *Registry, device, method string, args any) (T, error) {
+	var v T
+	raw, err := r.Call(ctx, device, method, args)
+	if err != nil {
+		return v, err
+	}
+	if len(raw) == 0 {
+		return v, nil
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return v, fmt.Errorf("rpc %s.%s: decode result: %w", device, method, err)
+	}
+	return v, nil
+}
+
+// replyTopic returns this registry's reply topic, subscribing on first use.
+func (r *Registry) replyTopic(ctx context.Context) (string, error) {
+	r.rpcReplyMu.Lock()
+	defer r.rpcReplyMu.Unlock()
+
+	if r.rpcReply != "" {
+		return r.rpcReply, nil
+	}
+
+	topic := r.Topics.Reply(newCorrelationID())
+	if _, err := r.subs.Subscribe(ctx, topic, r.QoSSet, r.handleReply); err != nil {
+		return "", err
+	}
+
+	r.rpcReply = topic
+	return topic, nil
+}
+
+func (r *Registry) handleReply(m Message) {
+	var resp RPCResponse
+	if err := json.Unmarshal(m.Payload, &resp); err != nil {
+		r.Log.Warn("rpc reply unmarshal failed", "topic", m.Topic, "error", err)
+		return
+	}
+	if resp.ID == "" && m.Properties != nil {
+		resp.ID = string(m.Properties.CorrelationData)
+	}
+
+	r.rpcMu.Lock()
+	ch, ok := r.rpcPending[resp.ID]
+	r.rpcMu.Unlock()
+	if !ok {
+		// late or duplicate reply
+		return
+	}
+	select {
+	case ch <- resp:
+	default:
+	}
+}
+
+func (r *Registry) rpcTimeout() time.Duration {
+	if r.RPCTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return r.RPCTimeout
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,209 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loopMQTT routes publishes to its own subscriptions, like a broker with
+// a single client.
+type loopMQTT struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]subSpec
+}
+
+func newLoopMQTT() *loopMQTT { return &loopMQTT{subs: map[int]subSpec{}} }
+
+func (m *loopMQTT) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	return m.PublishMessage(ctx, Message{Topic: topic, Payload: payload, Retain: retain, QoS: qos})
+}
+
+func (m *loopMQTT) PublishMessage(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	var handlers []func(Message)
+	for _, s := range m.subs {
+		if MatchTopic(s.topic, msg.Topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	m.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (m *loopMQTT) Subscribe(ctx context.Context, topic string, qos byte, handler func(Message)) (func() error, error) {
+	m.mu.Lock()
+	m.nextID++
+	id := m.nextID
+	m.subs[id] = subSpec{topic: topic, qos: qos, handler: handler}
+	m.mu.Unlock()
+	return func() error {
+		m.mu.Lock()
+		delete(m.subs, id)
+		m.mu.Unlock()
+		return nil
+	}, nil
+}
+
+func (m *loopMQTT) SetWill(topic string, payload []byte, retain bool, qos byte) error { return nil }
+
+func TestRPCCallReturnsResult(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newLoopMQTT(), TopicScheme{Prefix: "otto"})
+	reg.Handle("pump", "add", func(_ context.Context, args json.RawMessage) (any, error) {
+		var in []int
+		if err := json.Unmarshal(args, &in); err != nil {
+			return nil, err
+		}
+		return in[0] + in[1], nil
+	})
+	reg.ResubscribeAll(ctx)
+
+	got, err := CallAs[int](ctx, reg, "pump", "add", []int{2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, 5, got)
+
+	// The reply subscription is reused for later calls.
+	got, err = CallAs[int](ctx, reg, "pump", "add", []int{4, 4})
+	require.NoError(t, err)
+	assert.Equal(t, 8, got)
+}
+
+func TestRPCCallHandlerError(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newLoopMQTT(), TopicScheme{Prefix: "otto"})
+	reg.Handle("pump", "prime", func(context.Context, json.RawMessage) (any, error) {
+		return nil, errors.New("dry run")
+	})
+	reg.ResubscribeAll(ctx)
+
+	_, err := reg.Call(ctx, "pump", "prime", nil)
+	var rpcErr *RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, "pump", rpcErr.Device)
+	assert.Equal(t, "prime", rpcErr.Method)
+	assert.Equal(t, "dry run", rpcErr.Msg)
+
+	_, err = reg.Call(ctx, "pump", "nope", nil)
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Contains(t, rpcErr.Msg, ErrUnknownMethod.Error())
+}
+
+func TestRPCCallTimesOutWithoutServer(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(newLoopMQTT(), TopicScheme{Prefix: "otto"})
+	reg.RPCTimeout = 50 * time.Millisecond
+
+	_, err := reg.Call(context.Background(), "ghost", "set", true)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRPCSetThroughWireSink(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newLoopMQTT(), TopicScheme{Prefix: "otto"})
+	reg.CommandTimeout = 50 * time.Millisecond
+	reg.SetRPC = true
+	sink := testutils.NewSink[int]("relay", 1)
+	WireSink(ctx, reg, sink, codec.JSON[int]{})
+	reg.ResubscribeAll(ctx)
+
+	_, err := reg.Call(ctx, "relay", "set", 7)
+	require.NoError(t, err)
+	got, ok := sink.TryRead()
+	require.True(t, ok)
+	assert.Equal(t, 7, got)
+
+	_, err = reg.Call(ctx, "relay", "set", "seven")
+	var rpcErr *RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Contains(t, rpcErr.Msg, "set unmarshal")
+
+	// Fill the sink so the next set cannot be delivered.
+	sink.In() <- 1
+	_, err = reg.Call(ctx, "relay", "set", 2)
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Equal(t, ErrSetTimeout.Error(), rpcErr.Msg)
+}
+
+func TestRPCSetNotServedByDefault(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	sink := testutils.NewSink[int]("relay", 1)
+	WireSink(ctx, reg, sink, codec.JSON[int]{})
+	reg.ResubscribeAll(ctx)
+
+	_, _, subs, _ := mqtt.snapshot()
+	assert.Equal(t, 1, subs["otto/devices/relay/set"])
+	assert.Zero(t, subs["otto/devices/relay/rpc"])
+
+	require.NoError(t, reg.Set(ctx, "relay", []byte("7")))
+	got, ok := sink.TryRead()
+	require.True(t, ok)
+	assert.Equal(t, 7, got)
+
+	// Another method subscribes the RPC topic once.
+	reg.Handle("relay", "ping", func(context.Context, json.RawMessage) (any, error) { return nil, nil })
+	reg.Handle("relay", "pong", func(context.Context, json.RawMessage) (any, error) { return nil, nil })
+	_, _, subs, _ = mqtt.snapshot()
+	assert.Equal(t, 1, subs["otto/devices/relay/rpc"])
+}
+
+func TestRPCServeUsesPropertiesForRouting(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newLoopMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Handle("lamp", "ping", func(context.Context, json.RawMessage) (any, error) { return "pong", nil })
+	reg.ResubscribeAll(ctx)
+
+	replies := make(chan Message, 1)
+	_, err := mqtt.Subscribe(ctx, "client/reply", 1, func(m Message) { replies <- m })
+	require.NoError(t, err)
+
+	require.NoError(t, mqtt.PublishMessage(ctx, Message{
+		Topic:      "otto/devices/lamp/rpc",
+		Payload:    []byte(`{"method":"ping"}`),
+		Properties: &Properties{ResponseTopic: "client/reply", CorrelationData: []byte("c-1")},
+	}))
+
+	m, ok := testutils.WaitRecv(replies, time.Second)
+	require.True(t, ok)
+	var resp RPCResponse
+	require.NoError(t, json.Unmarshal(m.Payload, &resp))
+	assert.Equal(t, "c-1", resp.ID)
+	assert.JSONEq(t, `"pong"`, string(resp.Result))
+	assert.Equal(t, []byte("c-1"), m.Properties.CorrelationData)
+}
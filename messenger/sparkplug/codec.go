@@ -0,0 +1,74 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Codec encodes a T as a Sparkplug B payload holding a single metric.
+// It implements codec.Codec[T] for use with the Wire* helpers.
+type Codec[T any] struct {
+	// Metric names the metric. Defaults to "value".
+	Metric string
+}
+
+// ContentType returns the protobuf content type.
+func (Codec[T]) ContentType() string { return "application/x-protobuf" }
+
+// Marshal encodes v as one metric. It leaves out timestamps so equal
+// values encode to equal bytes, which publish policies and acks compare.
+func (c Codec[T]) Marshal(v T) ([]byte, error) {
+	m := Metric{Name: c.metric()}
+	m.Datatype, m.Value = metricValue(0, v)
+	return Payload{Metrics: []Metric{m}}.Marshal()
+}
+
+// Unmarshal decodes the named metric (or the only metric) into a T.
+func (c Codec[T]) Unmarshal(b []byte) (T, error) {
+	var zero T
+	p, err := Unmarshal(b)
+	if err != nil {
+		return zero, err
+	}
+
+	var m *Metric
+	for i := range p.Metrics {
+		if p.Metrics[i].Name == c.metric() || len(p.Metrics) == 1 {
+			m = &p.Metrics[i]
+			break
+		}
+	}
+	if m == nil {
+		return zero, errors.New("sparkplug: metric " + c.metric() + " not found")
+	}
+	if m.IsNull {
+		return zero, nil
+	}
+	if v, ok := m.Value.(T); ok {
+		return v, nil
+	}
+
+	// Convert between numeric widths, and decode values that were sent
+	// as JSON strings, via JSON.
+	raw, err := json.Marshal(m.Value)
+	if err != nil {
+		return zero, err
+	}
+	var v T
+	if err := json.Unmarshal(raw, &v); err == nil {
+		return v, nil
+	}
+	if s, ok := m.Value.(string); ok {
+		if err := json.Unmarshal([]byte(s), &v); err == nil {
+			return v, nil
+		}
+	}
+	return zero, errors.New("sparkplug: cannot decode metric " + m.Name)
+}
+
+func (c Codec[T]) metric() string {
+	if c.Metric == "" {
+		return "value"
+	}
+	return c.Metric
+}
@@ -0,0 +1,406 @@
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is a Sparkplug B metric data type.
+type DataType uint32
+
+// Sparkplug B data types used by otto.
+const (
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	Bytes    DataType = 17
+)
+
+// Payload is a Sparkplug B payload. Only the fields otto uses are
+// modelled; unknown fields are skipped when decoding.
+type Payload struct {
+	Timestamp uint64
+	Metrics   []Metric
+	Seq       *uint64 // nil for NDEATH, which carries no sequence number
+	UUID      string
+	Body      []byte
+}
+
+// Metric is one Sparkplug B metric.
+//
+// Value holds int64 for signed types, uint64 for unsigned types and
+// DateTime, float32 for Float, float64 for Double, bool, string, or
+// []byte, and is ignored when IsNull is set.
+type Metric struct {
+	Name       string
+	Timestamp  uint64
+	Datatype   DataType
+	IsNull     bool
+	Properties *PropertySet
+	Value      any
+}
+
+// PropertySet holds metric properties such as engUnit.
+type PropertySet struct {
+	Keys   []string
+	Values []PropertyValue
+}
+
+// PropertyValue is one metric property. Value follows Metric.Value.
+type PropertyValue struct {
+	Type   DataType
+	IsNull bool
+	Value  any
+}
+
+// Uint64 returns a pointer to v, for Payload.Seq.
+func Uint64(v uint64) *uint64 { return &v }
+
+// Marshal encodes p in protobuf wire format.
+func (p Payload) Marshal() ([]byte, error) {
+	var b []byte
+	if p.Timestamp != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Timestamp)
+	}
+	for _, m := range p.Metrics {
+		mb, err := m.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	if p.Seq != nil {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, *p.Seq)
+	}
+	if p.UUID != "" {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, p.UUID)
+	}
+	if p.Body != nil {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Body)
+	}
+	return b, nil
+}
+
+func (m Metric) marshal() ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Datatype))
+	if m.IsNull {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if m.Properties != nil {
+		pb, err := m.Properties.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+	if m.IsNull {
+		return b, nil
+	}
+	b, err := appendValue(b, 10, m.Datatype, m.Value)
+	if err != nil {
+		return nil, fmt.Errorf("sparkplug: metric %q: %w", m.Name, err)
+	}
+	return b, nil
+}
+
+func (ps PropertySet) marshal() ([]byte, error) {
+	if len(ps.Keys) != len(ps.Values) {
+		return nil, errors.New("sparkplug: property keys and values differ in length")
+	}
+	var b []byte
+	for _, k := range ps.Keys {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+	}
+	for _, v := range ps.Values {
+		var vb []byte
+		vb = protowire.AppendTag(vb, 1, protowire.VarintType)
+		vb = protowire.AppendVarint(vb, uint64(v.Type))
+		if v.IsNull {
+			vb = protowire.AppendTag(vb, 2, protowire.VarintType)
+			vb = protowire.AppendVarint(vb, 1)
+		} else {
+			var err error
+			if vb, err = appendValue(vb, 3, v.Type, v.Value); err != nil {
+				return nil, err
+			}
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, vb)
+	}
+	return b, nil
+}
+
+// appendValue encodes v in the value oneof starting at field base
+// (int_value); Metric and PropertyValue share the same field layout.
+func appendValue(b []byte, base protowire.Number, t DataType, v any) ([]byte, error) {
+	switch t {
+	case Int8, Int16, Int32, UInt8, UInt16, UInt32:
+		n, ok := toUint64(v)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not an integer", v)
+		}
+		b = protowire.AppendTag(b, base, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(uint32(n))), nil
+	case Int64, UInt64, DateTime:
+		n, ok := toUint64(v)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not an integer", v)
+		}
+		b = protowire.AppendTag(b, base+1, protowire.VarintType)
+		return protowire.AppendVarint(b, n), nil
+	case Float:
+		f, ok := v.(float32)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not a float32", v)
+		}
+		b = protowire.AppendTag(b, base+2, protowire.Fixed32Type)
+		return protowire.AppendFixed32(b, math.Float32bits(f)), nil
+	case Double:
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not a float64", v)
+		}
+		b = protowire.AppendTag(b, base+3, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(f)), nil
+	case Boolean:
+		f, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not a bool", v)
+		}
+		b = protowire.AppendTag(b, base+4, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(f)), nil
+	case String, Text:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not a string", v)
+		}
+		b = protowire.AppendTag(b, base+5, protowire.BytesType)
+		return protowire.AppendString(b, s), nil
+	case Bytes:
+		if base != 10 {
+			return nil, errors.New("bytes properties are not supported")
+		}
+		raw, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("value %T is not []byte", v)
+		}
+		b = protowire.AppendTag(b, 16, protowire.BytesType)
+		return protowire.AppendBytes(b, raw), nil
+	}
+	return nil, fmt.Errorf("unsupported datatype %d", t)
+}
+
+func toUint64(v any) (uint64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	}
+	return 0, false
+}
+
+// Unmarshal decodes a Sparkplug B payload.
+func Unmarshal(b []byte) (Payload, error) {
+	var p Payload
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.Timestamp = v
+		case num == 2 && typ == protowire.BytesType:
+			m, err := unmarshalMetric(raw)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case num == 3 && typ == protowire.VarintType:
+			p.Seq = Uint64(v)
+		case num == 4 && typ == protowire.BytesType:
+			p.UUID = string(raw)
+		case num == 5 && typ == protowire.BytesType:
+			p.Body = append([]byte(nil), raw...)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// rawValue is an undecoded value oneof field.
+type rawValue struct {
+	field protowire.Number // relative to int_value: 0..6
+	num   uint64
+	bytes []byte
+}
+
+func unmarshalMetric(b []byte) (Metric, error) {
+	var (
+		m   Metric
+		val *rawValue
+	)
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Name = string(raw)
+		case num == 3 && typ == protowire.VarintType:
+			m.Timestamp = v
+		case num == 4 && typ == protowire.VarintType:
+			m.Datatype = DataType(v)
+		case num == 7 && typ == protowire.VarintType:
+			m.IsNull = v != 0
+		case num == 9 && typ == protowire.BytesType:
+			ps, err := unmarshalPropertySet(raw)
+			if err != nil {
+				return err
+			}
+			m.Properties = &ps
+		case num >= 10 && num <= 16:
+			val = &rawValue{field: num - 10, num: v, bytes: raw}
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if val != nil && !m.IsNull {
+		m.Value = decodeValue(m.Datatype, *val)
+	}
+	return m, nil
+}
+
+func unmarshalPropertySet(b []byte) (PropertySet, error) {
+	var ps PropertySet
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ps.Keys = append(ps.Keys, string(raw))
+		case num == 2 && typ == protowire.BytesType:
+			var (
+				pv  PropertyValue
+				val *rawValue
+			)
+			err := walk(raw, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					pv.Type = DataType(v)
+				case num == 2 && typ == protowire.VarintType:
+					pv.IsNull = v != 0
+				case num >= 3 && num <= 8:
+					val = &rawValue{field: num - 3, num: v, bytes: raw}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if val != nil && !pv.IsNull {
+				pv.Value = decodeValue(pv.Type, *val)
+			}
+			ps.Values = append(ps.Values, pv)
+		}
+		return nil
+	})
+	return ps, err
+}
+
+func decodeValue(t DataType, v rawValue) any {
+	switch v.field {
+	case 0: // int_value (uint32)
+		switch t {
+		case Int8:
+			return int64(int8(v.num))
+		case Int16:
+			return int64(int16(v.num))
+		case Int32:
+			return int64(int32(v.num))
+		}
+		return uint64(uint32(v.num))
+	case 1: // long_value
+		if t == Int64 {
+			return int64(v.num)
+		}
+		return v.num
+	case 2:
+		return math.Float32frombits(uint32(v.num))
+	case 3:
+		return math.Float64frombits(v.num)
+	case 4:
+		return protowire.DecodeBool(v.num)
+	case 5:
+		return string(v.bytes)
+	case 6:
+		return append([]byte(nil), v.bytes...)
+	}
+	return nil
+}
+
+// walk calls fn for each field in b. Varint and fixed values are passed
+// in v, length-delimited values in raw.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var (
+			v   uint64
+			raw []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			v = uint64(f)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
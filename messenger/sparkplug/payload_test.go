@@ -0,0 +1,126 @@
+package sparkplug
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const ts = uint64(1700000000000)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestPayloadGolden(t *testing.T) {
+	t.Parallel()
+
+	p := Payload{Timestamp: ts, Seq: Uint64(3), Metrics: []Metric{
+		{Name: "temperature", Timestamp: ts, Datatype: Double, Value: 21.5},
+	}}
+	b, err := p.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, "0880d095ffbc31121f0a0b74656d70657261747572651880d095ffbc31200a6900000000008035401803", hex.EncodeToString(b))
+
+	got, err := Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, p, got)
+}
+
+func TestPayloadRoundTripTypes(t *testing.T) {
+	t.Parallel()
+
+	p := Payload{
+		Timestamp: ts,
+		Seq:       Uint64(255),
+		UUID:      "otto",
+		Body:      []byte{1, 2},
+		Metrics: []Metric{
+			{Name: "i8", Datatype: Int8, Value: int64(-5)},
+			{Name: "i32", Datatype: Int32, Value: int64(-70000)},
+			{Name: "i64", Datatype: Int64, Value: int64(-1)},
+			{Name: "u16", Datatype: UInt16, Value: uint64(65535)},
+			{Name: "u64", Datatype: UInt64, Value: uint64(1 << 40)},
+			{Name: "f", Datatype: Float, Value: float32(1.5)},
+			{Name: "d", Datatype: Double, Value: -0.25},
+			{Name: "b", Datatype: Boolean, Value: true},
+			{Name: "s", Datatype: String, Value: "on"},
+			{Name: "raw", Datatype: Bytes, Value: []byte("x")},
+			{Name: "null", Datatype: Double, IsNull: true},
+			{
+				Name: "props", Datatype: Boolean, Value: false,
+				Properties: &PropertySet{
+					Keys:   []string{"engUnit", "engHigh"},
+					Values: []PropertyValue{{Type: String, Value: "C"}, {Type: Double, Value: 100.0}},
+				},
+			},
+		},
+	}
+	b, err := p.Marshal()
+	require.NoError(t, err)
+	got, err := Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, p, got)
+}
+
+func TestPayloadErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := Payload{Metrics: []Metric{{Name: "x", Datatype: Double, Value: "nope"}}}.Marshal()
+	assert.Error(t, err)
+
+	_, err = Unmarshal([]byte{0x12, 0x05, 0x0a})
+	assert.Error(t, err)
+
+	// Unknown fields (alias = 2) are skipped.
+	m := protowire.AppendTag(nil, 2, protowire.VarintType)
+	m = protowire.AppendVarint(m, 7)
+	m = protowire.AppendTag(m, 4, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(Boolean))
+	b := protowire.AppendTag(nil, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, m)
+	got, err := Unmarshal(b)
+	require.NoError(t, err)
+	require.Len(t, got.Metrics, 1)
+	assert.Equal(t, Boolean, got.Metrics[0].Datatype)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	b, err := Codec[float64]{}.Marshal(21.5)
+	require.NoError(t, err)
+	f, err := Codec[float64]{}.Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, 21.5, f)
+
+	// Equal values encode to equal bytes, whenever they are encoded.
+	time.Sleep(2 * time.Millisecond)
+	again, err := Codec[float64]{}.Marshal(21.5)
+	require.NoError(t, err)
+	assert.Equal(t, b, again)
+
+	type reading struct {
+		C float64 `json:"c"`
+	}
+	rc := Codec[reading]{Metric: "reading"}
+	b, err = rc.Marshal(reading{C: 3})
+	require.NoError(t, err)
+	r, err := rc.Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, reading{C: 3}, r)
+
+	// Widths convert: an Int64 metric decodes into an int.
+	b, err = Payload{Metrics: []Metric{{Name: "value", Datatype: Int64, Value: int64(7)}}}.Marshal()
+	require.NoError(t, err)
+	n, err := Codec[int]{}.Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+}
@@ -0,0 +1,496 @@
+// Package sparkplug runs a Registry as a Sparkplug B edge node.
+//
+// Each otto device with a descriptor becomes a Sparkplug device with a
+// single metric. The node publishes NBIRTH and DBIRTH from the
+// descriptors, DDATA for every WireSource state update, routes DCMD
+// writes into WireSink through Registry.Set, and registers NDEATH as its
+// will (see Node.SetWill). Topics follow spBv1.0/<group>/<type>/<node>[/<device>].
+package sparkplug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/messenger"
+)
+
+// Namespace is the Sparkplug B topic namespace.
+const Namespace = "spBv1.0"
+
+// Message types.
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	NDATA  = "NDATA"
+	DDATA  = "DDATA"
+	NCMD   = "NCMD"
+	DCMD   = "DCMD"
+)
+
+// Node-level metric names.
+const (
+	MetricBdSeq   = "bdSeq"
+	MetricRebirth = "Node Control/Rebirth"
+)
+
+// Node is a Sparkplug B edge node backed by a Registry.
+type Node struct {
+	Registry *messenger.Registry
+	GroupID  string
+	NodeID   string
+
+	// Now returns the current time; tests override it for stable payloads.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	bdSeq   uint64 // carried by the registered will
+	born    bool   // NBIRTH sent with bdSeq
+	running bool
+	seq     uint64
+	online  bool
+	devs    map[string]device // by otto device name
+
+	// Publishes stamped with seq, sent in order by a single goroutine
+	// so state hooks never wait on the network. Guarded by mu.
+	out     []outMsg
+	sending bool
+}
+
+// outMsg is a queued publish. done, when set, receives its result.
+type outMsg struct {
+	device  string // otto device, "" for node messages
+	topic   string
+	payload []byte
+	qos     byte
+	done    chan error
+}
+
+// device is an otto device as a Sparkplug device with one metric.
+type device struct {
+	metric   string
+	datatype DataType
+	desc     devices.Descriptor
+}
+
+// New returns an edge node for r.
+func New(r *messenger.Registry, groupID, nodeID string) *Node {
+	return &Node{Registry: r, GroupID: groupID, NodeID: nodeID, Now: time.Now}
+}
+
+// Topic returns the Sparkplug topic for a message type; deviceID is
+// empty for node-level messages.
+func (n *Node) Topic(msgType, deviceID string) string {
+	return path.Join(Namespace, n.GroupID, msgType, n.NodeID, deviceID)
+}
+
+// Wire registers the state observer that publishes DDATA, the NCMD
+// and DCMD subscriptions and the connect hook that repeats the births
+// for each new session. Like other Registry subscriptions they are
+// applied by ResubscribeAll, so call Wire before connecting.
+func (n *Node) Wire() {
+	r := n.Registry
+	n.refresh()
+
+	r.OnState(func(name string, _ []byte, v any) { n.publishData(name, v) })
+	r.OnConnect(n.connected)
+	r.WantSub(n.Topic(NCMD, ""), 0, n.handleNCMD)
+	r.WantSub(n.Topic(DCMD, "+"), 0, n.handleDCMD)
+}
+
+// SetWill registers NDEATH as the connection's will. Sparkplug hosts
+// watch NDEATH, so it takes the place of Registry.SetStationWill; call
+// it before connecting. Every session needs a new bdSeq, so once a
+// birth has gone out under the current will SetWill moves to the next
+// one. With clients that reconnect on their own, call it again before
+// each reconnect:
+//
+//	client.SetOnReconnecting(func() { _ = node.SetWill() })
+func (n *Node) SetWill() error {
+	n.mu.Lock()
+	if n.born {
+		n.bdSeq++
+		n.born = false
+	}
+	bdSeq := n.bdSeq
+	n.mu.Unlock()
+
+	death, err := n.deathPayload(bdSeq).Marshal()
+	if err != nil {
+		return err
+	}
+	return n.Registry.MQTT.SetWill(n.Topic(NDEATH, ""), death, false, 1)
+}
+
+// Run publishes the births, repeats them whenever the Registry
+// reconnects and, when ctx ends, publishes the NDEATH that SetWill
+// registered before returning.
+func (n *Node) Run(ctx context.Context) error {
+	n.mu.Lock()
+	n.running = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.running = false
+		n.mu.Unlock()
+	}()
+
+	if err := n.Birth(ctx); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	n.mu.Lock()
+	n.online = false
+	death, err := n.deathPayload(n.bdSeq).Marshal()
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.queueLocked("", n.Topic(NDEATH, ""), death, 1, done)
+	n.mu.Unlock()
+	return <-done
+}
+
+// connected repeats the births for a new session while Run is active.
+func (n *Node) connected(ctx context.Context) {
+	n.mu.Lock()
+	running := n.running
+	n.mu.Unlock()
+	if !running {
+		return
+	}
+	if err := n.Birth(ctx); err != nil {
+		n.Registry.Log.Warn("sparkplug birth after connect failed", "error", err)
+	}
+}
+
+// Birth publishes NBIRTH, carrying the will's bdSeq, and a DBIRTH per
+// device, restarting seq at 0. It is also used to answer a rebirth
+// request.
+func (n *Node) Birth(ctx context.Context) error {
+	n.refresh()
+
+	n.mu.Lock()
+	n.seq = 0
+	now := n.millis()
+	nbirth := Payload{
+		Timestamp: now,
+		Metrics: []Metric{
+			{Name: MetricBdSeq, Timestamp: now, Datatype: UInt64, Value: n.bdSeq},
+			{Name: MetricRebirth, Timestamp: now, Datatype: Boolean, Value: false},
+		},
+	}
+	type birth struct {
+		device string
+		topic  string
+		p      Payload
+	}
+	births := []birth{{"", n.Topic(NBIRTH, ""), nbirth}}
+
+	for _, name := range slices.Sorted(maps.Keys(n.devs)) {
+		d := n.devs[name]
+		m := Metric{Name: d.metric, Timestamp: now, Datatype: d.datatype, Properties: properties(d.desc)}
+		if v, ok := n.Registry.StateAny(name); ok {
+			m.Datatype, m.Value = metricValue(d.datatype, v)
+		} else {
+			m.IsNull = true
+			if m.Datatype == 0 {
+				m.Datatype = String
+			}
+		}
+		births = append(births, birth{name, n.Topic(DBIRTH, name), Payload{Timestamp: now, Metrics: []Metric{m}}})
+	}
+
+	done := make(chan error, len(births))
+	for _, b := range births {
+		if err := n.stampLocked(b.device, b.topic, b.p, done); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	n.born = true
+	n.online = true
+	n.mu.Unlock()
+
+	var first error
+	for range births {
+		select {
+		case err := <-done:
+			if first == nil {
+				first = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return first
+}
+
+func (n *Node) publishData(name string, v any) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	d, ok := n.devs[name]
+	if !ok || !n.online {
+		return
+	}
+	now := n.millis()
+	m := Metric{Name: d.metric, Timestamp: now}
+	m.Datatype, m.Value = metricValue(d.datatype, v)
+
+	if err := n.stampLocked(name, n.Topic(DDATA, name), Payload{Timestamp: now, Metrics: []Metric{m}}, nil); err != nil {
+		n.Registry.Log.Warn("sparkplug DDATA encode failed", "device", name, "error", err)
+	}
+}
+
+func (n *Node) handleNCMD(msg messenger.Message) {
+	p, err := Unmarshal(msg.Payload)
+	if err != nil {
+		n.Registry.Log.Warn("sparkplug NCMD decode failed", "error", err)
+		return
+	}
+	for _, m := range p.Metrics {
+		if m.Name == MetricRebirth && m.Value == true {
+			go func() {
+				if err := n.Birth(context.Background()); err != nil {
+					n.Registry.Log.Warn("sparkplug rebirth failed", "error", err)
+				}
+			}()
+			return
+		}
+	}
+}
+
+func (n *Node) handleDCMD(msg messenger.Message) {
+	name := path.Base(msg.Topic)
+
+	n.mu.Lock()
+	d, ok := n.devs[name]
+	n.mu.Unlock()
+	if !ok {
+		n.Registry.Log.Warn("sparkplug DCMD for unknown device", "device", name)
+		return
+	}
+
+	p, err := Unmarshal(msg.Payload)
+	if err != nil {
+		n.Registry.Log.Warn("sparkplug DCMD decode failed", "device", name, "error", err)
+		return
+	}
+	for _, m := range p.Metrics {
+		if m.Name != d.metric || m.IsNull {
+			continue
+		}
+		// Registry.Set decodes with the sink's codec; otto sinks default
+		// to JSON, which also reads plain numbers and booleans.
+		b, err := json.Marshal(m.Value)
+		if err != nil {
+			continue
+		}
+		go func() {
+			if err := n.Registry.Set(context.Background(), name, b); err != nil {
+				n.Registry.Log.Warn("sparkplug DCMD delivery failed", "device", name, "error", err)
+			}
+		}()
+	}
+}
+
+// stampLocked stamps the next seq on p and queues it. n.mu must be held.
+func (n *Node) stampLocked(device, topic string, p Payload, done chan error) error {
+	p.Seq = Uint64(n.seq)
+	b, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	n.seq = (n.seq + 1) % 256
+	n.queueLocked(device, topic, b, 0, done)
+	return nil
+}
+
+// queueLocked queues a publish behind the earlier ones and starts the
+// sender if it is idle. n.mu must be held.
+func (n *Node) queueLocked(device, topic string, payload []byte, qos byte, done chan error) {
+	n.out = append(n.out, outMsg{device: device, topic: topic, payload: payload, qos: qos, done: done})
+	if !n.sending {
+		n.sending = true
+		go n.send()
+	}
+}
+
+// send publishes queued messages in order until the queue is empty.
+func (n *Node) send() {
+	for {
+		n.mu.Lock()
+		if len(n.out) == 0 {
+			n.sending = false
+			n.mu.Unlock()
+			return
+		}
+		batch := n.out
+		n.out = nil
+		n.mu.Unlock()
+
+		for _, m := range batch {
+			msg := messenger.Message{Topic: m.topic, Payload: m.payload, QoS: m.qos}
+			err := n.Registry.PublishFor(context.Background(), m.device, msg)
+			switch {
+			case m.done != nil:
+				m.done <- err
+			case err != nil:
+				n.Registry.Log.Warn("sparkplug publish failed", "topic", m.topic, "error", err)
+			}
+		}
+	}
+}
+
+func (n *Node) deathPayload(bdSeq uint64) Payload {
+	now := n.millis()
+	return Payload{
+		Timestamp: now,
+		Metrics:   []Metric{{Name: MetricBdSeq, Timestamp: now, Datatype: UInt64, Value: bdSeq}},
+	}
+}
+
+// refresh rebuilds the device table from the Registry's descriptors.
+func (n *Node) refresh() {
+	devs := map[string]device{}
+	for _, dev := range n.Registry.Devices() {
+		desc, ok := messenger.DescriptorOf(dev)
+		if !ok {
+			continue
+		}
+		metric := desc.Kind
+		if metric == "" {
+			metric = "value"
+		}
+		devs[dev.Name()] = device{metric: metric, datatype: datatypeOf(desc.ValueType), desc: desc}
+	}
+
+	n.mu.Lock()
+	n.devs = devs
+	n.mu.Unlock()
+}
+
+func (n *Node) millis() uint64 { return uint64(n.Now().UnixMilli()) }
+
+// datatypeOf maps a descriptor ValueType to a Sparkplug data type; 0
+// means infer from the value.
+func datatypeOf(valueType string) DataType {
+	switch valueType {
+	case "bool":
+		return Boolean
+	case "int8":
+		return Int8
+	case "int16":
+		return Int16
+	case "int32":
+		return Int32
+	case "int", "int64":
+		return Int64
+	case "uint8":
+		return UInt8
+	case "uint16":
+		return UInt16
+	case "uint32":
+		return UInt32
+	case "uint", "uint64":
+		return UInt64
+	case "float32":
+		return Float
+	case "float", "float64", "number":
+		return Double
+	case "string":
+		return String
+	}
+	return 0
+}
+
+// metricValue converts a Go state value to a Sparkplug value of type t,
+// inferring the type when t is 0. Values with no Sparkplug equivalent
+// are sent as JSON strings.
+func metricValue(t DataType, v any) (DataType, any) {
+	switch x := v.(type) {
+	case bool:
+		return Boolean, x
+	case string:
+		return String, x
+	case []byte:
+		return Bytes, x
+	case float32:
+		if t == 0 || t == Float {
+			return Float, x
+		}
+		return Double, float64(x)
+	case float64:
+		if t == Float {
+			return Float, float32(x)
+		}
+		return Double, x
+	case int:
+		return intType(t, Int64), int64(x)
+	case int8:
+		return intType(t, Int8), int64(x)
+	case int16:
+		return intType(t, Int16), int64(x)
+	case int32:
+		return intType(t, Int32), int64(x)
+	case int64:
+		return intType(t, Int64), x
+	case uint:
+		return intType(t, UInt64), uint64(x)
+	case uint8:
+		return intType(t, UInt8), uint64(x)
+	case uint16:
+		return intType(t, UInt16), uint64(x)
+	case uint32:
+		return intType(t, UInt32), uint64(x)
+	case uint64:
+		return intType(t, UInt64), x
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return String, fmt.Sprint(v)
+	}
+	return String, string(b)
+}
+
+func intType(declared, natural DataType) DataType {
+	switch declared {
+	case Int8, Int16, Int32, Int64, UInt8, UInt16, UInt32, UInt64:
+		return declared
+	}
+	return natural
+}
+
+// properties carries the descriptor's unit and range as the engUnit,
+// engLow and engHigh metric properties.
+func properties(desc devices.Descriptor) *PropertySet {
+	ps := &PropertySet{}
+	if desc.Unit != "" {
+		ps.Keys = append(ps.Keys, "engUnit")
+		ps.Values = append(ps.Values, PropertyValue{Type: String, Value: desc.Unit})
+	}
+	if desc.Min != nil {
+		ps.Keys = append(ps.Keys, "engLow")
+		ps.Values = append(ps.Values, PropertyValue{Type: Double, Value: *desc.Min})
+	}
+	if desc.Max != nil {
+		ps.Keys = append(ps.Keys, "engHigh")
+		ps.Values = append(ps.Values, PropertyValue{Type: Double, Value: *desc.Max})
+	}
+	if len(ps.Keys) == 0 {
+		return nil
+	}
+	return ps
+}
@@ -0,0 +1,249 @@
+package sparkplug
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/rustyeddy/otto/messenger/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type describedSource struct {
+	*testutils.Source[float64]
+	desc devices.Descriptor
+}
+
+func (d describedSource) Descriptor() devices.Descriptor { return d.desc }
+
+type describedSink struct {
+	*testutils.Sink[bool]
+	desc devices.Descriptor
+}
+
+func (d describedSink) Descriptor() devices.Descriptor { return d.desc }
+
+const (
+	goldenNBIRTH = "0880d095ffbc3112120a0562645365711880d095ffbc312008580012210a144e6f646520436f6e74726f6c2f526562697274681880d095ffbc31200b70001800"
+	goldenDDATA  = "0880d095ffbc31121f0a0b74656d70657261747572651880d095ffbc31200a6900000000008035401803"
+	goldenNDEATH = "0880d095ffbc3112120a0562645365711880d095ffbc3120085800"
+)
+
+func TestEdgeNode(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	broker := memory.NewBroker()
+	client := broker.NewClient()
+	reg := messenger.NewRegistry(client, nil)
+
+	src := describedSource{
+		Source: testutils.NewSource[float64]("temp", 1),
+		desc:   devices.Descriptor{Name: "temp", Kind: "temperature", ValueType: "float64", Unit: "C"},
+	}
+	sink := describedSink{
+		Sink: testutils.NewSink[bool]("relay", 1),
+		desc: devices.Descriptor{Name: "relay", Kind: "switch", ValueType: "bool", Access: devices.ReadWrite},
+	}
+	reg.Add(src)
+	reg.Add(sink)
+	messenger.WireSource(ctx, reg, src, codec.JSON[float64]{})
+	messenger.WireSink(ctx, reg, sink, codec.JSON[bool]{})
+
+	host := broker.NewClient()
+	got := make(chan messenger.Message, 16)
+	_, err := host.Subscribe(ctx, "spBv1.0/plant/+/edge1/#", 0, func(m messenger.Message) {
+		if !messenger.MatchTopic("spBv1.0/plant/NCMD/#", m.Topic) && !messenger.MatchTopic("spBv1.0/plant/DCMD/#", m.Topic) {
+			got <- m
+		}
+	})
+	require.NoError(t, err)
+
+	node := New(reg, "plant", "edge1")
+	node.Now = func() time.Time { return time.UnixMilli(int64(ts)) }
+	node.Wire()
+	require.NoError(t, node.SetWill())
+	reg.ResubscribeAll(ctx)
+
+	runCtx, stop := context.WithCancel(ctx)
+	t.Cleanup(stop)
+	go func() { _ = node.Run(runCtx) }()
+
+	// Births, devices in name order.
+	msgs, err := testutils.CollectN(got, 3, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "spBv1.0/plant/NBIRTH/edge1", msgs[0].Topic)
+	assert.Equal(t, goldenNBIRTH, hex.EncodeToString(msgs[0].Payload))
+
+	assert.Equal(t, "spBv1.0/plant/DBIRTH/edge1/relay", msgs[1].Topic)
+	relay, err := Unmarshal(msgs[1].Payload)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), *relay.Seq)
+	assert.Equal(t, Metric{Name: "switch", Timestamp: ts, Datatype: Boolean, IsNull: true}, relay.Metrics[0])
+
+	assert.Equal(t, "spBv1.0/plant/DBIRTH/edge1/temp", msgs[2].Topic)
+	temp, err := Unmarshal(msgs[2].Payload)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), *temp.Seq)
+	require.NotNil(t, temp.Metrics[0].Properties)
+	assert.Equal(t, []string{"engUnit"}, temp.Metrics[0].Properties.Keys)
+
+	// DDATA follows WireSource.
+	src.Emit(21.5)
+	m, ok := testutils.WaitRecv(got, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "spBv1.0/plant/DDATA/edge1/temp", m.Topic)
+	assert.Equal(t, goldenDDATA, hex.EncodeToString(m.Payload))
+
+	// DCMD reaches the sink.
+	cmd, err := Payload{Timestamp: ts, Metrics: []Metric{{Name: "switch", Datatype: Boolean, Value: true}}}.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, host.Publish(ctx, "spBv1.0/plant/DCMD/edge1/relay", cmd, false, 0))
+	on, ok := testutils.WaitRecv(sink.Get(), time.Second)
+	require.True(t, ok)
+	assert.True(t, on)
+
+	// Rebirth restarts seq at 0.
+	rebirth, err := Payload{Metrics: []Metric{{Name: MetricRebirth, Datatype: Boolean, Value: true}}}.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, host.Publish(ctx, "spBv1.0/plant/NCMD/edge1", rebirth, false, 0))
+	m, ok = testutils.WaitRecv(got, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "spBv1.0/plant/NBIRTH/edge1", m.Topic)
+	_, err = testutils.CollectN(got, 2, time.Second)
+	require.NoError(t, err)
+
+	// Losing the connection publishes the NDEATH will.
+	client.Kill()
+	m, ok = testutils.WaitRecv(got, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "spBv1.0/plant/NDEATH/edge1", m.Topic)
+	assert.Equal(t, goldenNDEATH, hex.EncodeToString(m.Payload))
+}
+
+func TestNodeReconnectBirths(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	broker := memory.NewBroker()
+	client := broker.NewClient()
+	reg := messenger.NewRegistry(client, nil)
+	src := describedSource{
+		Source: testutils.NewSource[float64]("temp", 1),
+		desc:   devices.Descriptor{Name: "temp", Kind: "temperature", ValueType: "float64"},
+	}
+	reg.Add(src)
+
+	host := broker.NewClient()
+	got := make(chan messenger.Message, 16)
+	_, err := host.Subscribe(ctx, "spBv1.0/plant/+/edge1/#", 0, func(m messenger.Message) { got <- m })
+	require.NoError(t, err)
+	bdSeq := func(m messenger.Message) any {
+		p, err := Unmarshal(m.Payload)
+		require.NoError(t, err)
+		return p.Metrics[0].Value
+	}
+
+	node := New(reg, "plant", "edge1")
+	node.Wire()
+	require.NoError(t, node.SetWill())
+	reg.ResubscribeAll(ctx)
+	assert.Empty(t, got, "no births before Run")
+
+	go func() { _ = node.Run(ctx) }()
+	msgs, err := testutils.CollectN(got, 2, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "spBv1.0/plant/NBIRTH/edge1", msgs[0].Topic)
+	assert.Equal(t, uint64(0), bdSeq(msgs[0]))
+
+	// Before a reconnect the next will takes a new bdSeq, once however
+	// many attempts it takes; the new session births with it.
+	require.NoError(t, node.SetWill())
+	require.NoError(t, node.SetWill())
+	reg.ResubscribeAll(ctx)
+	msgs, err = testutils.CollectN(got, 2, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "spBv1.0/plant/NBIRTH/edge1", msgs[0].Topic)
+	assert.Equal(t, uint64(1), bdSeq(msgs[0]))
+	assert.Equal(t, "spBv1.0/plant/DBIRTH/edge1/temp", msgs[1].Topic)
+
+	client.Kill()
+	m, ok := testutils.WaitRecv(got, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "spBv1.0/plant/NDEATH/edge1", m.Topic)
+	assert.Equal(t, uint64(1), bdSeq(m))
+}
+
+// stalledMQTT holds Publish until release is closed.
+type stalledMQTT struct {
+	messenger.MQTT
+	release chan struct{}
+}
+
+func (m stalledMQTT) Publish(ctx context.Context, topic string, payload []byte, retain bool, qos byte) error {
+	<-m.release
+	return m.MQTT.Publish(ctx, topic, payload, retain, qos)
+}
+
+func TestNodeDataDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	broker := memory.NewBroker()
+	stalled := stalledMQTT{MQTT: broker.NewClient(), release: make(chan struct{})}
+	reg := messenger.NewRegistry(stalled, nil)
+	reg.Add(describedSource{
+		Source: testutils.NewSource[float64]("temp", 1),
+		desc:   devices.Descriptor{Name: "temp", Kind: "temperature", ValueType: "float64"},
+	})
+
+	host := broker.NewClient()
+	got := make(chan messenger.Message, 16)
+	_, err := host.Subscribe(ctx, "spBv1.0/plant/+/edge1/#", 0, func(m messenger.Message) { got <- m })
+	require.NoError(t, err)
+
+	node := New(reg, "plant", "edge1")
+	node.Wire()
+	go func() { _ = node.Run(ctx) }()
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		if !node.online {
+			return errors.New("not born")
+		}
+		return nil
+	}))
+
+	// The state hook returns while the births are still stuck.
+	returned := make(chan struct{}, 1)
+	go func() {
+		node.publishData("temp", 22.0)
+		returned <- struct{}{}
+	}()
+	_, ok := testutils.WaitRecv(returned, time.Second)
+	assert.True(t, ok, "publishData blocked on the network")
+
+	// Once the broker takes them, they arrive in seq order.
+	close(stalled.release)
+	msgs, err := testutils.CollectN(got, 3, time.Second)
+	require.NoError(t, err)
+	for i, want := range []string{"NBIRTH/edge1", "DBIRTH/edge1/temp", "DDATA/edge1/temp"} {
+		assert.Equal(t, "spBv1.0/plant/"+want, msgs[i].Topic)
+		p, err := Unmarshal(msgs[i].Payload)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), *p.Seq)
+	}
+}
@@ -0,0 +1,238 @@
+package messenger
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StateRecord is a persisted state value: the encoded payload as
+// published and when it was recorded.
+type StateRecord struct {
+	Payload []byte    `json:"payload"`
+	Time    time.Time `json:"time"`
+}
+
+// StateStore persists the Registry state cache across restarts.
+// Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Load returns every stored record keyed by device name.
+	Load() (map[string]StateRecord, error)
+	// Save records the latest state for a device.
+	Save(name string, rec StateRecord) error
+	// Delete forgets a device's state.
+	Delete(name string) error
+}
+
+// StateFlusher is implemented by stores that write Saves in the
+// background. Registry.Run flushes them when it returns.
+type StateFlusher interface {
+	Flush() error
+}
+
+// DefaultStateStoreDelay is how long a FileStateStore gathers Saves
+// before writing them.
+const DefaultStateStoreDelay = time.Second
+
+// FileStateStore keeps the state cache in a single JSON file. Save only
+// updates memory; the file is rewritten in the background at most once
+// per Delay, so saves never wait on the disk. Each write goes to a
+// temporary file that is synced before it replaces the old one.
+type FileStateStore struct {
+	path string
+
+	// Delay batches Saves into one write. Defaults to
+	// DefaultStateStoreDelay.
+	Delay time.Duration
+
+	writeMu sync.Mutex // one write at a time, in snapshot order
+
+	mu    sync.Mutex
+	recs  map[string]StateRecord
+	dirty bool
+	timer *time.Timer
+	err   error // failed background write, reported by the next Save or Flush
+}
+
+var _ StateFlusher = (*FileStateStore)(nil)
+
+// NewFileStateStore returns a store backed by the JSON file at path.
+// The file and its directory are created on the first write.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load reads the file, keeping Saves not yet written. A missing file
+// is an empty store.
+func (s *FileStateStore) Load() (map[string]StateRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		if err := s.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	out := make(map[string]StateRecord, len(s.recs))
+	for k, v := range s.recs {
+		out[k] = v
+	}
+	return out, nil
+}
+
+// Save updates name and schedules a write. It returns the error of a
+// failed background write, if any, which is retried with this one.
+func (s *FileStateStore) Save(name string, rec StateRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.recs == nil {
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+	}
+	s.recs[name] = rec
+	return s.scheduleLocked()
+}
+
+// Delete forgets name and schedules a write, reporting errors like Save.
+func (s *FileStateStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.recs == nil {
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+	}
+	if _, ok := s.recs[name]; !ok {
+		return nil
+	}
+	delete(s.recs, name)
+	return s.scheduleLocked()
+}
+
+// scheduleLocked marks the store dirty, starts the write timer and
+// takes the error of a failed background write.
+func (s *FileStateStore) scheduleLocked() error {
+	s.dirty = true
+	if s.timer == nil {
+		delay := s.Delay
+		if delay <= 0 {
+			delay = DefaultStateStoreDelay
+		}
+		s.timer = time.AfterFunc(delay, func() { _ = s.write(true) })
+	}
+
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// Flush writes pending Saves now.
+func (s *FileStateStore) Flush() error {
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	err := s.err
+	s.err = nil
+	s.mu.Unlock()
+
+	if werr := s.write(false); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// write rewrites the file if there are unwritten Saves. A failed
+// background write is kept for the next Save or Flush to report.
+func (s *FileStateStore) write(background bool) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if background {
+		s.timer = nil
+	}
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.recs)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = writeFileSync(s.path, b)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		if background {
+			s.err = err
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// writeFileSync replaces path with b durably: the data is synced to a
+// temporary file in the same directory before it is renamed over path,
+// and the directory is synced after.
+func writeFileSync(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make the rename itself durable; not every platform can sync a
+	// directory, so this is best effort.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (s *FileStateStore) loadLocked() error {
+	s.recs = map[string]StateRecord{}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.recs)
+}
@@ -0,0 +1,153 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStateStoreRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state", "cache.json")
+	s := NewFileStateStore(path)
+
+	recs, err := s.Load()
+	require.NoError(t, err)
+	assert.Empty(t, recs)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, s.Save("lamp", StateRecord{Payload: []byte("true"), Time: now}))
+	require.NoError(t, s.Save("temp", StateRecord{Payload: []byte("21.5"), Time: now}))
+
+	// Saves stay in memory until the delay passes or Flush.
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	recs, err = s.Load()
+	require.NoError(t, err)
+	assert.Len(t, recs, 2)
+	require.NoError(t, s.Flush())
+
+	recs, err = NewFileStateStore(path).Load()
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, []byte("true"), recs["lamp"].Payload)
+	assert.True(t, now.Equal(recs["temp"].Time))
+
+	require.NoError(t, s.Delete("temp"))
+	require.NoError(t, s.Delete("missing"))
+	require.NoError(t, s.Flush())
+	recs, err = NewFileStateStore(path).Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lamp"}, slices.Collect(maps.Keys(recs)))
+}
+
+func TestFileStateStoreBatchesWrites(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	s := NewFileStateStore(path)
+	s.Delay = 20 * time.Millisecond
+
+	for i := range 100 {
+		require.NoError(t, s.Save("temp", StateRecord{Payload: []byte(strconv.Itoa(i))}))
+	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		recs, err := NewFileStateStore(path).Load()
+		if err != nil {
+			return err
+		}
+		if string(recs["temp"].Payload) != "99" {
+			return errors.New("last save not written")
+		}
+		return nil
+	}))
+
+	// Only the state file is left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "state.json", entries[0].Name())
+}
+
+func TestRegistryStateSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	mqtt := newWireMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	store := NewFileStateStore(path)
+	reg.Store = store
+	src := testutils.NewSource[bool]("lamp", 1)
+	WireSource(ctx, reg, src, codec.JSON[bool]{})
+
+	src.Set() <- true
+	_, ok := testutils.WaitRecv(mqtt.publishCh, time.Second)
+	require.True(t, ok)
+	src.Close()
+	require.NoError(t, store.Flush())
+
+	// Load before the source is wired: typed state appears once it is.
+	reg2 := NewRegistry(newWireMQTT(), TopicScheme{Prefix: "otto"})
+	reg2.Store = NewFileStateStore(path)
+	require.NoError(t, reg2.LoadState())
+
+	raw, ok := reg2.StateRaw("lamp")
+	require.True(t, ok)
+	assert.Equal(t, []byte("true"), raw)
+	_, ok = StateAs[bool](reg2, "lamp")
+	assert.False(t, ok)
+
+	WireSource(ctx, reg2, testutils.NewSource[bool]("lamp", 1), codec.JSON[bool]{})
+	on, ok := StateAs[bool](reg2, "lamp")
+	require.True(t, ok)
+	assert.True(t, on)
+
+	// Wire first, then load.
+	reg3 := NewRegistry(newWireMQTT(), TopicScheme{Prefix: "otto"})
+	reg3.Store = NewFileStateStore(path)
+	WireSource(ctx, reg3, testutils.NewSource[bool]("lamp", 1), codec.JSON[bool]{})
+	require.NoError(t, reg3.LoadState())
+	on, ok = StateAs[bool](reg3, "lamp")
+	require.True(t, ok)
+	assert.True(t, on)
+
+	ts, ok := reg3.StateTime("lamp")
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now(), ts, time.Minute)
+}
+
+func TestRegistryRemoveDeletesStoredState(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, store.Save("lamp", StateRecord{Payload: []byte("true")}))
+	reg := NewRegistry(newRegistryMQTT(), TopicScheme{Prefix: "otto"})
+	reg.Store = store
+	require.NoError(t, reg.Add(&fakeDevice{name: "lamp", events: make(chan devices.Event)}))
+
+	require.NoError(t, reg.Remove(ctx, "lamp"))
+	recs, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, recs, "a removed device's state is not restored")
+}
@@ -0,0 +1,77 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultStation returns the hostname, or "otto" when it is unknown.
+func defaultStation() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "otto"
+	}
+	// Keep the name a single, publishable topic level.
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(h)
+}
+
+// SetStationWill sets the connection's will to offline on the station
+// status topic. Clients send the will with CONNECT, so call it before
+// connecting. A connection has a single will: skip it when a protocol
+// adapter such as homie or sparkplug sets its own.
+func (r *Registry) SetStationWill() error {
+	b, _ := json.Marshal(StatusPayload{Station: r.Station, Status: StatusOffline, Time: time.Now()})
+	return r.MQTT.SetWill(StationStatusTopic(r.Topics, r.Station), b, true, r.QoSStatus)
+}
+
+// OnConnect registers fn to be called from ResubscribeAll, after the
+// subscriptions are applied, on every connect and reconnect. Protocol
+// adapters use it to announce themselves to a new session.
+func (r *Registry) OnConnect(fn func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectHooks = append(r.connectHooks, fn)
+}
+
+// publishStationStatus publishes status retained on the station status
+// topic.
+func (r *Registry) publishStationStatus(ctx context.Context, status string) {
+	b, _ := json.Marshal(StatusPayload{Station: r.Station, Status: status, Time: time.Now()})
+	msg := Message{Topic: StationStatusTopic(r.Topics, r.Station), Payload: b, Retain: true, QoS: r.QoSStatus}
+	if err := PublishMessage(ctx, r.MQTT, msg); err != nil {
+		r.Log.Warn("station status publish failed", "station", r.Station, "error", err)
+	}
+}
+
+// rebirth announces the station online again and republishes the last
+// status of each device, which an Availability may have replaced with
+// offline while the connection was down. It does nothing unless Run is
+// active.
+func (r *Registry) rebirth(ctx context.Context) {
+	r.mu.RLock()
+	running := r.run != nil
+	status := make(map[string]StatusPayload, len(r.status))
+	for name, st := range r.status {
+		status[name] = st
+	}
+	r.mu.RUnlock()
+	if !running {
+		return
+	}
+
+	r.publishStationStatus(ctx, StatusOnline)
+
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, _ := json.Marshal(status[name])
+		_ = r.publish(ctx, name, Message{Topic: r.Topics.Status(name), Payload: b, Retain: true, QoS: r.QoSStatus})
+	}
+}
@@ -0,0 +1,115 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statuses decodes the publishes made on topic.
+func statuses(t *testing.T, m *registryMQTT, topic string) []StatusPayload {
+	t.Helper()
+	publishes, _, _, _ := m.snapshot()
+	var out []StatusPayload
+	for _, call := range publishes {
+		if call.topic != topic {
+			continue
+		}
+		var st StatusPayload
+		require.NoError(t, json.Unmarshal(call.body, &st))
+		assert.True(t, call.retain, topic)
+		out = append(out, st)
+	}
+	return out
+}
+
+func TestRegistryStationStatus(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Station = "garden"
+	reg.Restart.Settle = time.Millisecond
+	reg.Add(&fakeDevice{name: "lamp", events: make(chan devices.Event)})
+	reg.Add(&fakeDevice{name: "pump", events: make(chan devices.Event)})
+
+	require.NoError(t, reg.SetStationWill())
+
+	// Before Run there is nothing to announce.
+	reg.ResubscribeAll(ctx)
+	assert.Empty(t, statuses(t, mqtt, "otto/stations/garden/status"))
+
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+	online := func(name string) error {
+		for _, st := range statuses(t, mqtt, reg.Topics.Status(name)) {
+			if st.Status == StatusOnline {
+				return nil
+			}
+		}
+		return errors.New(name + " not online")
+	}
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		return errors.Join(online("lamp"), online("pump"))
+	}))
+
+	_, wills, _, _ := mqtt.snapshot()
+	require.Len(t, wills, 1)
+	var will StatusPayload
+	require.NoError(t, json.Unmarshal(wills[0].body, &will))
+	assert.Equal(t, StatusPayload{Station: "garden", Status: StatusOffline, Time: will.Time}, will)
+
+	lamp := statuses(t, mqtt, "otto/devices/lamp/status")
+	require.NotEmpty(t, lamp)
+	assert.Equal(t, "lamp", lamp[0].Device)
+	assert.Equal(t, "garden", lamp[0].Station)
+
+	// A reconnect announces the station and its devices again.
+	before := len(statuses(t, mqtt, "otto/devices/pump/status"))
+	reg.ResubscribeAll(ctx)
+	pump := statuses(t, mqtt, "otto/devices/pump/status")
+	require.Len(t, pump, before+1)
+	assert.Equal(t, StatusOnline, pump[before].Status)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	var got []string
+	for _, st := range statuses(t, mqtt, "otto/stations/garden/status") {
+		assert.Equal(t, "garden", st.Station)
+		assert.Empty(t, st.Device)
+		got = append(got, st.Status)
+	}
+	assert.Equal(t, []string{StatusOnline, StatusOnline, StatusOffline}, got)
+}
+
+func TestRegistryOnConnect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	var subscribed []int
+	reg.WantSub("otto/devices/lamp/set", 1, func(Message) {})
+	reg.OnConnect(func(context.Context) {
+		_, _, subs, _ := mqtt.snapshot()
+		subscribed = append(subscribed, subs["otto/devices/lamp/set"])
+	})
+
+	// Each connect runs the hooks after resubscribing.
+	reg.ResubscribeAll(ctx)
+	reg.ResubscribeAll(ctx)
+	assert.Equal(t, []int{1, 2}, subscribed)
+}
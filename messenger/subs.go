@@ -0,0 +1,424 @@
+package messenger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type subSpec struct {
+	topic   string
+	qos     byte
+	handler func(Message)
+}
+
+// Subscriptions manages the MQTT subscriptions of many handlers. Any
+// number of handlers may register on a filter, each getting its own
+// Subscription to remove it with. The broker sees one subscription per
+// filter, and none for a filter covered by a wider registered one (say
+// otto/devices/+/set under otto/#): its messages arrive on the wider
+// subscription and are matched and fanned out in process. A filter's
+// broker subscription is dropped with its last handler.
+//
+// Nothing is subscribed until ResubscribeAll runs; after that, changes
+// apply right away.
+type Subscriptions struct {
+	MQTT MQTT
+	Log  Logger
+
+	// OnError, if set, is called when a broker subscription fails.
+	OnError func(filter string, err error)
+
+	// serializes broker work so a filter is never subscribed twice
+	syncMu sync.Mutex
+
+	mu      sync.Mutex
+	filters map[string][]handlerEntry // in registration order
+	active  map[string]activeSub      // broker subscriptions by filter
+	owner   map[string]string         // filter -> active filter delivering it
+	live    bool
+	nextID  uint64
+}
+
+type handlerEntry struct {
+	id uint64
+	subSpec
+}
+
+type activeSub struct {
+	qos   byte
+	unsub func() error
+}
+
+// NewSubscriptions returns a manager subscribing through m.
+func NewSubscriptions(m MQTT) *Subscriptions {
+	return &Subscriptions{
+		MQTT:    m,
+		Log:     slog.Default(),
+		filters: map[string][]handlerEntry{},
+		active:  map[string]activeSub{},
+		owner:   map[string]string{},
+	}
+}
+
+// Subscription is one handler registered with Subscriptions.
+type Subscription struct {
+	s      *Subscriptions
+	filter string
+	id     uint64
+	once   sync.Once
+}
+
+// Filter returns the topic filter the handler is registered on.
+func (sub *Subscription) Filter() string { return sub.filter }
+
+// Unsubscribe removes the handler. The broker subscription goes once no
+// other handler needs it. It is safe to call more than once.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() { sub.s.remove(sub) })
+}
+
+// Add registers handler for messages matching filter. Once ResubscribeAll
+// has run, the broker subscription is applied right away.
+func (s *Subscriptions) Add(filter string, qos byte, handler func(Message)) *Subscription {
+	sub, live := s.add(filter, qos, handler)
+	if live {
+		_ = s.sync(context.Background(), false)
+	}
+	return sub
+}
+
+// Subscribe is Add, except that filter is subscribed at the broker before
+// it returns, even before ResubscribeAll has run. If that fails the
+// handler is not registered.
+func (s *Subscriptions) Subscribe(ctx context.Context, filter string, qos byte, handler func(Message)) (*Subscription, error) {
+	sub, live := s.add(filter, qos, handler)
+
+	var err error
+	if live {
+		err = s.sync(ctx, false)
+	} else {
+		err = s.pin(ctx, filter)
+	}
+
+	s.mu.Lock()
+	served := s.owner[filter] != ""
+	s.mu.Unlock()
+	if !served {
+		sub.Unsubscribe()
+		if err == nil {
+			err = fmt.Errorf("subscribe %s: not subscribed", filter)
+		}
+		return nil, err
+	}
+	return sub, nil
+}
+
+// ResubscribeAll applies every broker subscription afresh (call on
+// connect and reconnect). Until it first runs, Add only records handlers.
+func (s *Subscriptions) ResubscribeAll(ctx context.Context) {
+	s.mu.Lock()
+	s.live = true
+	n := len(s.filters)
+	s.mu.Unlock()
+
+	s.Log.Info("MQTT connected; (re)subscribing", "count", n)
+	_ = s.sync(ctx, true)
+}
+
+// Suspend drops every broker subscription but keeps the handlers, so a
+// later ResubscribeAll restores them.
+func (s *Subscriptions) Suspend() {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	s.live = false
+	var unsubs []func() error
+	for f, a := range s.active {
+		unsubs = append(unsubs, a.unsub)
+		delete(s.active, f)
+	}
+	s.reownLocked()
+	s.mu.Unlock()
+
+	for _, u := range unsubs {
+		_ = u()
+	}
+}
+
+// Filters returns the filters with at least one handler, sorted.
+func (s *Subscriptions) Filters() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.filters))
+	for f := range s.filters {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s *Subscriptions) add(filter string, qos byte, handler func(Message)) (*Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	sub := &Subscription{s: s, filter: filter, id: s.nextID}
+	s.filters[filter] = append(s.filters[filter], handlerEntry{id: sub.id, subSpec: subSpec{topic: filter, qos: qos, handler: handler}})
+	s.reownLocked()
+	return sub, s.live
+}
+
+func (s *Subscriptions) remove(sub *Subscription) {
+	s.mu.Lock()
+	hs := s.filters[sub.filter]
+	for i, h := range hs {
+		if h.id == sub.id {
+			hs = append(hs[:i:i], hs[i+1:]...)
+			break
+		}
+	}
+	if len(hs) == 0 {
+		delete(s.filters, sub.filter)
+	} else {
+		s.filters[sub.filter] = hs
+	}
+	s.reownLocked()
+	live := s.live
+	s.mu.Unlock()
+
+	if live {
+		_ = s.sync(context.Background(), false)
+		return
+	}
+	if len(hs) == 0 {
+		// Pinned by Subscribe before going live: nothing else drops it.
+		s.syncMu.Lock()
+		defer s.syncMu.Unlock()
+		s.mu.Lock()
+		a, ok := s.active[sub.filter]
+		delete(s.active, sub.filter)
+		s.reownLocked()
+		s.mu.Unlock()
+		if ok {
+			_ = a.unsub()
+		}
+	}
+}
+
+// pin subscribes filter at the broker unless an active subscription
+// already delivers it.
+func (s *Subscriptions) pin(ctx context.Context, filter string) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	if s.owner[filter] != "" {
+		s.mu.Unlock()
+		return nil
+	}
+	var qos byte
+	for _, h := range s.filters[filter] {
+		qos = max(qos, h.qos)
+	}
+	s.mu.Unlock()
+
+	return s.subscribe(ctx, filter, qos)
+}
+
+// sync brings the broker subscriptions in line with the handlers: wider
+// filters are subscribed before the narrower ones they replace are
+// dropped. With force every subscription is made afresh.
+func (s *Subscriptions) sync(ctx context.Context, force bool) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mu.Lock()
+	var stale []func() error
+	if force {
+		for f, a := range s.active {
+			stale = append(stale, a.unsub)
+			delete(s.active, f)
+		}
+		s.reownLocked()
+	}
+	want := s.rootsLocked()
+	var add []string
+	for f, qos := range want {
+		if a, ok := s.active[f]; !ok || a.qos != qos {
+			add = append(add, f)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, u := range stale {
+		_ = u()
+	}
+
+	sort.Strings(add)
+	var errs []error
+	for _, f := range add {
+		if err := s.subscribe(ctx, f, want[f]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Handlers may have come and gone meanwhile; go by the current set.
+	s.mu.Lock()
+	want = s.rootsLocked()
+	up := map[string]bool{}
+	for f := range want {
+		if _, ok := s.active[f]; ok {
+			up[f] = true
+		}
+	}
+	stale = stale[:0]
+	for f, a := range s.active {
+		if _, ok := want[f]; ok {
+			continue
+		}
+		if len(s.filters[f]) > 0 && !covered(f, up) {
+			// The wider filter failed to subscribe; keep serving this one.
+			continue
+		}
+		stale = append(stale, a.unsub)
+		delete(s.active, f)
+	}
+	s.reownLocked()
+	s.mu.Unlock()
+
+	for _, u := range stale {
+		_ = u()
+	}
+	return errors.Join(errs...)
+}
+
+// subscribe makes one broker subscription. A repeated subscription to
+// the same filter replaces the old one at the broker, so its unsubscribe
+// is not called.
+func (s *Subscriptions) subscribe(ctx context.Context, filter string, qos byte) error {
+	unsub, err := s.MQTT.Subscribe(ctx, filter, qos, s.dispatch(filter))
+	if err != nil {
+		s.Log.Error("MQTT subscribe failed", "topic", filter, "error", err)
+		if s.OnError != nil {
+			s.OnError(filter, err)
+		}
+		return fmt.Errorf("subscribe %s: %w", filter, err)
+	}
+
+	s.mu.Lock()
+	s.active[filter] = activeSub{qos: qos, unsub: unsub}
+	s.reownLocked()
+	s.mu.Unlock()
+
+	s.Log.Info("MQTT subscribed", "topic", filter, "qos", qos)
+	return nil
+}
+
+// dispatch returns the handler for the broker subscription to root: it
+// runs the handlers of every filter root delivers that matches the
+// message topic.
+func (s *Subscriptions) dispatch(root string) func(Message) {
+	return func(m Message) {
+		s.mu.Lock()
+		var hs []func(Message)
+		for f, owner := range s.owner {
+			if owner != root || !MatchTopic(f, m.Topic) {
+				continue
+			}
+			for _, h := range s.filters[f] {
+				hs = append(hs, h.handler)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, h := range hs {
+			h(m)
+		}
+	}
+}
+
+// rootsLocked returns the filters that need a broker subscription, those
+// no other registered filter covers, each with the highest QoS asked
+// for by the handlers it delivers.
+func (s *Subscriptions) rootsLocked() map[string]byte {
+	roots := map[string]byte{}
+	for f := range s.filters {
+		if !covered(f, s.filters) {
+			roots[f] = 0
+		}
+	}
+	for f, hs := range s.filters {
+		for root, qos := range roots {
+			if !covers(root, f) {
+				continue
+			}
+			for _, h := range hs {
+				qos = max(qos, h.qos)
+			}
+			roots[root] = qos
+		}
+	}
+	return roots
+}
+
+// covered reports whether a filter in set other than f covers f.
+func covered[V any](f string, set map[string]V) bool {
+	for g := range set {
+		if g != f && covers(g, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// reownLocked works out which active subscription delivers each filter:
+// its own if it has one, else the first active filter covering it.
+func (s *Subscriptions) reownLocked() {
+	act := make([]string, 0, len(s.active))
+	for f := range s.active {
+		act = append(act, f)
+	}
+	sort.Strings(act)
+
+	clear(s.owner)
+	for f := range s.filters {
+		if _, ok := s.active[f]; ok {
+			s.owner[f] = f
+			continue
+		}
+		for _, a := range act {
+			if covers(a, f) {
+				s.owner[f] = a
+				break
+			}
+		}
+	}
+}
+
+// covers reports whether every topic matching filter b also matches
+// filter a.
+func covers(a, b string) bool {
+	if strings.HasPrefix(b, "$") && (strings.HasPrefix(a, "+") || strings.HasPrefix(a, "#")) {
+		return false
+	}
+
+	al := strings.Split(a, "/")
+	bl := strings.Split(b, "/")
+	for i, x := range al {
+		if x == "#" {
+			return true
+		}
+		if i >= len(bl) || bl[i] == "#" {
+			return false
+		}
+		if x != "+" && x != bl[i] {
+			return false
+		}
+	}
+	return len(al) == len(bl)
+}
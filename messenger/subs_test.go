@@ -0,0 +1,163 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handlers returns the handlers registered on filter.
+func handlers(s *Subscriptions, filter string) []func(Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []func(Message)
+	for _, h := range s.filters[filter] {
+		out = append(out, h.handler)
+	}
+	return out
+}
+
+// deliver hands a message to the latest broker subscription to filter.
+func deliver(t *testing.T, f *fakeMQTT, filter, topic string) {
+	t.Helper()
+	subs, _, _ := f.snapshot()
+	for i := len(subs) - 1; i >= 0; i-- {
+		if subs[i].topic == filter {
+			subs[i].handler(Message{Topic: topic})
+			return
+		}
+	}
+	require.Failf(t, "not subscribed", "filter %s", filter)
+}
+
+func TestCovers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/b", "a/+", false},
+		{"a/#", "a", true},
+		{"a/#", "a/+/c", true},
+		{"a/+", "a/#", false},
+		{"#", "a/#", true},
+		{"a/+/c", "a/b/+", false},
+		{"a/b/+", "a/b", false},
+		{"+/x", "$SYS/x", false},
+		{"#", "$SYS/x", false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, covers(tc.a, tc.b), "covers(%q, %q)", tc.a, tc.b)
+	}
+}
+
+func TestSubscriptionsShareFilter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newFakeMQTT()
+	s := NewSubscriptions(mqtt)
+	var a, b int
+	subA := s.Add("otto/devices/lamp/set", 0, func(Message) { a++ })
+	subB := s.Add("otto/devices/lamp/set", 1, func(Message) { b++ })
+	s.ResubscribeAll(ctx)
+
+	subs, calls, _ := mqtt.snapshot()
+	require.Len(t, subs, 1)
+	assert.Equal(t, byte(1), subs[0].qos, "highest QoS wins")
+	assert.Equal(t, 1, calls["otto/devices/lamp/set"])
+
+	deliver(t, mqtt, "otto/devices/lamp/set", "otto/devices/lamp/set")
+	assert.Equal(t, 1, a)
+	assert.Equal(t, 1, b)
+
+	subA.Unsubscribe()
+	subA.Unsubscribe()
+	deliver(t, mqtt, "otto/devices/lamp/set", "otto/devices/lamp/set")
+	assert.Equal(t, 1, a)
+	assert.Equal(t, 2, b)
+
+	_, _, unsubs := mqtt.snapshot()
+	assert.Zero(t, unsubs["otto/devices/lamp/set"], "still wanted by b")
+
+	subB.Unsubscribe()
+	_, _, unsubs = mqtt.snapshot()
+	assert.Equal(t, 1, unsubs["otto/devices/lamp/set"])
+	assert.Empty(t, s.Filters())
+}
+
+func TestSubscriptionsWildcardFanOut(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newFakeMQTT()
+	s := NewSubscriptions(mqtt)
+	s.ResubscribeAll(ctx)
+
+	var lamp, all []string
+	s.Add("otto/devices/lamp/set", 1, func(m Message) { lamp = append(lamp, m.Topic) })
+	wide := s.Add("otto/devices/+/set", 0, func(m Message) { all = append(all, m.Topic) })
+
+	// The wide filter takes over the narrow one at the broker, at the
+	// QoS the narrow one asked for.
+	subs, calls, unsubs := mqtt.snapshot()
+	assert.Equal(t, 1, calls["otto/devices/+/set"])
+	assert.Equal(t, byte(1), subs[len(subs)-1].qos)
+	assert.Equal(t, 1, unsubs["otto/devices/lamp/set"])
+
+	deliver(t, mqtt, "otto/devices/+/set", "otto/devices/lamp/set")
+	deliver(t, mqtt, "otto/devices/+/set", "otto/devices/pump/set")
+	assert.Equal(t, []string{"otto/devices/lamp/set"}, lamp)
+	assert.Equal(t, []string{"otto/devices/lamp/set", "otto/devices/pump/set"}, all)
+
+	// Dropping the wide filter brings the narrow subscription back.
+	wide.Unsubscribe()
+	_, calls, unsubs = mqtt.snapshot()
+	assert.Equal(t, 2, calls["otto/devices/lamp/set"])
+	assert.Equal(t, 1, unsubs["otto/devices/+/set"])
+
+	deliver(t, mqtt, "otto/devices/lamp/set", "otto/devices/lamp/set")
+	assert.Len(t, lamp, 2)
+	assert.Len(t, all, 2)
+}
+
+func TestSubscriptionsSubscribeBeforeLive(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newFakeMQTT()
+	s := NewSubscriptions(mqtt)
+	s.Add("otto/devices/lamp/set", 1, func(Message) {})
+
+	var got int
+	sub, err := s.Subscribe(ctx, "otto/replies/x", 1, func(Message) { got++ })
+	require.NoError(t, err)
+	_, calls, _ := mqtt.snapshot()
+	assert.Equal(t, 1, calls["otto/replies/x"])
+	assert.Zero(t, calls["otto/devices/lamp/set"], "Add waits for ResubscribeAll")
+
+	deliver(t, mqtt, "otto/replies/x", "otto/replies/x")
+	assert.Equal(t, 1, got)
+
+	sub.Unsubscribe()
+	_, _, unsubs := mqtt.snapshot()
+	assert.Equal(t, 1, unsubs["otto/replies/x"])
+
+	failing := NewSubscriptions(&failSubMQTT{})
+	_, err = failing.Subscribe(ctx, "otto/replies/x", 1, func(Message) {})
+	require.Error(t, err)
+	assert.Empty(t, failing.Filters())
+}
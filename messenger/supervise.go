@@ -0,0 +1,208 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rustyeddy/devices"
+)
+
+// RestartMode selects when Run restarts a device whose Run returned.
+type RestartMode string
+
+const (
+	// RestartNever leaves the device stopped; a failure is reported as
+	// StatusError.
+	RestartNever RestartMode = "never"
+	// RestartOnFailure restarts the device when Run returns an error.
+	RestartOnFailure RestartMode = "on-failure"
+	// RestartAlways restarts the device whenever Run returns.
+	RestartAlways RestartMode = "always"
+)
+
+// RestartPolicy controls how Registry.Run supervises a device.
+//
+// A device is reported StatusOnline once its Run has kept running for
+// Settle. Restarts wait Backoff, doubling for each restart still inside
+// Window up to MaxBackoff. Once MaxRestarts restarts happened within
+// Window the device is given up on and reported as StatusError.
+//
+// A restart calls the device's Run again, so a device supervised with
+// RestartOnFailure or RestartAlways must support Run being called again
+// after it returns. Events is read before each start, so such a device
+// may close its events channel as Run returns and hand out a new one.
+type RestartPolicy struct {
+	Mode RestartMode
+
+	Settle time.Duration // run time before reporting online (default 1s)
+
+	Backoff    time.Duration // first restart delay (default 1s)
+	MaxBackoff time.Duration // delay cap (default 1m)
+
+	MaxRestarts int           // restarts allowed within Window; 0 = no limit
+	Window      time.Duration // default 10m
+}
+
+// DefaultRestartPolicy restarts failed devices up to five times in ten
+// minutes.
+var DefaultRestartPolicy = RestartPolicy{
+	Mode:        RestartOnFailure,
+	Settle:      time.Second,
+	Backoff:     time.Second,
+	MaxBackoff:  time.Minute,
+	MaxRestarts: 5,
+	Window:      10 * time.Minute,
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.Mode == "" {
+		p.Mode = RestartNever
+	}
+	if p.Settle <= 0 {
+		p.Settle = time.Second
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.Window <= 0 {
+		p.Window = 10 * time.Minute
+	}
+	return p
+}
+
+// delay returns the backoff before restart n (0-based) within the window.
+func (p RestartPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxBackoff)
+}
+
+// SetRestartPolicy overrides Registry.Restart for one device. It takes
+// effect the next time the device is started.
+func (r *Registry) SetRestartPolicy(name string, p RestartPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restarts[name] = p
+}
+
+func (r *Registry) restartPolicy(name string) RestartPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p, ok := r.restarts[name]; ok {
+		return p.withDefaults()
+	}
+	return r.Restart.withDefaults()
+}
+
+// StatusFunc observes a device status change.
+type StatusFunc func(name string, st StatusPayload)
+
+// OnStatus registers fn to be called with each status a device
+// publishes. fn must not block.
+func (r *Registry) OnStatus(fn StatusFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statusHooks = append(r.statusHooks, fn)
+}
+
+// Status returns the last status published for a device.
+func (r *Registry) Status(name string) (StatusPayload, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.status[name]
+	return s, ok
+}
+
+// supervise runs dev until ctx ends, restarting it according to its
+// RestartPolicy and publishing each lifecycle step on its status topic.
+func (r *Registry) supervise(ctx context.Context, dev devices.Device) {
+	name := dev.Name()
+	p := r.restartPolicy(name)
+
+	var window []time.Time // restart times inside p.Window
+	restarts := 0
+	var events <-chan devices.Event
+
+	for {
+		if ch := dev.Events(); ch != events {
+			events = ch
+			r.wireEvents(ctx, name, ch)
+		}
+
+		r.publishStatus(ctx, name, StatusPayload{Status: StatusStarting, Restarts: restarts})
+
+		errc := make(chan error, 1)
+		go func() { errc <- runDevice(ctx, dev) }()
+		settle := time.NewTimer(p.Settle)
+		var err error
+		select {
+		case err = <-errc:
+			settle.Stop()
+		case <-settle.C:
+			r.publishStatus(ctx, name, StatusPayload{Status: StatusOnline, Restarts: restarts})
+			err = <-errc
+		}
+
+		// Shutdown or Remove; the caller publishes offline.
+		if ctx.Err() != nil {
+			return
+		}
+
+		var msg string
+		if err != nil {
+			msg = err.Error()
+			r.Log.Warn("device run failed", "device", name, "error", err)
+		}
+		if p.Mode == RestartNever || (p.Mode == RestartOnFailure && err == nil) {
+			status := StatusOffline
+			if err != nil {
+				status = StatusError
+			}
+			r.publishStatus(ctx, name, StatusPayload{Status: status, Error: msg, Restarts: restarts})
+			return
+		}
+
+		now := time.Now()
+		for len(window) > 0 && now.Sub(window[0]) > p.Window {
+			window = window[1:]
+		}
+		if p.MaxRestarts > 0 && len(window) >= p.MaxRestarts {
+			r.Log.Error("device restart limit reached", "device", name, "restarts", len(window), "window", p.Window)
+			msg = fmt.Sprintf("gave up after %d restarts in %s: %s", len(window), p.Window, msg)
+			r.publishStatus(ctx, name, StatusPayload{Status: StatusError, Error: msg, Restarts: restarts})
+			return
+		}
+
+		delay := p.delay(len(window))
+		window = append(window, now)
+		restarts++
+		if err != nil {
+			r.publishStatus(ctx, name, StatusPayload{Status: StatusDegraded, Error: msg, Restarts: restarts})
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// runDevice calls dev.Run, turning a panic into an error so one
+// misbehaving driver cannot take down the process.
+func runDevice(ctx context.Context, dev devices.Device) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return dev.Run(ctx)
+}
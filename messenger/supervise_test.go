@@ -0,0 +1,246 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartPolicyDelay(t *testing.T) {
+	t.Parallel()
+
+	p := RestartPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	assert.Equal(t, 100*time.Millisecond, p.delay(0))
+	assert.Equal(t, 200*time.Millisecond, p.delay(1))
+	assert.Equal(t, 800*time.Millisecond, p.delay(3))
+	assert.Equal(t, time.Second, p.delay(4))
+	assert.Equal(t, time.Second, p.delay(100))
+
+	assert.Equal(t, RestartNever, RestartPolicy{}.withDefaults().Mode)
+}
+
+// testSettle is long enough that a Run failing at once is never
+// reported online.
+const testSettle = 50 * time.Millisecond
+
+// runSupervised runs a Registry with one device until want reports
+// done, then shuts it down and returns the device's published statuses.
+func runSupervised(t *testing.T, p RestartPolicy, run func(context.Context) error, want func(StatusPayload) bool) []StatusPayload {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.SetRestartPolicy("dev", p)
+	reg.Add(&fakeDevice{name: "dev", events: make(chan devices.Event), run: run})
+
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		if st, ok := reg.Status("dev"); !ok || !want(st) {
+			return errors.New("status not reached")
+		}
+		return nil
+	}))
+	cancel()
+	require.NoError(t, <-done)
+
+	publishes, _, _, _ := mqtt.snapshot()
+	var out []StatusPayload
+	for _, call := range publishes {
+		if call.topic != "otto/devices/dev/status" {
+			continue
+		}
+		var st StatusPayload
+		require.NoError(t, json.Unmarshal(call.body, &st))
+		out = append(out, st)
+	}
+	return out
+}
+
+func statusNames(sts []StatusPayload) []string {
+	out := make([]string, len(sts))
+	for i, st := range sts {
+		out[i] = st.Status
+	}
+	return out
+}
+
+func TestSuperviseRestartsOnFailure(t *testing.T) {
+	t.Parallel()
+
+	var runs atomic.Int32
+	sts := runSupervised(t,
+		RestartPolicy{Mode: RestartOnFailure, Settle: testSettle, Backoff: time.Millisecond},
+		func(ctx context.Context) error {
+			if runs.Add(1) <= 2 {
+				return errors.New("i2c: nack")
+			}
+			<-ctx.Done()
+			return nil
+		},
+		func(st StatusPayload) bool { return st.Status == StatusOnline && st.Restarts == 2 },
+	)
+
+	// Runs that fail at once are never reported online.
+	assert.EqualValues(t, 3, runs.Load())
+	assert.Equal(t, []string{
+		StatusStarting, StatusDegraded,
+		StatusStarting, StatusDegraded,
+		StatusStarting, StatusOnline, StatusOffline,
+	}, statusNames(sts))
+	assert.Equal(t, "i2c: nack", sts[1].Error)
+	assert.Equal(t, 1, sts[1].Restarts)
+	assert.Equal(t, 2, sts[3].Restarts)
+}
+
+func TestSuperviseGivesUpAfterMaxRestarts(t *testing.T) {
+	t.Parallel()
+
+	var runs atomic.Int32
+	sts := runSupervised(t,
+		RestartPolicy{Mode: RestartAlways, Settle: testSettle, Backoff: time.Millisecond, MaxRestarts: 2, Window: time.Minute},
+		func(context.Context) error {
+			runs.Add(1)
+			return errors.New("bus error")
+		},
+		func(st StatusPayload) bool { return st.Status == StatusError },
+	)
+
+	assert.EqualValues(t, 3, runs.Load())
+	last := sts[len(sts)-2]
+	assert.Equal(t, StatusError, last.Status)
+	assert.Contains(t, last.Error, "gave up after 2 restarts")
+	assert.Contains(t, last.Error, "bus error")
+	assert.Equal(t, StatusOffline, sts[len(sts)-1].Status)
+}
+
+func TestSuperviseCleanExit(t *testing.T) {
+	t.Parallel()
+
+	// on-failure leaves a cleanly exited device offline...
+	sts := runSupervised(t,
+		RestartPolicy{Mode: RestartOnFailure, Settle: testSettle, Backoff: time.Millisecond},
+		func(context.Context) error { return nil },
+		func(st StatusPayload) bool { return st.Status == StatusOffline },
+	)
+	assert.Equal(t, []string{StatusStarting, StatusOffline, StatusOffline}, statusNames(sts))
+
+	// ...while always restarts it without reporting degraded.
+	var runs atomic.Int32
+	sts = runSupervised(t,
+		RestartPolicy{Mode: RestartAlways, Settle: testSettle, Backoff: time.Millisecond},
+		func(ctx context.Context) error {
+			if runs.Add(1) == 1 {
+				return nil
+			}
+			<-ctx.Done()
+			return nil
+		},
+		func(st StatusPayload) bool { return st.Status == StatusOnline && st.Restarts == 1 },
+	)
+	assert.Equal(t, []string{StatusStarting, StatusStarting, StatusOnline, StatusOffline}, statusNames(sts))
+}
+
+func TestSuperviseRecoversPanic(t *testing.T) {
+	t.Parallel()
+
+	sts := runSupervised(t,
+		RestartPolicy{Mode: RestartNever, Settle: testSettle},
+		func(context.Context) error { panic("nil register map") },
+		func(st StatusPayload) bool { return st.Status == StatusError },
+	)
+	assert.Equal(t, "panic: nil register map", sts[len(sts)-2].Error)
+}
+
+// reopeningDevice closes its events channel when Run returns and hands
+// out a new one for the next Run, like a driver that rebuilds its state.
+type reopeningDevice struct {
+	mu     sync.Mutex
+	events chan devices.Event
+	runs   int
+}
+
+func (d *reopeningDevice) Name() string { return "dev" }
+func (d *reopeningDevice) Events() <-chan devices.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.events
+}
+func (d *reopeningDevice) Close() error { return nil }
+
+func (d *reopeningDevice) Run(ctx context.Context) error {
+	d.mu.Lock()
+	d.runs++
+	run := d.runs
+	events := d.events
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.events = make(chan devices.Event)
+		d.mu.Unlock()
+		close(events)
+	}()
+
+	select {
+	case events <- devices.Event{Device: "dev", Kind: "info", Msg: fmt.Sprintf("run %d", run)}:
+	case <-ctx.Done():
+		return nil
+	}
+	if run == 1 {
+		return errors.New("i2c: nack")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestSuperviseRewiresEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.Restart = RestartPolicy{Mode: RestartOnFailure, Settle: testSettle, Backoff: time.Millisecond}
+	reg.Add(&reopeningDevice{events: make(chan devices.Event)})
+
+	done := make(chan error, 1)
+	go func() { done <- reg.Run(ctx) }()
+
+	// The restarted Run's events are forwarded from its new channel.
+	var msgs []string
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		msgs = msgs[:0]
+		publishes, _, _, _ := mqtt.snapshot()
+		for _, call := range publishes {
+			if call.topic != "otto/devices/dev/event" {
+				continue
+			}
+			var ev EventPayload
+			require.NoError(t, json.Unmarshal(call.body, &ev))
+			msgs = append(msgs, ev.Msg)
+		}
+		if len(msgs) < 2 {
+			return errors.New("restarted run's event not forwarded")
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"run 1", "run 2"}, msgs)
+
+	cancel()
+	require.NoError(t, <-done)
+}
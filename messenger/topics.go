@@ -1,8 +1,83 @@
 package messenger
 
-import "path"
+import (
+	"fmt"
+	"path"
+	"strings"
+)
 
-// TopicScheme builds MQTT topic paths for devices.
+// Topics builds MQTT topic paths for devices. Registry and the Wire*
+// helpers use it for every topic they publish or subscribe to, so a
+// deployment can fit otto into an existing topic hierarchy.
+type Topics interface {
+	// State returns the MQTT topic for a device's state.
+	State(name string) string
+	// Set returns the MQTT topic for a device's set command.
+	Set(name string) string
+	// Event returns the MQTT topic for a device's events.
+	Event(name string) string
+	// Status returns the MQTT topic for a device's status.
+	Status(name string) string
+	// Meta returns the MQTT topic for a device's metadata.
+	Meta(name string) string
+	// RPC returns the MQTT topic a device receives RPC requests on.
+	RPC(name string) string
+	// Reply returns the MQTT topic RPC responses for caller are sent to.
+	Reply(caller string) string
+}
+
+// AckTopics is implemented by Topics that place set command acks
+// themselves. See AckTopic.
+type AckTopics interface {
+	// Ack returns the MQTT topic a device reports set command outcomes on.
+	Ack(name string) string
+}
+
+// StationTopics is implemented by Topics that place station status
+// themselves. See StationStatusTopic.
+type StationTopics interface {
+	// StationStatus returns the MQTT topic for a station's status, which
+	// carries the will of the station's connection.
+	StationStatus(station string) string
+}
+
+var (
+	_ Topics = TopicScheme{}
+	_ Topics = FlatScheme{}
+	_ Topics = StationScheme{}
+	_ Topics = (*TemplateScheme)(nil)
+
+	_ AckTopics     = TopicScheme{}
+	_ AckTopics     = FlatScheme{}
+	_ AckTopics     = StationScheme{}
+	_ AckTopics     = (*TemplateScheme)(nil)
+	_ StationTopics = TopicScheme{}
+	_ StationTopics = FlatScheme{}
+	_ StationTopics = StationScheme{}
+	_ StationTopics = (*TemplateScheme)(nil)
+)
+
+// AckTopic returns the topic device name reports set command outcomes
+// on. Schemes that do not implement AckTopics get "ack" next to the
+// device's status topic.
+func AckTopic(t Topics, name string) string {
+	if a, ok := t.(AckTopics); ok {
+		return a.Ack(name)
+	}
+	return path.Join(path.Dir(t.Status(name)), "ack")
+}
+
+// StationStatusTopic returns the status topic of station. Schemes that
+// do not implement StationTopics get the status topic of a device named
+// "stations/<station>".
+func StationStatusTopic(t Topics, station string) string {
+	if s, ok := t.(StationTopics); ok {
+		return s.StationStatus(station)
+	}
+	return t.Status(path.Join("stations", station))
+}
+
+// TopicScheme is the default layout: <prefix>/devices/<name>/<kind>.
 type TopicScheme struct {
 	Prefix string // e.g. "otto" or "home"
 }
@@ -23,3 +98,209 @@ func (s TopicScheme) Status(name string) string { return path.Join(s.base(name),
 
 // Meta returns the MQTT topic for a device's metadata.
 func (s TopicScheme) Meta(name string) string { return path.Join(s.base(name), "meta") }
+
+// RPC returns the MQTT topic a device receives RPC requests on.
+func (s TopicScheme) RPC(name string) string { return path.Join(s.base(name), "rpc") }
+
+// Ack returns the MQTT topic a device reports set command outcomes on.
+func (s TopicScheme) Ack(name string) string { return path.Join(s.base(name), "ack") }
+
+// Reply returns the MQTT topic RPC responses for caller are sent to.
+func (s TopicScheme) Reply(caller string) string { return path.Join(s.Prefix, "replies", caller) }
+
+// StationStatus returns <prefix>/stations/<station>/status.
+func (s TopicScheme) StationStatus(station string) string {
+	return path.Join(s.Prefix, "stations", station, "status")
+}
+
+// FlatScheme drops the "devices" level: <prefix>/<name>/<kind>.
+type FlatScheme struct {
+	Prefix string
+}
+
+// State returns <prefix>/<name>/state.
+func (s FlatScheme) State(name string) string { return path.Join(s.Prefix, name, "state") }
+
+// Set returns <prefix>/<name>/set.
+func (s FlatScheme) Set(name string) string { return path.Join(s.Prefix, name, "set") }
+
+// Event returns <prefix>/<name>/event.
+func (s FlatScheme) Event(name string) string { return path.Join(s.Prefix, name, "event") }
+
+// Status returns <prefix>/<name>/status.
+func (s FlatScheme) Status(name string) string { return path.Join(s.Prefix, name, "status") }
+
+// Meta returns <prefix>/<name>/meta.
+func (s FlatScheme) Meta(name string) string { return path.Join(s.Prefix, name, "meta") }
+
+// RPC returns <prefix>/<name>/rpc.
+func (s FlatScheme) RPC(name string) string { return path.Join(s.Prefix, name, "rpc") }
+
+// Ack returns <prefix>/<name>/ack.
+func (s FlatScheme) Ack(name string) string { return path.Join(s.Prefix, name, "ack") }
+
+// Reply returns <prefix>/replies/<caller>.
+func (s FlatScheme) Reply(caller string) string { return path.Join(s.Prefix, "replies", caller) }
+
+// StationStatus returns <prefix>/stations/<station>/status.
+func (s FlatScheme) StationStatus(station string) string {
+	return path.Join(s.Prefix, "stations", station, "status")
+}
+
+// StationScheme groups devices under their station:
+// <prefix>/<station>/<name>/<kind>.
+type StationScheme struct {
+	Prefix  string
+	Station string
+}
+
+func (s StationScheme) base(name string) string { return path.Join(s.Prefix, s.Station, name) }
+
+// State returns <prefix>/<station>/<name>/state.
+func (s StationScheme) State(name string) string { return path.Join(s.base(name), "state") }
+
+// Set returns <prefix>/<station>/<name>/set.
+func (s StationScheme) Set(name string) string { return path.Join(s.base(name), "set") }
+
+// Event returns <prefix>/<station>/<name>/event.
+func (s StationScheme) Event(name string) string { return path.Join(s.base(name), "event") }
+
+// Status returns <prefix>/<station>/<name>/status.
+func (s StationScheme) Status(name string) string { return path.Join(s.base(name), "status") }
+
+// Meta returns <prefix>/<station>/<name>/meta.
+func (s StationScheme) Meta(name string) string { return path.Join(s.base(name), "meta") }
+
+// RPC returns <prefix>/<station>/<name>/rpc.
+func (s StationScheme) RPC(name string) string { return path.Join(s.base(name), "rpc") }
+
+// Ack returns <prefix>/<station>/<name>/ack.
+func (s StationScheme) Ack(name string) string { return path.Join(s.base(name), "ack") }
+
+// Reply returns <prefix>/<station>/replies/<caller>.
+func (s StationScheme) Reply(caller string) string {
+	return path.Join(s.Prefix, s.Station, "replies", caller)
+}
+
+// StationStatus returns <prefix>/<station>/status. Use Station "+" to
+// build filters covering every station's devices.
+func (s StationScheme) StationStatus(station string) string {
+	return path.Join(s.Prefix, station, "status")
+}
+
+// TemplateScheme builds topics from a template configured at runtime,
+// e.g. "site/{station}/otto/{name}/{kind}". {name} and {kind} are filled
+// per topic; any other {var} comes from the vars given to
+// NewTemplateScheme.
+//
+// Reply topics use the same template with {name} set to "replies" and
+// {kind} set to the caller, keeping them inside the configured hierarchy.
+// Station status topics likewise set {name} to "stations/<station>" and
+// {kind} to "status".
+type TemplateScheme struct {
+	tmpl  string
+	parts []tmplPart
+}
+
+type tmplPart struct {
+	lit string
+	key string // "name", "kind" or "" for a literal
+}
+
+// NewTemplateScheme parses tmpl, substituting vars now. The template
+// must contain {name} and {kind}; unknown variables, and wildcards in
+// the template or in the values of the variables it uses, are an error.
+func NewTemplateScheme(tmpl string, vars map[string]string) (*TemplateScheme, error) {
+	s := &TemplateScheme{tmpl: tmpl}
+	var lit strings.Builder
+	seen := map[string]bool{}
+
+	rest := tmpl
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			lit.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("topic template %q: unclosed {", tmpl)
+		}
+		lit.WriteString(rest[:open])
+		key := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		switch key {
+		case "name", "kind":
+			s.parts = append(s.parts, tmplPart{lit: lit.String()}, tmplPart{key: key})
+			lit.Reset()
+			seen[key] = true
+		default:
+			v, ok := vars[key]
+			if !ok {
+				return nil, fmt.Errorf("topic template %q: unknown variable {%s}", tmpl, key)
+			}
+			if strings.ContainsAny(v, "+#") {
+				return nil, fmt.Errorf("topic template %q: variable {%s}=%q: %w", tmpl, key, v, ErrInvalidTopic)
+			}
+			lit.WriteString(v)
+		}
+	}
+	s.parts = append(s.parts, tmplPart{lit: lit.String()})
+
+	if !seen["name"] || !seen["kind"] {
+		return nil, fmt.Errorf("topic template %q: must contain {name} and {kind}", tmpl)
+	}
+	if strings.ContainsAny(tmpl, "+#") {
+		return nil, fmt.Errorf("topic template %q: %w", tmpl, ErrInvalidTopic)
+	}
+	return s, nil
+}
+
+// String returns the template as configured.
+func (s *TemplateScheme) String() string { return s.tmpl }
+
+func (s *TemplateScheme) expand(name, kind string) string {
+	var b strings.Builder
+	for _, p := range s.parts {
+		switch p.key {
+		case "name":
+			b.WriteString(name)
+		case "kind":
+			b.WriteString(kind)
+		default:
+			b.WriteString(p.lit)
+		}
+	}
+	return b.String()
+}
+
+// State expands the template with {kind}="state".
+func (s *TemplateScheme) State(name string) string { return s.expand(name, "state") }
+
+// Set expands the template with {kind}="set".
+func (s *TemplateScheme) Set(name string) string { return s.expand(name, "set") }
+
+// Event expands the template with {kind}="event".
+func (s *TemplateScheme) Event(name string) string { return s.expand(name, "event") }
+
+// Status expands the template with {kind}="status".
+func (s *TemplateScheme) Status(name string) string { return s.expand(name, "status") }
+
+// Meta expands the template with {kind}="meta".
+func (s *TemplateScheme) Meta(name string) string { return s.expand(name, "meta") }
+
+// RPC expands the template with {kind}="rpc".
+func (s *TemplateScheme) RPC(name string) string { return s.expand(name, "rpc") }
+
+// Ack expands the template with {kind}="ack".
+func (s *TemplateScheme) Ack(name string) string { return s.expand(name, "ack") }
+
+// Reply expands the template with {name}="replies" and {kind}=caller.
+func (s *TemplateScheme) Reply(caller string) string { return s.expand("replies", caller) }
+
+// StationStatus expands the template with {name}="stations/<station>"
+// and {kind}="status".
+func (s *TemplateScheme) StationStatus(station string) string {
+	return s.expand(path.Join("stations", station), "status")
+}
@@ -1,6 +1,7 @@
 package messenger
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -22,6 +23,10 @@ func TestTopicSchemePaths(t *testing.T) {
 		{name: "event", got: scheme.Event("lamp"), expected: "otto/devices/lamp/event"},
 		{name: "status", got: scheme.Status("lamp"), expected: "otto/devices/lamp/status"},
 		{name: "meta", got: scheme.Meta("lamp"), expected: "otto/devices/lamp/meta"},
+		{name: "rpc", got: scheme.RPC("lamp"), expected: "otto/devices/lamp/rpc"},
+		{name: "ack", got: scheme.Ack("lamp"), expected: "otto/devices/lamp/ack"},
+		{name: "reply", got: scheme.Reply("abc"), expected: "otto/replies/abc"},
+		{name: "station", got: scheme.StationStatus("garden"), expected: "otto/stations/garden/status"},
 	}
 
 	for _, tc := range tests {
@@ -48,3 +53,105 @@ func TestStateAs(t *testing.T) {
 	_, ok = StateAs[int](reg, "relay")
 	assert.False(t, ok)
 }
+
+func TestAlternativeTopicSchemes(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := NewTemplateScheme("site/{station}/otto/{name}/{kind}", map[string]string{"station": "garden"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		scheme Topics
+		state  string
+		set    string
+		reply  string
+		status string
+	}{
+		{
+			name:   "flat",
+			scheme: FlatScheme{Prefix: "home"},
+			state:  "home/lamp/state",
+			set:    "home/lamp/set",
+			reply:  "home/replies/abc",
+			status: "home/stations/garden/status",
+		},
+		{
+			name:   "station",
+			scheme: StationScheme{Prefix: "otto", Station: "garden"},
+			state:  "otto/garden/lamp/state",
+			set:    "otto/garden/lamp/set",
+			reply:  "otto/garden/replies/abc",
+			status: "otto/garden/status",
+		},
+		{
+			name:   "template",
+			scheme: tmpl,
+			state:  "site/garden/otto/lamp/state",
+			set:    "site/garden/otto/lamp/set",
+			reply:  "site/garden/otto/replies/abc",
+			status: "site/garden/otto/stations/garden/status",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.state, tc.scheme.State("lamp"))
+			assert.Equal(t, tc.set, tc.scheme.Set("lamp"))
+			assert.Equal(t, tc.reply, tc.scheme.Reply("abc"))
+			assert.Equal(t, tc.status, StationStatusTopic(tc.scheme, "garden"))
+		})
+	}
+}
+
+func TestNewTemplateSchemeErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tmpl := range []string{
+		"otto/{name}",
+		"otto/{kind}",
+		"otto/{site}/{name}/{kind}",
+		"otto/{name}/{kind",
+		"otto/+/{name}/{kind}",
+	} {
+		_, err := NewTemplateScheme(tmpl, nil)
+		assert.Error(t, err, tmpl)
+	}
+
+	// Variables must not smuggle wildcards into topics.
+	for _, v := range []string{"+", "#", "a/+/b"} {
+		_, err := NewTemplateScheme("site/{station}/{name}/{kind}", map[string]string{"station": v})
+		assert.ErrorIs(t, err, ErrInvalidTopic, v)
+	}
+}
+
+func TestOptionalTopics(t *testing.T) {
+	t.Parallel()
+
+	// Only the core methods, as a scheme written before acks and station
+	// status were added.
+	var core Topics = struct{ Topics }{TopicScheme{Prefix: "otto"}}
+	_, ok := core.(AckTopics)
+	require.False(t, ok)
+	assert.Equal(t, "otto/devices/lamp/ack", AckTopic(core, "lamp"))
+	assert.Equal(t, "otto/devices/stations/garden/status", StationStatusTopic(core, "garden"))
+
+	flat := FlatScheme{Prefix: "home"}
+	assert.Equal(t, "home/lamp/ack", AckTopic(flat, "lamp"))
+	assert.Equal(t, "home/stations/garden/status", StationStatusTopic(flat, "garden"))
+}
+
+func TestRegistryUsesTopicScheme(t *testing.T) {
+	t.Parallel()
+
+	mqtt := newRegistryMQTT()
+	reg := NewRegistry(mqtt, FlatScheme{Prefix: "home"})
+	reg.publishStatus(context.Background(), "lamp", StatusPayload{Status: StatusOnline})
+
+	pubs, _, _, _ := mqtt.snapshot()
+	require.Len(t, pubs, 1)
+	assert.Equal(t, "home/lamp/status", pubs[0].topic)
+
+	assert.Equal(t, TopicScheme{Prefix: "otto"}, NewRegistry(nil, nil).Topics)
+}
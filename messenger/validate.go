@@ -0,0 +1,190 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/rustyeddy/devices"
+)
+
+var (
+	// ErrReadOnly rejects set commands for devices whose descriptor
+	// Access is devices.ReadOnly.
+	ErrReadOnly = errors.New("device is read-only")
+
+	// ErrOutOfRange rejects set values outside the descriptor's Min/Max.
+	ErrOutOfRange = errors.New("value out of range")
+)
+
+// AttrSetRange is the descriptor attribute that overrides
+// Registry.ClampSets for one device: "clamp" or "reject".
+const AttrSetRange = "set_range"
+
+// RangeError reports a set value outside the descriptor's Min/Max.
+type RangeError struct {
+	Value    float64
+	Min, Max *float64
+}
+
+func (e *RangeError) Error() string {
+	bound := func(f *float64) string {
+		if f == nil {
+			return "_"
+		}
+		return fmt.Sprint(*f)
+	}
+	return fmt.Sprintf("%v: %v not in [%s, %s]", ErrOutOfRange, e.Value, bound(e.Min), bound(e.Max))
+}
+
+func (e *RangeError) Unwrap() error { return ErrOutOfRange }
+
+// ValidateSet checks v against desc before it is delivered to a device.
+// Writes to devices.ReadOnly devices fail with ErrReadOnly. Numeric values outside
+// Min/Max fail with a *RangeError, or are clamped into range when clamp
+// is set; clamped reports whether that happened. Integers are compared
+// exactly and clamp to the nearest integer of their type in range; when
+// there is none they fail even with clamp. Non-numeric values are only
+// checked for access.
+func ValidateSet[T any](desc devices.Descriptor, v T, clamp bool) (out T, clamped bool, err error) {
+	if desc.Access == devices.ReadOnly {
+		return v, false, ErrReadOnly
+	}
+	if desc.Min == nil && desc.Max == nil {
+		return v, false, nil
+	}
+
+	rv := reflect.ValueOf(&v).Elem()
+	rangeErr := func(f float64) error { return &RangeError{Value: f, Min: desc.Min, Max: desc.Max} }
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// Compare as integers: float64 loses precision beyond 2^53. The
+		// type's limits are powers of two, so they convert exactly.
+		n := rv.Int()
+		hi := int64(math.MaxInt64 >> (64 - rv.Type().Bits()))
+		lo := -hi - 1
+		empty := false
+		if desc.Min != nil {
+			m := math.Ceil(*desc.Min)
+			empty = m >= 0x1p63
+			if m > float64(lo) && !empty {
+				lo = int64(m)
+			}
+		}
+		if desc.Max != nil {
+			m := math.Floor(*desc.Max)
+			empty = empty || m < -0x1p63
+			if m < float64(hi) && !empty {
+				hi = int64(m)
+			}
+		}
+		switch {
+		case empty || lo > hi:
+			// No integer of this type is in range.
+			return v, false, rangeErr(float64(n))
+		case n >= lo && n <= hi:
+			return v, false, nil
+		case !clamp:
+			return v, false, rangeErr(float64(n))
+		}
+		rv.SetInt(min(max(n, lo), hi))
+		return v, true, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := rv.Uint()
+		hi := uint64(math.MaxUint64 >> (64 - rv.Type().Bits()))
+		lo := uint64(0)
+		empty := false
+		if desc.Min != nil {
+			m := math.Ceil(*desc.Min)
+			empty = m >= 0x1p64
+			if m > 0 && !empty {
+				lo = uint64(m)
+			}
+		}
+		if desc.Max != nil {
+			m := math.Floor(*desc.Max)
+			empty = empty || m < 0
+			if m < float64(hi) && !empty {
+				hi = uint64(m)
+			}
+		}
+		switch {
+		case empty || lo > hi:
+			return v, false, rangeErr(float64(n))
+		case n >= lo && n <= hi:
+			return v, false, nil
+		case !clamp:
+			return v, false, rangeErr(float64(n))
+		}
+		rv.SetUint(min(max(n, lo), hi))
+		return v, true, nil
+
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) {
+			return v, false, rangeErr(f)
+		}
+		lo, hi := math.Inf(-1), math.Inf(1)
+		if desc.Min != nil {
+			lo = *desc.Min
+		}
+		if desc.Max != nil {
+			hi = *desc.Max
+		}
+		if f >= lo && f <= hi {
+			return v, false, nil
+		}
+		if !clamp {
+			return v, false, rangeErr(f)
+		}
+		rv.SetFloat(math.Min(math.Max(f, lo), hi))
+		return v, true, nil
+	}
+	return v, false, nil
+}
+
+// checkSet validates v for a device wired with WireSink and reports a
+// rejection or clamp of command id on the device's ack and event topics.
+func checkSet[T any](ctx context.Context, r *Registry, name, id string, desc *devices.Descriptor, v T) (T, error) {
+	if desc == nil {
+		return v, nil
+	}
+
+	clamp := r.ClampSets
+	switch desc.Attributes[AttrSetRange] {
+	case "clamp":
+		clamp = true
+	case "reject":
+		clamp = false
+	}
+
+	out, clamped, err := ValidateSet(*desc, v, clamp)
+	switch {
+	case err != nil:
+		r.Log.Warn("set rejected", "device", name, "error", err)
+		r.reportSet(ctx, name, AckPayload{ID: id, Status: AckRejected, Error: err.Error()})
+	case clamped:
+		r.Log.Warn("set clamped", "device", name, "value", out)
+		b, _ := json.Marshal(out)
+		r.reportSet(ctx, name, AckPayload{ID: id, Status: AckClamped, Value: b, Error: fmt.Sprintf("%v clamped to %v", v, out)})
+	}
+	return out, err
+}
+
+// reportSet publishes a set outcome on the ack topic and as a
+// "set_<status>" event.
+func (r *Registry) reportSet(ctx context.Context, name string, ack AckPayload) {
+	ack.Time = time.Now()
+	r.publishAck(ctx, name, ack)
+
+	ev := EventPayload{Device: name, Kind: "set_" + ack.Status, Time: ack.Time, Msg: ack.Error}
+	if ack.Status == AckRejected || ack.Status == AckTimeout {
+		ev.Err = ack.Error
+	}
+	r.publishEvent(ctx, name, ev)
+}
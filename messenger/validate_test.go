@@ -0,0 +1,150 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/devices"
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fptr(f float64) *float64 { return &f }
+
+func TestValidateSet(t *testing.T) {
+	t.Parallel()
+
+	rng := devices.Descriptor{Access: devices.ReadWrite, Min: fptr(0), Max: fptr(100)}
+
+	_, _, err := ValidateSet(devices.Descriptor{Access: devices.ReadOnly}, true, false)
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	v, clamped, err := ValidateSet(rng, 42.5, false)
+	require.NoError(t, err)
+	assert.False(t, clamped)
+	assert.Equal(t, 42.5, v)
+
+	_, _, err = ValidateSet(rng, 150.0, false)
+	var re *RangeError
+	require.True(t, errors.As(err, &re))
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	assert.Equal(t, 150.0, re.Value)
+
+	_, _, err = ValidateSet(rng, math.NaN(), true)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	f, clamped, err := ValidateSet(rng, 150.0, true)
+	require.NoError(t, err)
+	assert.True(t, clamped)
+	assert.Equal(t, 100.0, f)
+
+	frac := devices.Descriptor{Min: fptr(0.5), Max: fptr(9.5)}
+	n, _, err := ValidateSet(frac, -3, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	u, _, err := ValidateSet(frac, uint8(200), true)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(9), u)
+
+	// No integer lies in [0.2, 0.8], so there is nothing to clamp to.
+	_, _, err = ValidateSet(devices.Descriptor{Min: fptr(0.2), Max: fptr(0.8)}, 1, true)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, _, err = ValidateSet(devices.Descriptor{Min: fptr(300)}, int8(5), true)
+	assert.ErrorIs(t, err, ErrOutOfRange, "no int8 reaches the minimum")
+	_, _, err = ValidateSet(devices.Descriptor{Max: fptr(-1)}, uint(5), true)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	// Large integers compare exactly: 2^53+1 is above a 2^53 maximum,
+	// though both are the same float64.
+	big := devices.Descriptor{Max: fptr(1 << 53)}
+	_, _, err = ValidateSet(big, int64(1<<53+1), false)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	i, clamped, err := ValidateSet(big, int64(1<<53+1), true)
+	require.NoError(t, err)
+	assert.True(t, clamped)
+	assert.Equal(t, int64(1<<53), i)
+	_, _, err = ValidateSet(big, uint64(1<<53+1), false)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, _, err = ValidateSet(devices.Descriptor{Min: fptr(0), Max: fptr(math.MaxUint64)}, uint64(math.MaxUint64), false)
+	assert.NoError(t, err)
+
+	// Non-numeric values are only checked for access.
+	s, _, err := ValidateSet(rng, "high", false)
+	require.NoError(t, err)
+	assert.Equal(t, "high", s)
+}
+
+type describedSink struct {
+	*testutils.Sink[float64]
+	desc devices.Descriptor
+}
+
+func (d describedSink) Descriptor() devices.Descriptor { return d.desc }
+
+func TestWireSinkValidatesSets(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := newLoopMQTT()
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	reg.SetRPC = true
+	pump := describedSink{
+		Sink: testutils.NewSink[float64]("pump", 1),
+		desc: devices.Descriptor{Name: "pump", Access: devices.ReadWrite, Min: fptr(0), Max: fptr(100)},
+	}
+	WireSink(ctx, reg, pump, codec.JSON[float64]{})
+
+	acks := make(chan AckPayload, 4)
+	events := make(chan map[string]any, 4)
+	_, err := mqtt.Subscribe(ctx, "otto/devices/pump/ack", 1, func(m Message) {
+		var a AckPayload
+		require.NoError(t, json.Unmarshal(m.Payload, &a))
+		acks <- a
+	})
+	require.NoError(t, err)
+	_, err = mqtt.Subscribe(ctx, "otto/devices/pump/event", 0, func(m Message) {
+		var e map[string]any
+		require.NoError(t, json.Unmarshal(m.Payload, &e))
+		events <- e
+	})
+	require.NoError(t, err)
+	reg.ResubscribeAll(ctx)
+
+	require.NoError(t, mqtt.Publish(ctx, "otto/devices/pump/set", []byte("150"), false, 1))
+	ack, ok := testutils.WaitRecv(acks, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "rejected", ack.Status)
+	assert.Contains(t, ack.Error, "out of range")
+	evt, ok := testutils.WaitRecv(events, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "set_rejected", evt["kind"])
+	_, delivered := pump.TryRead()
+	assert.False(t, delivered)
+
+	// RPC callers see the rejection too.
+	_, err = reg.Call(ctx, "pump", "set", -1)
+	var rpcErr *RPCError
+	require.True(t, errors.As(err, &rpcErr))
+	assert.Contains(t, rpcErr.Msg, "out of range")
+	testutils.Drain(acks)
+	testutils.Drain(events)
+
+	// Clamping delivers the bound and says so.
+	reg.ClampSets = true
+	require.NoError(t, mqtt.Publish(ctx, "otto/devices/pump/set", []byte("150"), false, 1))
+	got, ok := testutils.WaitRecv(pump.Get(), time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 100.0, got)
+	ack, ok = testutils.WaitRecv(acks, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "clamped", ack.Status)
+	assert.JSONEq(t, "100", string(ack.Value))
+}
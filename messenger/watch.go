@@ -0,0 +1,177 @@
+package messenger
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StateUpdate is one state change recorded by WireSource.
+type StateUpdate struct {
+	Device string
+	Raw    []byte // encoded payload as published
+	Value  any    // decoded value
+	Time   time.Time
+}
+
+// SlowPolicy decides what happens when a watcher's buffer is full.
+// State is always delivered without blocking the publishing WireSource.
+type SlowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered update to make room, so a
+	// watcher that catches up sees the latest state. The default.
+	DropOldest SlowPolicy = iota
+	// DropNewest discards the incoming update.
+	DropNewest
+	// Disconnect stops the watcher, closing its channel.
+	Disconnect
+)
+
+// DefaultWatchBuffer is a watcher's channel capacity unless WatchBuffer
+// is given.
+const DefaultWatchBuffer = 16
+
+// WatchOption configures a watcher.
+type WatchOption func(*Watcher)
+
+// WatchBuffer sets the watcher's channel capacity.
+func WatchBuffer(n int) WatchOption {
+	return func(w *Watcher) { w.buf = max(n, 1) }
+}
+
+// WatchPolicy sets how the watcher handles a full buffer.
+func WatchPolicy(p SlowPolicy) WatchOption {
+	return func(w *Watcher) { w.policy = p }
+}
+
+// Watcher receives state updates on C until Stop is called.
+type Watcher struct {
+	C <-chan StateUpdate
+
+	r       *Registry
+	device  string // "" for all devices
+	buf     int
+	policy  SlowPolicy
+	dropped atomic.Uint64
+
+	mu     sync.Mutex
+	ch     chan StateUpdate
+	closed bool
+}
+
+// Watch returns a watcher for one device's state updates.
+func (r *Registry) Watch(name string, opts ...WatchOption) *Watcher {
+	return r.watch(name, opts)
+}
+
+// WatchAll returns a watcher for every device's state updates.
+func (r *Registry) WatchAll(opts ...WatchOption) *Watcher {
+	return r.watch("", opts)
+}
+
+func (r *Registry) watch(name string, opts []WatchOption) *Watcher {
+	w := &Watcher{r: r, device: name, buf: DefaultWatchBuffer}
+	for _, o := range opts {
+		o(w)
+	}
+	w.ch = make(chan StateUpdate, w.buf)
+	w.C = w.ch
+
+	r.watchMu.Lock()
+	r.watchers[w] = struct{}{}
+	r.watchMu.Unlock()
+	return w
+}
+
+// Stop unregisters the watcher and closes C. It is safe to call more
+// than once.
+func (w *Watcher) Stop() {
+	w.r.watchMu.Lock()
+	delete(w.r.watchers, w)
+	w.r.watchMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
+
+// Dropped reports how many updates the slow-consumer policy discarded.
+func (w *Watcher) Dropped() uint64 { return w.dropped.Load() }
+
+// send delivers u without blocking, applying the slow-consumer policy.
+// It reports false if the watcher should be disconnected.
+func (w *Watcher) send(u StateUpdate) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return true
+	}
+	for {
+		select {
+		case w.ch <- u:
+			return true
+		default:
+		}
+
+		w.dropped.Add(1)
+		switch w.policy {
+		case DropNewest:
+			return true
+		case Disconnect:
+			return false
+		}
+		// DropOldest: make room and retry.
+		select {
+		case <-w.ch:
+		default:
+		}
+	}
+}
+
+// notifyWatchers fans a state update out to matching watchers.
+func (r *Registry) notifyWatchers(u StateUpdate) {
+	r.watchMu.Lock()
+	var ws []*Watcher
+	for w := range r.watchers {
+		if w.device == "" || w.device == u.Device {
+			ws = append(ws, w)
+		}
+	}
+	r.watchMu.Unlock()
+
+	for _, w := range ws {
+		if !w.send(u) {
+			r.Log.Warn("state watcher disconnected: too slow", "device", u.Device, "dropped", w.Dropped())
+			w.Stop()
+		}
+	}
+}
+
+// WatchAs streams a device's decoded state as T until ctx ends, when the
+// channel is closed. Updates whose value is not a T are skipped.
+func WatchAs[T any](ctx context.Context, r *Registry, name string, opts ...WatchOption) <-chan T {
+	w := r.Watch(name, opts...)
+	out := make(chan T, cap(w.ch))
+
+	context.AfterFunc(ctx, w.Stop)
+	go func() {
+		defer close(out)
+		for u := range w.C {
+			v, ok := u.Value.(T)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
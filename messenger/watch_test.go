@@ -0,0 +1,122 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rustyeddy/otto/internal/testutils"
+	"github.com/rustyeddy/otto/messenger/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func values(t *testing.T, w *Watcher) []any {
+	t.Helper()
+	var out []any
+	for {
+		select {
+		case u, ok := <-w.C:
+			if !ok {
+				return out
+			}
+			out = append(out, u.Value)
+		default:
+			return out
+		}
+	}
+}
+
+func TestWatchFiltersByDevice(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(newRegistryMQTT(), nil)
+	lamp := reg.Watch("lamp")
+	all := reg.WatchAll()
+	t.Cleanup(lamp.Stop)
+	t.Cleanup(all.Stop)
+
+	reg.setState("lamp", []byte("true"), true)
+	reg.setState("pump", []byte("3"), 3)
+
+	u, ok := testutils.WaitRecv(lamp.C, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "lamp", u.Device)
+	assert.Equal(t, []byte("true"), u.Raw)
+	assert.Equal(t, true, u.Value)
+	assert.False(t, u.Time.IsZero())
+	assert.Empty(t, values(t, lamp))
+
+	assert.Equal(t, []any{true, 3}, values(t, all))
+}
+
+func TestWatchSlowPolicies(t *testing.T) {
+	t.Parallel()
+
+	reg := NewRegistry(newRegistryMQTT(), nil)
+	oldest := reg.Watch("pump", WatchBuffer(2))
+	newest := reg.Watch("pump", WatchBuffer(2), WatchPolicy(DropNewest))
+	disc := reg.Watch("pump", WatchBuffer(2), WatchPolicy(Disconnect))
+
+	// Nobody reads: WireSource's setState must still never block.
+	for i := 1; i <= 4; i++ {
+		reg.setState("pump", nil, i)
+	}
+
+	assert.Equal(t, []any{3, 4}, values(t, oldest))
+	assert.EqualValues(t, 2, oldest.Dropped())
+
+	assert.Equal(t, []any{1, 2}, values(t, newest))
+	assert.EqualValues(t, 2, newest.Dropped())
+
+	assert.Equal(t, []any{1, 2}, values(t, disc))
+	_, open := <-disc.C
+	assert.False(t, open, "slow watcher is disconnected")
+
+	reg.watchMu.Lock()
+	assert.Len(t, reg.watchers, 2)
+	reg.watchMu.Unlock()
+
+	oldest.Stop()
+	oldest.Stop()
+	_, open = <-oldest.C
+	assert.False(t, open)
+}
+
+func TestWatchAs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newWireMQTT(), nil)
+	src := testutils.NewSource[float64]("temp", 1)
+	WireSource(ctx, reg, src, codec.JSON[float64]{})
+
+	wctx, stop := context.WithCancel(ctx)
+	temps := WatchAs[float64](wctx, reg, "temp")
+
+	src.Set() <- 21.5
+	v, ok := testutils.WaitRecv(temps, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 21.5, v)
+
+	// Values of another type are skipped.
+	reg.setState("temp", []byte(`"n/a"`), "n/a")
+	src.Set() <- 22
+	v, ok = testutils.WaitRecv(temps, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 22.0, v)
+
+	stop()
+	require.NoError(t, testutils.Eventually(time.Second, time.Millisecond, func() error {
+		select {
+		case _, open := <-temps:
+			if !open {
+				return nil
+			}
+		default:
+		}
+		return assert.AnError
+	}))
+}
@@ -2,6 +2,9 @@ package messenger
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/rustyeddy/devices"
@@ -9,10 +12,44 @@ import (
 )
 
 // WireSource publishes device.Out() to MQTT .../state (JSON-encoded).
+// The device's PublishPolicy (see SetPublishPolicy) decides which values
+// are published; only published values reach the state cache.
 func WireSource[T any](ctx context.Context, r *Registry, dev devices.Source[T], c codec.Codec[T]) {
 	name := dev.Name()
+	ctx = r.deviceContext(ctx, name)
+	r.setStateDecoder(name, func(b []byte) (any, error) { return c.Unmarshal(b) })
+	gate := newPublishGate(r.publishPolicy(dev), dev)
+
+	publish := func(v T, b []byte) {
+		gate.published(v, b, time.Now())
+
+		// cache (and persist, if a Store is set)
+		r.setState(name, b, v)
+
+		t := r.Topics.State(name)
+		msg := Message{Topic: t, Payload: b, Retain: r.RetainState, QoS: r.QoSState}
+		if ct, ok := c.(codec.ContentTyper); ok {
+			msg.Properties = &Properties{ContentType: ct.ContentType()}
+		}
+		if err := r.publish(ctx, name, msg); err != nil {
+			r.Log.Error("failed to publish", "topic", t, "error", err)
+		}
+	}
 
 	go func() {
+		// held: latest value waiting out MinInterval; latest: last value
+		// seen, for the MaxInterval heartbeat.
+		var (
+			held, latest       *T
+			heldRaw, latestRaw []byte
+			hold, heartbeat    <-chan time.Time
+		)
+		beat := func() {
+			if gate.p.MaxInterval > 0 {
+				heartbeat = time.After(gate.p.MaxInterval)
+			}
+		}
+
 		for {
 			select {
 			case v, ok := <-dev.Out():
@@ -24,21 +61,40 @@ func WireSource[T any](ctx context.Context, r *Registry, dev devices.Source[T],
 				b, err := c.Marshal(v)
 				if err != nil {
 					r.Log.Warn("state marshal failed", "device", name, "error", err)
+					r.Metrics.marshalError(name)
+					continue
+				}
+				latest, latestRaw = &v, b
+
+				if !gate.changed(v, b) {
+					held = nil
 					continue
 				}
+				if wait, early := gate.early(time.Now()); early {
+					if hold == nil {
+						hold = time.After(wait)
+					}
+					held, heldRaw = &v, b
+					continue
+				}
+				held, hold = nil, nil
+				publish(v, b)
+				beat()
 
-				// cache
-				r.stateMu.Lock()
-				r.stateRaw[name] = b
-				r.stateAny[name] = v
-				r.stateMu.Unlock()
+			case <-hold:
+				hold = nil
+				if held != nil && gate.changed(*held, heldRaw) {
+					publish(*held, heldRaw)
+					beat()
+				}
+				held = nil
 
-				// publish
-				t := r.Topics.State(name)
-				err = r.MQTT.Publish(ctx, t, b, r.RetainState, r.QoSState)
-				if err != nil {
-					r.Log.Error("failed to publish", "topic", t, "error", err)
+			case <-heartbeat:
+				heartbeat = nil
+				if latest != nil {
+					publish(*latest, latestRaw)
 				}
+				beat()
 
 			case <-ctx.Done():
 				return
@@ -47,34 +103,117 @@ func WireSource[T any](ctx context.Context, r *Registry, dev devices.Source[T],
 	}()
 }
 
+// ErrSetTimeout is returned when a device does not accept a set value
+// within the Registry's CommandTimeout.
+var ErrSetTimeout = errors.New("set delivery timeout")
+
+// ErrNotSettable is returned by Set for devices without a WireSink.
+var ErrNotSettable = errors.New("device is not settable")
+
+// Set delivers an encoded value to a device wired with WireSink, in
+// process and with the sink's codec, as a message on its set topic
+// would be. The error reports decode or delivery failures.
+func (r *Registry) Set(ctx context.Context, name string, payload []byte) error {
+	r.rpcMu.Lock()
+	fn := r.rpcHandlers[name]["set"]
+	r.rpcMu.Unlock()
+	if fn == nil {
+		return fmt.Errorf("%s: %w", name, ErrNotSettable)
+	}
+	_, err := fn(ctx, payload)
+	return err
+}
+
 // WireSink subscribes to MQTT .../set and delivers decoded values into device.In().
 // Uses timeout so MQTT callback doesn't block forever.
+// Devices with a descriptor have values checked by ValidateSet first.
+// Outcomes are published on .../ack; commands sent with an id (see
+// SetCommand) are also acked when accepted and when the device's state
+// next reflects the value.
+// It also registers a "set" RPC method, used by Registry.Set and, with
+// Registry.SetRPC, served over MQTT so callers of Registry.Call learn
+// the outcome.
 func WireSink[T any](ctx context.Context, r *Registry, dev devices.Sink[T], c codec.Codec[T]) {
 	name := dev.Name()
+	ctx = r.deviceContext(ctx, name)
 	setTopic := r.Topics.Set(name)
 	in := dev.In()
 
-	r.WantSub(setTopic, r.QoSSet, func(m Message) {
-		v, err := c.Unmarshal(m.Payload)
+	var desc *devices.Descriptor
+	if d, ok := DescriptorOf(dev); ok {
+		desc = &d
+	}
+
+	r.wantDeviceSub(name, setTopic, r.QoSSet, func(m Message) {
+		id, payload := parseSetCommand(m)
+		v, err := c.Unmarshal(payload)
 		if err != nil {
 			r.Log.Warn("set unmarshal failed", "device", name, "topic", m.Topic, "error", err)
+			r.reportSet(ctx, name, AckPayload{ID: id, Status: AckRejected, Error: err.Error()})
 			return
 		}
-
-		timeout := r.CommandTimeout
-		if timeout <= 0 {
-			timeout = 2 * time.Second
+		if v, err = checkSet(ctx, r, name, id, desc, v); err != nil {
+			return
 		}
 
-		select {
-		case in <- v:
-			// delivered
-		case <-time.After(timeout):
+		// The applied ack compares the device's state with the value
+		// as this codec encodes it.
+		want, _ := c.Marshal(v)
+		p := r.acks.expect(name, id, want)
+
+		err = deliverSet(ctx, in, v, r.CommandTimeout)
+		r.Metrics.setDelivery(name, err)
+		if err != nil {
+			r.acks.failed(name, p)
+		}
+		switch {
+		case errors.Is(err, ErrSetTimeout):
 			r.Log.Warn("set delivery timeout", "device", name, "topic", m.Topic)
-		case <-ctx.Done():
-			return
+			r.reportSet(ctx, name, AckPayload{ID: id, Status: AckTimeout, Error: err.Error()})
+		case err == nil && id != "":
+			r.publishAck(ctx, name, AckPayload{ID: id, Status: AckAccepted})
+			if r.acks.accepted(name, p) {
+				r.publishAck(ctx, name, AckPayload{ID: id, Status: AckApplied})
+			}
 		}
 	})
+
+	r.handle(name, "set", func(rctx context.Context, args json.RawMessage) (any, error) {
+		v, err := c.Unmarshal(args)
+		if err != nil {
+			return nil, fmt.Errorf("set unmarshal: %w", err)
+		}
+		if v, err = checkSet(rctx, r, name, "", desc, v); err != nil {
+			return nil, err
+		}
+
+		rctx, cancel := context.WithCancel(rctx)
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		err = deliverSet(rctx, in, v, r.CommandTimeout)
+		r.Metrics.setDelivery(name, err)
+		return nil, err
+	}, r.SetRPC)
+}
+
+// deliverSet pushes v into in, giving up after timeout or when ctx ends.
+func deliverSet[T any](ctx context.Context, in chan<- T, v T, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case in <- v:
+		return nil
+	case <-t.C:
+		return ErrSetTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // WireDuplex wires both state publish and set subscribe.
@@ -89,12 +89,12 @@ func TestWireSinkDeliversToDevice(t *testing.T) {
 
 	WireSink(ctx, reg, sink, codec.JSON[int]{})
 
-	sub, ok := reg.subs["otto/devices/relay/set"]
-	require.True(t, ok)
+	hs := handlers(reg.subs, "otto/devices/relay/set")
+	require.Len(t, hs, 1)
 
 	payload, err := json.Marshal(7)
 	require.NoError(t, err)
-	sub.handler(Message{Topic: "otto/devices/relay/set", Payload: payload})
+	hs[0](Message{Topic: "otto/devices/relay/set", Payload: payload})
 
 	select {
 	case got := <-sink.Get():
@@ -117,15 +117,15 @@ func TestWireSinkContextCancelReturns(t *testing.T) {
 
 	WireSink(ctx, reg, sink, codec.JSON[int]{})
 
-	sub, ok := reg.subs["otto/devices/relay/set"]
-	require.True(t, ok)
+	hs := handlers(reg.subs, "otto/devices/relay/set")
+	require.Len(t, hs, 1)
 
 	payload, err := json.Marshal(9)
 	require.NoError(t, err)
 
 	done := make(chan struct{})
 	go func() {
-		sub.handler(Message{Topic: "otto/devices/relay/set", Payload: payload})
+		hs[0](Message{Topic: "otto/devices/relay/set", Payload: payload})
 		close(done)
 	}()
 
@@ -138,3 +138,76 @@ func TestWireSinkContextCancelReturns(t *testing.T) {
 		require.Fail(t, "handler did not return on canceled context")
 	}
 }
+
+type propsMQTT struct {
+	wireMQTT
+	msgs chan Message
+}
+
+func (m *propsMQTT) PublishMessage(ctx context.Context, msg Message) error {
+	m.msgs <- msg
+	return nil
+}
+
+func TestWireSourceSetsContentType(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	mqtt := &propsMQTT{msgs: make(chan Message, 1)}
+	reg := NewRegistry(mqtt, TopicScheme{Prefix: "otto"})
+	src := testutils.NewSource[int]("src", 8)
+	WireSource(ctx, reg, src, codec.JSON[int]{})
+
+	src.Set() <- 1
+
+	select {
+	case m := <-mqtt.msgs:
+		require.NotNil(t, m.Properties)
+		assert.Equal(t, "application/json", m.Properties.ContentType)
+	case <-ctx.Done():
+		require.Fail(t, "publish not received")
+	}
+}
+
+func TestRegistrySetDeliversInProcess(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newWireMQTT(), TopicScheme{Prefix: "otto"})
+	sink := testutils.NewSink[int]("relay", 1)
+	WireSink(ctx, reg, sink, codec.JSON[int]{})
+
+	require.NoError(t, reg.Set(ctx, "relay", []byte("3")))
+	got, ok := sink.TryRead()
+	require.True(t, ok)
+	assert.Equal(t, 3, got)
+
+	assert.Error(t, reg.Set(ctx, "relay", []byte(`"x"`)))
+	assert.ErrorIs(t, reg.Set(ctx, "ghost", []byte("1")), ErrNotSettable)
+}
+
+func TestOnStateObservesWireSource(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+
+	reg := NewRegistry(newWireMQTT(), TopicScheme{Prefix: "otto"})
+	seen := make(chan any, 1)
+	reg.OnState(func(name string, raw []byte, v any) {
+		assert.Equal(t, "src", name)
+		assert.Equal(t, []byte("5"), raw)
+		seen <- v
+	})
+	src := testutils.NewSource[int]("src", 1)
+	WireSource(ctx, reg, src, codec.JSON[int]{})
+
+	src.Emit(5)
+	v, ok := testutils.WaitRecv(seen, time.Second)
+	require.True(t, ok)
+	assert.Equal(t, 5, v)
+}